@@ -0,0 +1,9 @@
+-- Chunks flagged as possible prompt injection at ingest time are kept for
+-- review but excluded from retrieval.
+ALTER TABLE aiknowledge
+    ADD COLUMN IF NOT EXISTS quarantined BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS quarantine_reason TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS aiknowledge_quarantined_idx
+    ON aiknowledge (user_id)
+    WHERE quarantined;
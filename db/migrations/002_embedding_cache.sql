@@ -0,0 +1,11 @@
+-- Content-addressed embedding cache shared by the assistant and ingest.
+-- cache_key is "<provider>#<model>#<sha256 of whitespace-normalized text>";
+-- plain arrays are used because cached models differ in dimension.
+CREATE TABLE IF NOT EXISTS embedding_cache (
+    cache_key  TEXT PRIMARY KEY,
+    embedding  DOUBLE PRECISION[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS embedding_cache_created_at_idx
+    ON embedding_cache (created_at);
@@ -0,0 +1,27 @@
+-- Per-document metadata copied onto every chunk, so chat requests can
+-- filter retrieval by tags, date range, document ID or metadata values
+-- inside the vector search.
+ALTER TABLE aiknowledge
+    ADD COLUMN IF NOT EXISTS document_id TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS document_date DATE,
+    ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '[]'::jsonb,
+    ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+-- Chunks ingested earlier get one ID per user and document name; their
+-- date stays NULL, so date-range filters leave them out.
+UPDATE aiknowledge
+    SET document_id = md5(user_id || '/' || document_name)
+    WHERE document_id = '';
+
+CREATE INDEX IF NOT EXISTS aiknowledge_document_idx
+    ON aiknowledge (user_id, document_id);
+
+CREATE INDEX IF NOT EXISTS aiknowledge_document_date_idx
+    ON aiknowledge (user_id, document_date);
+
+-- jsonb_path_ops serves the @> containment the filters use
+CREATE INDEX IF NOT EXISTS aiknowledge_tags_idx
+    ON aiknowledge USING GIN (tags jsonb_path_ops);
+
+CREATE INDEX IF NOT EXISTS aiknowledge_metadata_idx
+    ON aiknowledge USING GIN (metadata jsonb_path_ops);
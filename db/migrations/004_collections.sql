@@ -0,0 +1,46 @@
+-- Knowledge-base collections shared between users. A collection is owned by
+-- a principal ("user:<sub>" or "team:<Cognito group>"), and members hold
+-- the owner, editor or reader role. Retrieval searches every collection
+-- the caller's principals can read.
+CREATE TABLE IF NOT EXISTS collections (
+    collection_id TEXT PRIMARY KEY,
+    name          TEXT NOT NULL,
+    owner         TEXT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS collection_members (
+    collection_id TEXT NOT NULL REFERENCES collections ON DELETE CASCADE,
+    principal     TEXT NOT NULL,
+    role          TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'reader')),
+    PRIMARY KEY (collection_id, principal)
+);
+
+CREATE INDEX IF NOT EXISTS collection_members_principal_idx
+    ON collection_members (principal, collection_id);
+
+-- Existing chunks move to their uploader's personal collection; user_id
+-- stays as the uploader.
+ALTER TABLE aiknowledge ADD COLUMN IF NOT EXISTS collection_id TEXT;
+
+INSERT INTO collections (collection_id, name, owner)
+    SELECT DISTINCT 'personal:' || user_id, 'Personal', 'user:' || user_id FROM aiknowledge
+    ON CONFLICT DO NOTHING;
+
+INSERT INTO collection_members (collection_id, principal, role)
+    SELECT DISTINCT 'personal:' || user_id, 'user:' || user_id, 'owner' FROM aiknowledge
+    ON CONFLICT DO NOTHING;
+
+UPDATE aiknowledge SET collection_id = 'personal:' || user_id WHERE collection_id IS NULL;
+
+ALTER TABLE aiknowledge ALTER COLUMN collection_id SET NOT NULL;
+
+DO $$
+BEGIN
+    ALTER TABLE aiknowledge ADD CONSTRAINT aiknowledge_collection_fk
+        FOREIGN KEY (collection_id) REFERENCES collections ON DELETE CASCADE;
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+
+CREATE INDEX IF NOT EXISTS aiknowledge_collection_idx
+    ON aiknowledge (collection_id);
@@ -0,0 +1,13 @@
+-- Several organizations can share one deployment. Every collection and
+-- chunk belongs to one tenant, and all reads and writes filter on it, so
+-- a team or user principal from one tenant never matches another tenant's
+-- rows. Data written before tenants existed belongs to the default tenant.
+ALTER TABLE collections ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+ALTER TABLE aiknowledge ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+CREATE INDEX IF NOT EXISTS collections_tenant_idx
+    ON collections (tenant_id, collection_id);
+
+CREATE INDEX IF NOT EXISTS aiknowledge_tenant_collection_idx
+    ON aiknowledge (tenant_id, collection_id);
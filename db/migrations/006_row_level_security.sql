@@ -0,0 +1,55 @@
+-- Row-level security on aiknowledge, so isolation no longer depends on every
+-- query carrying the right WHERE clause. The services set the caller's
+-- verified identity per transaction with set_config(..., true):
+--
+--   yoursai.tenant_id   the tenant ID
+--   yoursai.user_id     the tenant-scoped user ID
+--   yoursai.principals  the caller's principals as a text[] literal
+--
+-- A transaction that sets none of them sees and changes nothing. FORCE
+-- applies the policies to the table owner too, so maintenance that has to
+-- see every row needs a role with BYPASSRLS.
+
+-- yoursai_has_role reports whether any of the caller's principals holds one
+-- of roles on the collection, which must belong to the caller's tenant:
+-- principals are not tenant-scoped, so "team:eng" in one tenant would
+-- otherwise match a collection shared with "team:eng" in another.
+CREATE OR REPLACE FUNCTION yoursai_has_role(collection TEXT, roles TEXT[]) RETURNS BOOLEAN
+    LANGUAGE sql STABLE AS $$
+    SELECT EXISTS (
+        SELECT 1 FROM collection_members m JOIN collections c ON c.collection_id = m.collection_id
+        WHERE m.collection_id = collection
+          AND c.tenant_id = current_setting('yoursai.tenant_id', true)
+          AND m.principal = ANY (NULLIF(current_setting('yoursai.principals', true), '')::text[])
+          AND m.role = ANY (roles))
+$$;
+
+ALTER TABLE aiknowledge ENABLE ROW LEVEL SECURITY;
+ALTER TABLE aiknowledge FORCE ROW LEVEL SECURITY;
+
+-- Readers of a collection see its chunks in their own tenant
+DROP POLICY IF EXISTS aiknowledge_select ON aiknowledge;
+CREATE POLICY aiknowledge_select ON aiknowledge FOR SELECT
+    USING (tenant_id = current_setting('yoursai.tenant_id', true)
+           AND yoursai_has_role(collection_id, '{owner,editor,reader}'));
+
+-- Owners and editors add chunks, always as themselves
+DROP POLICY IF EXISTS aiknowledge_insert ON aiknowledge;
+CREATE POLICY aiknowledge_insert ON aiknowledge FOR INSERT
+    WITH CHECK (tenant_id = current_setting('yoursai.tenant_id', true)
+                AND user_id = current_setting('yoursai.user_id', true)
+                AND yoursai_has_role(collection_id, '{owner,editor}'));
+
+-- Owners and editors change and delete chunks, and cannot move them to a
+-- collection or tenant they do not write to
+DROP POLICY IF EXISTS aiknowledge_update ON aiknowledge;
+CREATE POLICY aiknowledge_update ON aiknowledge FOR UPDATE
+    USING (tenant_id = current_setting('yoursai.tenant_id', true)
+           AND yoursai_has_role(collection_id, '{owner,editor}'))
+    WITH CHECK (tenant_id = current_setting('yoursai.tenant_id', true)
+                AND yoursai_has_role(collection_id, '{owner,editor}'));
+
+DROP POLICY IF EXISTS aiknowledge_delete ON aiknowledge;
+CREATE POLICY aiknowledge_delete ON aiknowledge FOR DELETE
+    USING (tenant_id = current_setting('yoursai.tenant_id', true)
+           AND yoursai_has_role(collection_id, '{owner,editor}'));
@@ -1,7 +1,16 @@
 import axios from 'axios';
 import { API_URL, CHAT_ENDPOINT, INGEST_ENDPOINT } from '@/env';
 import { getToken } from './auth';
-import type { ChatRequest, ChatResponse, IngestRequest, IngestResponse, Session } from './types';
+import type {
+  ChatRequest,
+  ChatResponse,
+  Collection,
+  CollectionMember,
+  IngestRequest,
+  IngestResponse,
+  Persona,
+  Session,
+} from './types';
 
 const api = axios.create({
   baseURL: API_URL,
@@ -22,10 +31,22 @@ export const chatApi = {
   sendMessage: (data: ChatRequest) => api.post<ChatResponse>(CHAT_ENDPOINT, data),
   getSessions: () => api.get<Session[]>('/sessions'),
   createSession: (name: string) => api.post<Session>('/sessions', { name }),
+  getPersonas: () => api.get<Persona[]>('/personas'),
 };
 
 export const ingestApi = {
   uploadDocument: (data: IngestRequest) => api.post<IngestResponse>(INGEST_ENDPOINT, data),
 };
 
+export const collectionsApi = {
+  list: () => api.get<Collection[]>('/collections'),
+  create: (name: string, team?: string) => api.post<Collection>('/collections', { name, team }),
+  members: (collectionId: string) =>
+    api.get<CollectionMember[]>(`/collections/${encodeURIComponent(collectionId)}/members`),
+  setMember: (collectionId: string, member: CollectionMember) =>
+    api.put<CollectionMember>(`/collections/${encodeURIComponent(collectionId)}/members`, member),
+  removeMember: (collectionId: string, principal: string) =>
+    api.delete(`/collections/${encodeURIComponent(collectionId)}/members/${encodeURIComponent(principal)}`),
+};
+
 export default api;
@@ -28,19 +28,64 @@ export interface Document {
 export interface ChatRequest {
   sessionId: string;
   message: string;
+  persona?: string;
+  retrievalStrategy?: 'single' | 'multi-query' | 'hyde' | 'multi-query+hyde';
+  filter?: MetadataFilter;
+}
+
+// Every set field must match; dates are YYYY-MM-DD and inclusive
+export interface MetadataFilter {
+  tags?: string[];
+  documentIds?: string[];
+  collectionIds?: string[];
+  dateFrom?: string;
+  dateTo?: string;
+  metadata?: Record<string, unknown>;
+}
+
+export interface Persona {
+  name: string;
+  version: number;
+  description: string;
 }
 
 export interface ChatResponse {
   reply: string;
   sessionId: string;
+  provider?: string;
+  model?: string;
+  warnings?: string[];
 }
 
 export interface IngestRequest {
   documentName: string;
   text: string;
+  collectionId?: string; // defaults to the caller's personal collection
+  metadata?: Record<string, unknown>;
+  tags?: string[];
+  documentDate?: string; // YYYY-MM-DD
 }
 
 export interface IngestResponse {
   message: string;
+  documentId: string;
+  collectionId: string;
   chunks: number;
+  quarantined?: number;
+}
+
+// Principals are "user:<sub>" or "team:<Cognito group>"
+export type CollectionRole = 'owner' | 'editor' | 'reader';
+
+export interface Collection {
+  collectionId: string;
+  name: string;
+  owner: string;
+  role?: CollectionRole;
+  createdAt: string;
+}
+
+export interface CollectionMember {
+  principal: string;
+  role: CollectionRole;
 }
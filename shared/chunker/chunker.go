@@ -0,0 +1,26 @@
+// Package chunker splits documents into the chunks yoursai-ingest embeds and
+// stores. The evaluation tools and the bulk ingest CLI use it too, so their
+// chunk counts and scores match what production stores.
+package chunker
+
+import "strings"
+
+// Split cuts text into chunks of about maxTokens tokens, counting one token
+// as 0.75 words. Whitespace is collapsed to single spaces.
+func Split(text string, maxTokens int) []string {
+	words := strings.Fields(text)
+	wordsPerChunk := maxTokens * 3 / 4
+	if wordsPerChunk < 1 {
+		wordsPerChunk = 1
+	}
+
+	var chunks []string
+	for i := 0; i < len(words); i += wordsPerChunk {
+		end := i + wordsPerChunk
+		if end > len(words) {
+			end = len(words)
+		}
+		chunks = append(chunks, strings.Join(words[i:end], " "))
+	}
+	return chunks
+}
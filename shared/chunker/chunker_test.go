@@ -0,0 +1,38 @@
+package chunker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		maxTokens int
+		want      []string
+	}{
+		{"empty", "  \n ", 8, nil},
+		{"one chunk", "a b c", 8, []string{"a b c"}},
+		{"collapses whitespace", "a\n\nb\tc", 8, []string{"a b c"}},
+		{"splits at six words per eight tokens", "1 2 3 4 5 6 7 8", 8, []string{"1 2 3 4 5 6", "7 8"}},
+		{"tiny limit still advances", "a b", 1, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := Split(tt.text, tt.maxTokens); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Split = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitKeepsEveryWord(t *testing.T) {
+	text := strings.Repeat("word ", 1001)
+	chunks := Split(text, 500)
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(chunks))
+	}
+	if got := strings.Join(chunks, " "); got != strings.TrimSpace(text) {
+		t.Error("joined chunks differ from the input")
+	}
+}
@@ -0,0 +1,222 @@
+// Package embedcache keeps embeddings keyed by provider, model and text, in an
+// in-memory LRU backed by Postgres or DynamoDB, so the same text is not paid
+// for twice.
+package embedcache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lib/pq"
+)
+
+// Key addresses an embedding by provider, model and a hash of
+// the normalized text, so identical text is only ever embedded once per model.
+func Key(provider, model, text string) string {
+	sum := sha256.Sum256([]byte(normalize(text)))
+	return provider + "#" + model + "#" + hex.EncodeToString(sum[:])
+}
+
+// normalize collapses whitespace, which changes nothing the
+// embedding model cares about but varies between otherwise equal inputs.
+func normalize(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// Store is the durable layer behind the in-memory LRU.
+type Store interface {
+	Get(ctx context.Context, key string) ([]float64, bool, error)
+	Put(ctx context.Context, key string, embedding []float64) error
+}
+
+// Cache checks a per-container LRU first and the durable store on a
+// miss. Store errors are logged and treated as misses: the cache must never
+// be the reason an embedding fails.
+type Cache struct {
+	lru   *lru
+	store Store // nil for LRU only
+}
+
+// New returns a cache holding up to lruSize vectors in memory in front of
+// store, which may be nil.
+func New(lruSize int, store Store) *Cache {
+	return &Cache{lru: newLRU(lruSize), store: store}
+}
+
+func (c *Cache) Get(ctx context.Context, key string) ([]float64, bool) {
+	if embedding, ok := c.lru.get(key); ok {
+		return embedding, true
+	}
+	if c.store == nil {
+		return nil, false
+	}
+	embedding, ok, err := c.store.Get(ctx, key)
+	if err != nil {
+		slog.WarnContext(ctx, "Embedding cache lookup failed", "error", err)
+		return nil, false
+	}
+	if ok {
+		c.lru.put(key, embedding)
+	}
+	return embedding, ok
+}
+
+func (c *Cache) Put(ctx context.Context, key string, embedding []float64) {
+	c.lru.put(key, embedding)
+	if c.store == nil {
+		return
+	}
+	if err := c.store.Put(ctx, key, embedding); err != nil {
+		slog.WarnContext(ctx, "Embedding cache write failed", "error", err)
+	}
+}
+
+type lru struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front is most recently used
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key       string
+	embedding []float64
+}
+
+func newLRU(capacity int) *lru {
+	return &lru{capacity: capacity, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (l *lru) get(key string) ([]float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	// Hand out a copy so callers can't corrupt the cached vector
+	return append([]float64(nil), el.Value.(*lruEntry).embedding...), true
+}
+
+func (l *lru) put(key string, embedding []float64) {
+	// Keep our own copy; the caller still holds the slice it passed in
+	embedding = append([]float64(nil), embedding...)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.items[key]; ok {
+		el.Value.(*lruEntry).embedding = embedding
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[key] = l.order.PushFront(&lruEntry{key: key, embedding: embedding})
+	for l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Postgres keeps embeddings in the embedding_cache table
+// (db/migrations/002_embedding_cache.sql).
+type Postgres struct {
+	db *sql.DB
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (s *Postgres) Get(ctx context.Context, key string) ([]float64, bool, error) {
+	var embedding pq.Float64Array
+	err := s.db.QueryRowContext(ctx,
+		`SELECT embedding FROM embedding_cache WHERE cache_key = $1`, key).Scan(&embedding)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return embedding, true, nil
+}
+
+func (s *Postgres) Put(ctx context.Context, key string, embedding []float64) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO embedding_cache (cache_key, embedding) VALUES ($1, $2) ON CONFLICT (cache_key) DO NOTHING`,
+		key, pq.Array(embedding))
+	return err
+}
+
+// Dynamo keeps embeddings as packed float64s, with a TTL so
+// vectors for text nobody asks about any more age out.
+type Dynamo struct {
+	client *dynamodb.Client
+	table  string
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewDynamo returns a store keeping entries in table for ttl. now is the
+// clock; nil means time.Now.
+func NewDynamo(client *dynamodb.Client, table string, ttl time.Duration, now func() time.Time) *Dynamo {
+	if now == nil {
+		now = time.Now
+	}
+	return &Dynamo{client: client, table: table, ttl: ttl, now: now}
+}
+
+func (s *Dynamo) Get(ctx context.Context, key string) ([]float64, bool, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"cacheKey": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	packed, ok := out.Item["embedding"].(*types.AttributeValueMemberB)
+	if !ok {
+		return nil, false, nil
+	}
+	if len(packed.Value)%8 != 0 {
+		return nil, false, fmt.Errorf("corrupt cached embedding for %s", key)
+	}
+	embedding := make([]float64, len(packed.Value)/8)
+	for i := range embedding {
+		embedding[i] = math.Float64frombits(binary.LittleEndian.Uint64(packed.Value[i*8:]))
+	}
+	return embedding, true, nil
+}
+
+func (s *Dynamo) Put(ctx context.Context, key string, embedding []float64) error {
+	packed := make([]byte, len(embedding)*8)
+	for i, v := range embedding {
+		binary.LittleEndian.PutUint64(packed[i*8:], math.Float64bits(v))
+	}
+	now := s.now()
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"cacheKey":  &types.AttributeValueMemberS{Value: key},
+			"embedding": &types.AttributeValueMemberB{Value: packed},
+			"createdAt": &types.AttributeValueMemberS{Value: now.UTC().Format(time.RFC3339)},
+			"expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(s.ttl).Unix(), 10)},
+		},
+	})
+	return err
+}
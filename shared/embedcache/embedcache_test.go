@@ -0,0 +1,49 @@
+package embedcache
+
+import (
+	"context"
+	"testing"
+)
+
+func TestKeyIgnoresWhitespace(t *testing.T) {
+	if Key("gemini", "m", "a  b\n c") != Key("gemini", "m", "a b c") {
+		t.Error("whitespace changed the key")
+	}
+	if Key("gemini", "m", "a") == Key("openai", "m", "a") {
+		t.Error("provider is not part of the key")
+	}
+}
+
+type mapStore map[string][]float64
+
+func (s mapStore) Get(ctx context.Context, key string) ([]float64, bool, error) {
+	v, ok := s[key]
+	return v, ok, nil
+}
+
+func (s mapStore) Put(ctx context.Context, key string, embedding []float64) error {
+	s[key] = embedding
+	return nil
+}
+
+func TestCacheEvictsToStore(t *testing.T) {
+	ctx := context.Background()
+	store := mapStore{}
+	c := New(2, store)
+	c.Put(ctx, "a", []float64{1})
+	c.Put(ctx, "b", []float64{2})
+	c.Put(ctx, "c", []float64{3})
+
+	if _, ok := c.lru.get("a"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	got, ok := c.Get(ctx, "a")
+	if !ok || got[0] != 1 {
+		t.Errorf("Get(a) = %v, %v; want it from the store", got, ok)
+	}
+
+	got[0] = 99
+	if again, _ := c.Get(ctx, "a"); again[0] != 1 {
+		t.Error("caller mutated the cached vector")
+	}
+}
@@ -0,0 +1,139 @@
+// Package llm builds and parses one short, non-conversational generation
+// against Gemini or OpenAI, for helper stages such as classifiers and query
+// rewriting. Callers keep their own client, retries, throttling and
+// metrics; the wire formats live here so every service speaks them alike.
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Completion is a system instruction and one user prompt, answered
+// deterministically in at most MaxTokens.
+type Completion struct {
+	Provider  string // "gemini" or "openai"
+	Model     string
+	URL       string // Gemini generateContent for Model, or OpenAI chat completions
+	APIKey    string
+	System    string
+	Prompt    string
+	MaxTokens int
+}
+
+// Request builds the provider request for c. Its ContentLength is the size
+// of the JSON body, which callers use to estimate prompt tokens.
+func (c Completion) Request(ctx context.Context) (*http.Request, error) {
+	var payload map[string]interface{}
+	url := c.URL
+	switch c.Provider {
+	case "gemini":
+		payload = map[string]interface{}{
+			"systemInstruction": map[string]interface{}{
+				"parts": []map[string]string{{"text": c.System}},
+			},
+			"contents": []map[string]interface{}{
+				{"role": "user", "parts": []map[string]string{{"text": c.Prompt}}},
+			},
+			"generationConfig": map[string]interface{}{
+				"maxOutputTokens": c.MaxTokens,
+				"temperature":     0,
+			},
+		}
+		url += "?key=" + c.APIKey
+	case "openai":
+		payload = map[string]interface{}{
+			"model": c.Model,
+			"messages": []map[string]string{
+				{"role": "system", "content": c.System},
+				{"role": "user", "content": c.Prompt},
+			},
+			"max_tokens":  c.MaxTokens,
+			"temperature": 0,
+		}
+	default:
+		return nil, fmt.Errorf("no AI provider configured")
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Provider == "openai" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	return req, nil
+}
+
+// Text extracts the reply from a decoded response of provider.
+func Text(provider string, result map[string]interface{}) (string, error) {
+	if provider == "gemini" {
+		text, _, err := GeminiReply(result)
+		return text, err
+	}
+	return OpenAIReply(result)
+}
+
+// GeminiReply extracts the first candidate's text and finish reason.
+func GeminiReply(result map[string]interface{}) (string, string, error) {
+	candidates, ok := result["candidates"].([]interface{})
+	if !ok || len(candidates) == 0 {
+		return "", "", fmt.Errorf("no candidates in response")
+	}
+	candidate, ok := candidates[0].(map[string]interface{})
+	if !ok {
+		return "", "", fmt.Errorf("invalid AI response format")
+	}
+	finishReason, _ := candidate["finishReason"].(string)
+
+	content, contentOk := candidate["content"].(map[string]interface{})
+	parts, partsOk := content["parts"].([]interface{})
+	if !contentOk || !partsOk || len(parts) == 0 {
+		return "", finishReason, fmt.Errorf("invalid AI response format")
+	}
+	partMap, partOk := parts[0].(map[string]interface{})
+	text, textOk := partMap["text"].(string)
+	if !partOk || !textOk {
+		return "", finishReason, fmt.Errorf("invalid AI response format")
+	}
+	return text, finishReason, nil
+}
+
+// OpenAIReply extracts the first choice's message content.
+func OpenAIReply(result map[string]interface{}) (string, error) {
+	choices, ok := result["choices"].([]interface{})
+	if !ok || len(choices) == 0 {
+		return "", fmt.Errorf("no choices in response")
+	}
+	choice, choiceOk := choices[0].(map[string]interface{})
+	message, messageOk := choice["message"].(map[string]interface{})
+	if !choiceOk || !messageOk {
+		return "", fmt.Errorf("invalid AI response format")
+	}
+	content, _ := message["content"].(string)
+	return content, nil
+}
+
+// Usage reads Gemini usageMetadata or OpenAI usage from a decoded
+// generation response.
+func Usage(result map[string]interface{}) (prompt, completion int) {
+	if meta, ok := result["usageMetadata"].(map[string]interface{}); ok {
+		p, _ := meta["promptTokenCount"].(float64)
+		c, _ := meta["candidatesTokenCount"].(float64)
+		return int(p), int(c)
+	}
+	if usage, ok := result["usage"].(map[string]interface{}); ok {
+		p, _ := usage["prompt_tokens"].(float64)
+		c, _ := usage["completion_tokens"].(float64)
+		return int(p), int(c)
+	}
+	return 0, 0
+}
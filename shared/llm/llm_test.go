@@ -0,0 +1,94 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestRequest(t *testing.T) {
+	tests := []struct {
+		provider string
+		url      string
+		auth     string
+		check    func(t *testing.T, payload map[string]interface{})
+	}{
+		{"gemini", "https://gemini.test/models/m:generateContent?key=k", "", func(t *testing.T, payload map[string]interface{}) {
+			config, _ := payload["generationConfig"].(map[string]interface{})
+			if config["maxOutputTokens"] != 5.0 || config["temperature"] != 0.0 {
+				t.Errorf("generationConfig = %v", config)
+			}
+			if _, ok := payload["systemInstruction"]; !ok {
+				t.Error("no systemInstruction")
+			}
+		}},
+		{"openai", "https://openai.test/chat", "Bearer k", func(t *testing.T, payload map[string]interface{}) {
+			if payload["model"] != "m" || payload["max_tokens"] != 5.0 || payload["temperature"] != 0.0 {
+				t.Errorf("payload = %v", payload)
+			}
+			if messages, _ := payload["messages"].([]interface{}); len(messages) != 2 {
+				t.Errorf("messages = %v, want system and user", payload["messages"])
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			base := "https://openai.test/chat"
+			if tt.provider == "gemini" {
+				base = "https://gemini.test/models/m:generateContent"
+			}
+			c := Completion{Provider: tt.provider, Model: "m", URL: base, APIKey: "k", System: "be brief", Prompt: "hi", MaxTokens: 5}
+			req, err := c.Request(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.URL.String() != tt.url || req.Header.Get("Authorization") != tt.auth {
+				t.Errorf("request = %s with auth %q", req.URL, req.Header.Get("Authorization"))
+			}
+			if req.ContentLength <= 0 {
+				t.Errorf("ContentLength = %d", req.ContentLength)
+			}
+			var payload map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, payload)
+		})
+	}
+
+	if _, err := (Completion{Provider: "other"}).Request(context.Background()); err == nil {
+		t.Error("unknown provider: want an error")
+	}
+}
+
+func TestTextAndUsage(t *testing.T) {
+	gemini := map[string]interface{}{
+		"candidates": []interface{}{map[string]interface{}{
+			"content":      map[string]interface{}{"parts": []interface{}{map[string]interface{}{"text": "SAFE"}}},
+			"finishReason": "STOP",
+		}},
+		"usageMetadata": map[string]interface{}{"promptTokenCount": 12.0, "candidatesTokenCount": 1.0},
+	}
+	openai := map[string]interface{}{
+		"choices": []interface{}{map[string]interface{}{"message": map[string]interface{}{"content": "INJECTION"}}},
+		"usage":   map[string]interface{}{"prompt_tokens": 20.0, "completion_tokens": 2.0},
+	}
+	if text, err := Text("gemini", gemini); err != nil || text != "SAFE" {
+		t.Errorf("gemini text = %q, %v", text, err)
+	}
+	if text, err := Text("openai", openai); err != nil || text != "INJECTION" {
+		t.Errorf("openai text = %q, %v", text, err)
+	}
+	if p, c := Usage(gemini); p != 12 || c != 1 {
+		t.Errorf("gemini usage = %d/%d", p, c)
+	}
+	if p, c := Usage(openai); p != 20 || c != 2 {
+		t.Errorf("openai usage = %d/%d", p, c)
+	}
+	if _, err := Text("gemini", map[string]interface{}{}); err == nil {
+		t.Error("empty gemini response: want an error")
+	}
+	if _, err := Text("openai", map[string]interface{}{"choices": []interface{}{"x"}}); err == nil {
+		t.Error("malformed openai response: want an error")
+	}
+}
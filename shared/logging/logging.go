@@ -0,0 +1,89 @@
+// Package logging writes JSON logs through slog with per-request fields
+// carried on the context.
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// contentPreview is how many characters of logged text Content keeps.
+var contentPreview int
+
+// Init sends JSON logs to stdout at level ("debug", "info", ...; anything
+// else means info). Anything still using the standard log package goes
+// through the same handler. contentPreview is the number of characters
+// Content keeps of logged text; zero logs only a hash and the length.
+func Init(level string, preview int) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		l = slog.LevelInfo
+	}
+	contentPreview = preview
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: l})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+type logFieldsKey struct{}
+
+// WithFields returns a context whose log records carry the given
+// key/value pairs, such as the request ID, user and session.
+func WithFields(ctx context.Context, args ...any) context.Context {
+	fields, _ := ctx.Value(logFieldsKey{}).([]slog.Attr)
+	var r slog.Record
+	r.Add(args...)
+	merged := append([]slog.Attr(nil), fields...)
+	r.Attrs(func(a slog.Attr) bool {
+		merged = append(merged, a)
+		return true
+	})
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+// contextHandler adds the fields stored by WithFields to every record
+// logged with a context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if fields, ok := ctx.Value(logFieldsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(fields...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Content logs user or model text without putting it in the logs: only a
+// hash and the length are written, plus a short prefix if Init was given a
+// preview length. Debug logging writes the full text.
+func Content(key, text string) slog.Attr {
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return slog.String(key, text)
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	attrs := []any{
+		slog.String("sha256", hex.EncodeToString(sum[:8])),
+		slog.Int("length", len(text)),
+	}
+	if contentPreview > 0 {
+		preview := []rune(text)
+		if len(preview) > contentPreview {
+			preview = preview[:contentPreview]
+		}
+		attrs = append(attrs, slog.String("preview", strings.TrimSpace(string(preview))))
+	}
+	return slog.Group(key, attrs...)
+}
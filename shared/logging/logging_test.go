@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func capture(t *testing.T, level slog.Level) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func TestWithFields(t *testing.T) {
+	buf := capture(t, slog.LevelInfo)
+	ctx := WithFields(context.Background(), "requestId", "r1")
+	ctx = WithFields(ctx, "userId", "u1")
+	slog.InfoContext(ctx, "hello")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["requestId"] != "r1" || record["userId"] != "u1" {
+		t.Errorf("record = %v", record)
+	}
+}
+
+func TestContent(t *testing.T) {
+	capture(t, slog.LevelInfo)
+	defer func(p int) { contentPreview = p }(contentPreview)
+
+	contentPreview = 0
+	if got := Content("message", "secret text").String(); bytes.Contains([]byte(got), []byte("secret")) {
+		t.Errorf("hashed content leaked the text: %s", got)
+	}
+
+	contentPreview = 6
+	if got := Content("message", "secret text").String(); !bytes.Contains([]byte(got), []byte("preview=secret")) {
+		t.Errorf("preview missing: %s", got)
+	}
+
+	capture(t, slog.LevelDebug)
+	if got := Content("message", "secret text").Value.String(); got != "secret text" {
+		t.Errorf("debug content = %q", got)
+	}
+}
@@ -0,0 +1,233 @@
+// Package ratelimit hands out per-key token buckets, in memory for local runs
+// or in DynamoDB so every Lambda instance shares the same limit.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Decision is the outcome of taking one token from a bucket.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// Limiter hands out tokens from a per-key token bucket.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (Decision, error)
+}
+
+// bucketSpec describes a token bucket that refills perMin tokens every minute
+// and can hold up to window seconds worth of tokens as burst.
+type bucketSpec struct {
+	perMin int
+	window int
+}
+
+func (b bucketSpec) capacity() float64 {
+	return float64(b.perMin) * float64(b.window) / 60
+}
+
+func (b bucketSpec) refillPerSecond() float64 {
+	return float64(b.perMin) / 60
+}
+
+// take refills a bucket for the elapsed time and tries to remove one token.
+func (b bucketSpec) take(tokens float64, last, now time.Time) (float64, Decision) {
+	elapsed := now.Sub(last).Seconds()
+	if elapsed > 0 {
+		tokens = math.Min(b.capacity(), tokens+elapsed*b.refillPerSecond())
+	}
+
+	decision := Decision{Limit: b.perMin}
+	if tokens >= 1 {
+		tokens--
+		decision.Allowed = true
+		decision.Remaining = int(tokens)
+		return tokens, decision
+	}
+
+	wait := (1 - tokens) / b.refillPerSecond()
+	decision.RetryAfter = time.Duration(math.Ceil(wait)) * time.Second
+	return tokens, decision
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Memory keeps buckets in process memory. It is meant for local runs and
+// tests; every Lambda instance would otherwise get its own allowance.
+type Memory struct {
+	spec    bucketSpec
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+// NewMemory returns a limiter allowing perMin requests a minute with a burst
+// of window seconds' worth. now is the clock; nil means time.Now.
+func NewMemory(perMin, window int, now func() time.Time) *Memory {
+	if now == nil {
+		now = time.Now
+	}
+	return &Memory{
+		spec:    bucketSpec{perMin: perMin, window: window},
+		now:     now,
+		buckets: map[string]*memoryBucket{},
+	}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string) (Decision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: m.spec.capacity(), last: now}
+		m.buckets[key] = b
+	}
+
+	tokens, decision := m.spec.take(b.tokens, b.last, now)
+	b.tokens = tokens
+	b.last = now
+	return decision, nil
+}
+
+// DynamoClient is the part of *dynamodb.Client the Dynamo limiter uses.
+type DynamoClient interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// Dynamo stores one bucket per key in DynamoDB and updates it with a
+// conditional write, so concurrent Lambda instances share the same limit.
+type Dynamo struct {
+	client DynamoClient
+	table  string
+	spec   bucketSpec
+	now    func() time.Time
+}
+
+const maxAttempts = 5
+
+// NewDynamo returns a limiter keeping its buckets in table. now is the
+// clock; nil means time.Now.
+func NewDynamo(client DynamoClient, table string, perMin, window int, now func() time.Time) *Dynamo {
+	if now == nil {
+		now = time.Now
+	}
+	return &Dynamo{
+		client: client,
+		table:  table,
+		spec:   bucketSpec{perMin: perMin, window: window},
+		now:    now,
+	}
+}
+
+func (d *Dynamo) Allow(ctx context.Context, key string) (Decision, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(d.table),
+			Key:            map[string]types.AttributeValue{"bucketKey": &types.AttributeValueMemberS{Value: key}},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return Decision{}, err
+		}
+
+		now := d.now()
+		tokens := d.spec.capacity()
+		last := now
+		var prevUpdated string
+		if out.Item != nil {
+			tokens, last, prevUpdated, err = parseBucketItem(out.Item)
+			if err != nil {
+				return Decision{}, err
+			}
+		}
+
+		tokens, decision := d.spec.take(tokens, last, now)
+		if !decision.Allowed {
+			return decision, nil
+		}
+
+		input := &dynamodb.PutItemInput{
+			TableName: aws.String(d.table),
+			Item: map[string]types.AttributeValue{
+				"bucketKey": &types.AttributeValueMemberS{Value: key},
+				"tokens":    &types.AttributeValueMemberN{Value: strconv.FormatFloat(tokens, 'f', -1, 64)},
+				"updatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixNano(), 10)},
+				// Idle buckets are full again after one window, so let TTL remove them.
+				"expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(2*time.Duration(d.spec.window)*time.Second).Unix(), 10)},
+			},
+		}
+		if prevUpdated == "" {
+			input.ConditionExpression = aws.String("attribute_not_exists(bucketKey)")
+		} else {
+			input.ConditionExpression = aws.String("updatedAt = :prev")
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":prev": &types.AttributeValueMemberN{Value: prevUpdated},
+			}
+		}
+
+		_, err = d.client.PutItem(ctx, input)
+		if err == nil {
+			return decision, nil
+		}
+
+		// Another request updated the bucket between our read and write; re-read and try again.
+		var conflict *types.ConditionalCheckFailedException
+		if !errors.As(err, &conflict) {
+			return Decision{}, err
+		}
+	}
+	return Decision{}, fmt.Errorf("rate limit bucket %s is too contended", key)
+}
+
+func parseBucketItem(item map[string]types.AttributeValue) (float64, time.Time, string, error) {
+	tokensAttr, tokensOk := item["tokens"].(*types.AttributeValueMemberN)
+	updatedAttr, updatedOk := item["updatedAt"].(*types.AttributeValueMemberN)
+	if !tokensOk || !updatedOk {
+		return 0, time.Time{}, "", fmt.Errorf("invalid rate limit bucket item")
+	}
+
+	tokens, err := strconv.ParseFloat(tokensAttr.Value, 64)
+	if err != nil {
+		return 0, time.Time{}, "", fmt.Errorf("invalid rate limit tokens: %v", err)
+	}
+	updatedNanos, err := strconv.ParseInt(updatedAttr.Value, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, "", fmt.Errorf("invalid rate limit timestamp: %v", err)
+	}
+	return tokens, time.Unix(0, updatedNanos), updatedAttr.Value, nil
+}
+
+// Headers builds the headers returned with every rate-limited response.
+func Headers(d Decision) map[string]string {
+	headers := map[string]string{
+		"Access-Control-Allow-Origin":   "*",
+		"Access-Control-Expose-Headers": "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining",
+		"Content-Type":                  "application/json",
+		"X-RateLimit-Limit":             strconv.Itoa(d.Limit),
+		"X-RateLimit-Remaining":         strconv.Itoa(d.Remaining),
+	}
+	if !d.Allowed {
+		headers["Retry-After"] = strconv.Itoa(int(d.RetryAfter / time.Second))
+	}
+	return headers
+}
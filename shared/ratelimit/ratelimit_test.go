@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestMemoryAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		perMin  int
+		window  int
+		drain   int           // calls made before the checked one
+		advance time.Duration // then the clock moves
+		want    Decision
+	}{
+		{"burst allowed", 60, 120, 119, 0, Decision{Allowed: true, Limit: 60, Remaining: 0}},
+		{"past the burst", 60, 120, 120, 0, Decision{Limit: 60, RetryAfter: time.Second}},
+		{"refills with time", 60, 120, 120, time.Second, Decision{Allowed: true, Limit: 60, Remaining: 0}},
+		{"partial refill rounds Retry-After up", 60, 120, 120, 500 * time.Millisecond, Decision{Limit: 60, RetryAfter: time.Second}},
+		{"slow refill rounds Retry-After up", 7, 60, 7, 0, Decision{Limit: 7, RetryAfter: 9 * time.Second}},
+		{"refill stops at the burst", 60, 120, 120, time.Hour, Decision{Allowed: true, Limit: 60, Remaining: 119}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1700000000, 0)
+			m := NewMemory(tt.perMin, tt.window, func() time.Time { return now })
+			for i := 0; i < tt.drain; i++ {
+				if d, _ := m.Allow(context.Background(), "k"); !d.Allowed {
+					t.Fatalf("call %d denied inside the burst", i+1)
+				}
+			}
+			now = now.Add(tt.advance)
+			got, err := m.Allow(context.Background(), "k")
+			if err != nil || got != tt.want {
+				t.Errorf("Allow = %+v, %v; want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryKeysAreIndependent(t *testing.T) {
+	m := NewMemory(1, 60, func() time.Time { return time.Unix(0, 0) })
+	m.Allow(context.Background(), "a")
+	if d, _ := m.Allow(context.Background(), "a"); d.Allowed {
+		t.Error("second call on a one-token bucket allowed")
+	}
+	if d, _ := m.Allow(context.Background(), "b"); !d.Allowed {
+		t.Error("another key waited on a's bucket")
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	h := Headers(Decision{Limit: 60, RetryAfter: 9 * time.Second})
+	if h["Retry-After"] != "9" || h["X-RateLimit-Limit"] != "60" || h["X-RateLimit-Remaining"] != "0" {
+		t.Errorf("denied headers = %v", h)
+	}
+	if _, ok := Headers(Decision{Allowed: true, Limit: 60, Remaining: 3})["Retry-After"]; ok {
+		t.Error("Retry-After set on an allowed decision")
+	}
+}
+
+// fakeDynamo keeps items in memory and applies the two conditions Dynamo
+// writes with. Before each of the first race puts, another writer takes a
+// token and moves updatedAt, as a concurrent Lambda would.
+type fakeDynamo struct {
+	mu     sync.Mutex
+	items  map[string]map[string]types.AttributeValue
+	race   int
+	now    time.Time // the racing writer's clock
+	puts   int
+	putErr error
+}
+
+func (f *fakeDynamo) GetItem(ctx context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := in.Key["bucketKey"].(*types.AttributeValueMemberS).Value
+	return &dynamodb.GetItemOutput{Item: f.items[key]}, nil
+}
+
+func (f *fakeDynamo) PutItem(ctx context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.puts++
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+	key := in.Item["bucketKey"].(*types.AttributeValueMemberS).Value
+	if f.race > 0 {
+		f.race--
+		f.items[key] = map[string]types.AttributeValue{
+			"bucketKey": in.Item["bucketKey"],
+			"tokens":    &types.AttributeValueMemberN{Value: "1"},
+			"updatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(f.now.UnixNano()-int64(f.race), 10)},
+		}
+	}
+
+	current, exists := f.items[key]
+	switch cond := *in.ConditionExpression; {
+	case cond == "attribute_not_exists(bucketKey)" && exists,
+		strings.HasPrefix(cond, "updatedAt = ") && (!exists || current["updatedAt"].(*types.AttributeValueMemberN).Value != in.ExpressionAttributeValues[":prev"].(*types.AttributeValueMemberN).Value):
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	f.items[key] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestDynamoAllow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+
+	t.Run("creates and drains a bucket", func(t *testing.T) {
+		d := NewDynamo(&fakeDynamo{items: map[string]map[string]types.AttributeValue{}}, "t", 60, 2, clock)
+		for _, want := range []Decision{{Allowed: true, Limit: 60, Remaining: 1}, {Allowed: true, Limit: 60}, {Limit: 60, RetryAfter: time.Second}} {
+			if got, err := d.Allow(context.Background(), "k"); err != nil || got != want {
+				t.Errorf("Allow = %+v, %v; want %+v", got, err, want)
+			}
+		}
+	})
+
+	t.Run("re-reads after a conditional check fails", func(t *testing.T) {
+		fake := &fakeDynamo{items: map[string]map[string]types.AttributeValue{}, race: 2, now: now}
+		d := NewDynamo(fake, "t", 60, 120, clock)
+		got, err := d.Allow(context.Background(), "k")
+		// The other writer left one token, which this call takes
+		if err != nil || got != (Decision{Allowed: true, Limit: 60, Remaining: 0}) {
+			t.Errorf("Allow = %+v, %v; want the last token", got, err)
+		}
+		if fake.puts != 3 {
+			t.Errorf("puts = %d, want 2 conflicts and a write", fake.puts)
+		}
+	})
+
+	t.Run("gives up on a contended bucket", func(t *testing.T) {
+		fake := &fakeDynamo{items: map[string]map[string]types.AttributeValue{}, race: maxAttempts, now: now}
+		_, err := NewDynamo(fake, "t", 60, 120, clock).Allow(context.Background(), "k")
+		if err == nil || !strings.Contains(err.Error(), "too contended") || fake.puts != maxAttempts {
+			t.Errorf("err = %v after %d puts, want too contended after %d", err, fake.puts, maxAttempts)
+		}
+	})
+
+	t.Run("returns other write errors", func(t *testing.T) {
+		boom := errors.New("throughput exceeded")
+		fake := &fakeDynamo{items: map[string]map[string]types.AttributeValue{}, putErr: boom}
+		if _, err := NewDynamo(fake, "t", 60, 120, clock).Allow(context.Background(), "k"); !errors.Is(err, boom) || fake.puts != 1 {
+			t.Errorf("err = %v after %d puts, want the write error at once", err, fake.puts)
+		}
+	})
+}
@@ -0,0 +1,207 @@
+// Package redact masks personal data with numbered placeholders before text
+// leaves for a model provider, and restores it in what comes back.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// piiDetector finds one kind of PII. validate, when set, weeds out regex
+// matches that fail the identifier's checksum or structure rules.
+type piiDetector struct {
+	kind     string
+	re       *regexp.Regexp
+	validate func(match string) bool
+}
+
+var piiDetectors = []piiDetector{
+	{"EMAIL", regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`), nil},
+	{"CARD", regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`), luhnValid},
+	{"IBAN", regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`), ibanValid},
+	{"SSN", regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), ssnValid},
+	{"AADHAAR", regexp.MustCompile(`\b[2-9]\d{3}[ \-]?\d{4}[ \-]?\d{4}\b`), verhoeffValid},
+	{"PAN", regexp.MustCompile(`\b[A-Z]{3}[PCHFATBLJG][A-Z]\d{4}[A-Z]\b`), nil},
+	{"PHONE", regexp.MustCompile(`(?:\+\d{1,3}[ \-.]?)?\(?\d{2,4}\)?[ \-.]?\d{3,4}[ \-.]?\d{3,4}\b`), phoneValid},
+}
+
+// Vault masks PII with numbered placeholders such as [EMAIL_1] and can put
+// the original values back. Use one vault for everything that must share
+// placeholders: a chat request, or every chunk of a document.
+type Vault struct {
+	enabled bool
+	values  map[string]string // placeholder -> original
+	byValue map[string]string // original -> placeholder
+	counts  map[string]int
+}
+
+// NewVault returns an empty vault. A disabled vault leaves text unchanged.
+func NewVault(enabled bool) *Vault {
+	return &Vault{
+		enabled: enabled,
+		values:  map[string]string{},
+		byValue: map[string]string{},
+		counts:  map[string]int{},
+	}
+}
+
+// Redact replaces every detected PII value in text with its placeholder.
+func (v *Vault) Redact(text string) string {
+	if !v.enabled {
+		return text
+	}
+	// Detectors run in order, so a card number is not later re-read as a phone number
+	for _, d := range piiDetectors {
+		text = d.re.ReplaceAllStringFunc(text, func(match string) string {
+			if d.validate != nil && !d.validate(match) {
+				return match
+			}
+			return v.placeholderFor(d.kind, match)
+		})
+	}
+	return text
+}
+
+func (v *Vault) placeholderFor(kind, value string) string {
+	if p, ok := v.byValue[value]; ok {
+		return p
+	}
+	v.counts[kind]++
+	p := fmt.Sprintf("[%s_%d]", kind, v.counts[kind])
+	v.values[p] = value
+	v.byValue[value] = p
+	return p
+}
+
+// Restore puts original values back in place of any placeholders in text.
+func (v *Vault) Restore(text string) string {
+	if len(v.values) == 0 {
+		return text
+	}
+	// Longest placeholders first so [EMAIL_12] is not partly replaced by [EMAIL_1]
+	placeholders := make([]string, 0, len(v.values))
+	for p := range v.values {
+		placeholders = append(placeholders, p)
+	}
+	sort.Slice(placeholders, func(i, j int) bool { return len(placeholders[i]) > len(placeholders[j]) })
+
+	pairs := make([]string, 0, len(placeholders)*2)
+	for _, p := range placeholders {
+		pairs = append(pairs, p, v.values[p])
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+func digitsOnly(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// luhnValid checks payment card numbers.
+func luhnValid(match string) bool {
+	digits := digitsOnly(match)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// ibanValid applies the ISO 13616 mod-97 check.
+func ibanValid(match string) bool {
+	iban := strings.ReplaceAll(match, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	rearranged := iban[4:] + iban[:4]
+	remainder := 0
+	for _, r := range rearranged {
+		var n int
+		switch {
+		case r >= '0' && r <= '9':
+			n = int(r - '0')
+			remainder = (remainder*10 + n) % 97
+		case r >= 'A' && r <= 'Z':
+			n = int(r-'A') + 10
+			remainder = (remainder*100 + n) % 97
+		default:
+			return false
+		}
+	}
+	return remainder == 1
+}
+
+// ssnValid rejects numbers the SSA never issues.
+func ssnValid(match string) bool {
+	parts := strings.Split(match, "-")
+	area, group, serial := parts[0], parts[1], parts[2]
+	if area == "000" || area == "666" || area[0] == '9' {
+		return false
+	}
+	return group != "00" && serial != "0000"
+}
+
+var (
+	verhoeffD = [10][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+		{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+		{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+		{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+		{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+		{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+		{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+		{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+		{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+	}
+	verhoeffP = [8][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+		{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+		{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+		{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+		{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+		{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+		{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+	}
+)
+
+// verhoeffValid checks Aadhaar numbers, whose last digit is a Verhoeff checksum.
+func verhoeffValid(match string) bool {
+	digits := digitsOnly(match)
+	if len(digits) != 12 {
+		return false
+	}
+	c := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		c = verhoeffD[c][verhoeffP[i%8][d]]
+	}
+	return c == 0
+}
+
+// phoneValid keeps phone matches to plausible lengths, which filters out most
+// dates, amounts and reference numbers the loose regex also catches.
+func phoneValid(match string) bool {
+	n := len(digitsOnly(match))
+	return n >= 10 && n <= 15
+}
@@ -0,0 +1,92 @@
+package redact
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidators(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate func(string) bool
+		match    string
+		want     bool
+	}{
+		{"Visa test card", luhnValid, "4111 1111 1111 1111", true},
+		{"Mastercard test card", luhnValid, "5500-0000-0000-0004", true},
+		{"card with a wrong check digit", luhnValid, "4111 1111 1111 1112", false},
+		{"too short for a card", luhnValid, "4111 1111 111", false},
+		{"GB IBAN", ibanValid, "GB82 WEST 1234 5698 7654 32", true},
+		{"DE IBAN", ibanValid, "DE89370400440532013000", true},
+		{"IBAN with a wrong check", ibanValid, "GB82 WEST 1234 5698 7654 33", false},
+		{"IBAN with punctuation", ibanValid, "GB82-WEST-1234-5698-7654-32", false},
+		{"SSN", ssnValid, "123-45-6789", true},
+		{"SSN area 000", ssnValid, "000-45-6789", false},
+		{"SSN area 666", ssnValid, "666-45-6789", false},
+		{"SSN area 9xx", ssnValid, "912-45-6789", false},
+		{"SSN group 00", ssnValid, "123-00-6789", false},
+		{"SSN serial 0000", ssnValid, "123-45-0000", false},
+		{"Aadhaar", verhoeffValid, "2341 2341 2346", true},
+		{"Aadhaar with a wrong check digit", verhoeffValid, "2341 2341 2345", false},
+		{"Aadhaar of the wrong length", verhoeffValid, "2341 2341 234", false},
+		{"international phone", phoneValid, "+44 20 7946 0958", true},
+		{"short number", phoneValid, "2024 1234", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.validate(tt.match); got != tt.want {
+				t.Errorf("valid(%q) = %v, want %v", tt.match, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"email", "Write to jane@example.com today", "Write to [EMAIL_1] today"},
+		{"valid card", "Card 4111 1111 1111 1111 on file", "Card [CARD_1] on file"},
+		{"repeated value reuses its placeholder", "a@b.io and a@b.io", "[EMAIL_1] and [EMAIL_1]"},
+		{"SSN", "SSN 123-45-6789", "SSN [SSN_1]"},
+		{"IBAN", "Pay GB82 WEST 1234 5698 7654 32 now", "Pay [IBAN_1] now"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewVault(true).Redact(tt.text); got != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+
+	if got := NewVault(false).Redact("jane@example.com"); got != "jane@example.com" {
+		t.Errorf("disabled vault redacted to %q", got)
+	}
+}
+
+func TestRestoreMoreThanTenPlaceholders(t *testing.T) {
+	var emails []string
+	for i := 1; i <= 12; i++ {
+		emails = append(emails, fmt.Sprintf("user%d@example.com", i))
+	}
+	text := strings.Join(emails, ", ")
+
+	v := NewVault(true)
+	masked := v.Redact(text)
+	if strings.Contains(masked, "@") || !strings.Contains(masked, "[EMAIL_12]") {
+		t.Fatalf("masked = %q", masked)
+	}
+	if got := v.Restore(masked); got != text {
+		t.Errorf("round trip = %q, want %q", got, text)
+	}
+	// [EMAIL_1] must not eat the start of [EMAIL_12]
+	if got := v.Restore("[EMAIL_12] then [EMAIL_1]"); got != "user12@example.com then user1@example.com" {
+		t.Errorf("Restore = %q", got)
+	}
+	if got := NewVault(true).Restore("[EMAIL_1]"); got != "[EMAIL_1]" {
+		t.Errorf("empty vault restored %q", got)
+	}
+}
@@ -0,0 +1,181 @@
+// Package retry sends outbound HTTP requests with exponential backoff, full
+// jitter and Retry-After support, bounded by the caller's deadline.
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("shared/retry")
+
+// Policy retries outbound provider calls with exponential backoff and
+// full jitter. It honours Retry-After and never sleeps past the context
+// deadline: when the next attempt could not finish in time, the last
+// response or error is returned straight away.
+type Policy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// MaxRetryAfter caps how long a server may ask us to wait; a longer
+	// Retry-After is treated as "not worth retrying"
+	MaxRetryAfter time.Duration
+	// OnRetry, if set, is called with the host before each retry
+	OnRetry func(host string)
+}
+
+// ErrBodyNotReplayable is returned for a request whose body could only be
+// sent once, since a retry would otherwise go out with an empty body.
+var ErrBodyNotReplayable = errors.New("retry: request body cannot be replayed")
+
+// Do sends req until it gets a non-retryable result or runs out of attempts.
+// A retryable status on the last attempt is returned as a normal response
+// so the caller can report it. req must have a replayable body, which
+// http.NewRequest arranges for bytes and strings readers; any other body
+// fails with ErrBodyNotReplayable before anything is sent.
+func (p Policy) Do(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil, ErrBodyNotReplayable
+	}
+
+	ctx, span := tracer.Start(ctx, "http.request", trace.WithAttributes(
+		attribute.String("http.method", req.Method),
+		attribute.String("server.address", req.URL.Host)))
+	defer span.End()
+
+	for attempt := 1; ; attempt++ {
+		attemptReq := req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+
+		resp, err := client.Do(attemptReq)
+		span.SetAttributes(attribute.Int("http.attempts", attempt))
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		if attempt >= attempts {
+			return resp, err
+		}
+
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if !retryableError(ctx, err) {
+				return nil, err
+			}
+			wait = p.backoff(attempt)
+			slog.WarnContext(ctx, "Request failed, retrying", "host", req.URL.Host, "wait", wait.String(), "attempt", attempt, "maxAttempts", attempts, "error", err)
+		case retryableStatus(resp.StatusCode):
+			wait = p.backoff(attempt)
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if retryAfter > p.MaxRetryAfter {
+					return resp, nil
+				}
+				wait = retryAfter
+			}
+			slog.WarnContext(ctx, "Retryable response, retrying", "host", req.URL.Host, "status", resp.StatusCode, "wait", wait.String(), "attempt", attempt, "maxAttempts", attempts)
+		default:
+			return resp, nil
+		}
+
+		// Don't start an attempt that the deadline would cut short anyway
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+			return resp, err
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(req.URL.Host)
+		}
+		if resp != nil {
+			// Drain so the connection can be reused
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff is full jitter: a random wait between zero and the exponential cap.
+func (p Policy) backoff(attempt int) time.Duration {
+	ceiling := p.BaseDelay << uint(attempt-1)
+	if ceiling > p.MaxDelay || ceiling <= 0 {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retryableStatus covers throttling, timeouts and transient server errors.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryableError reports whether a transport error is worth another try:
+// timeouts, resets and dropped connections are; our own cancellation or an
+// expired deadline is not.
+func retryableError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// parseRetryAfter reads either form of Retry-After: delay seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := at.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
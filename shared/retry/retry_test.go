@@ -0,0 +1,164 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{70, time.Second}, // the shift overflows
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			if got := p.backoff(tt.attempt); got < 0 || got > tt.ceiling {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", tt.attempt, got, tt.ceiling)
+			}
+		}
+	}
+	if got := (Policy{}).backoff(3); got != 0 {
+		t.Errorf("zero policy backoff = %v, want 0", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"30", 30 * time.Second, true},
+		{"-5", 0, false},
+		{"soon", 0, false},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"Wed, 01 May 2024 12:00:45 GMT", 45 * time.Second, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryableError(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"connection reset", context.Background(), &net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{"connection refused", context.Background(), fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+		{"unexpected EOF", context.Background(), io.ErrUnexpectedEOF, true},
+		{"timeout", context.Background(), timeoutError{}, true},
+		{"our cancellation", cancelled, &net.OpError{Op: "read", Err: syscall.ECONNRESET}, false},
+		{"cancelled error", context.Background(), context.Canceled, false},
+		{"anything else", context.Background(), errors.New("tls: bad certificate"), false},
+	}
+	for _, tt := range tests {
+		if got := retryableError(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("%s: retryableError = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDoRetriesAndReplaysBody(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("attempt %d sent body %q", calls.Load()+1, body)
+		}
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var retries int
+	p := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond,
+		OnRetry: func(string) { retries++ }}
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader("payload"))
+	resp, err := p.Do(context.Background(), server.Client(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls.Load() != 3 || retries != 2 {
+		t.Errorf("status %d after %d calls and %d retries", resp.StatusCode, calls.Load(), retries)
+	}
+}
+
+func TestDoStopsBeforeTheDeadline(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxRetryAfter: time.Minute}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+
+	start := time.Now()
+	resp, err := p.Do(ctx, server.Client(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || calls.Load() != 1 {
+		t.Errorf("status %d after %d calls, want the first 429 back", resp.StatusCode, calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waited %v for a retry the deadline ruled out", elapsed)
+	}
+}
+
+func TestDoRejectsOneShotBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request was sent")
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL, io.NopCloser(strings.NewReader("payload")))
+	if _, err := (Policy{MaxAttempts: 3}).Do(context.Background(), server.Client(), req); !errors.Is(err, ErrBodyNotReplayable) {
+		t.Errorf("err = %v, want ErrBodyNotReplayable", err)
+	}
+}
@@ -17,31 +17,40 @@ import (
 	_ "github.com/lib/pq"
 )
 
-func ExtractUserFromToken(authHeader string) (string, error) {
+// ExtractTokenClaims decodes the payload of a bearer JWT.
+func ExtractTokenClaims(authHeader string) (map[string]interface{}, error) {
 	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-		return "", fmt.Errorf("missing or invalid authorization header")
+		return nil, fmt.Errorf("missing or invalid authorization header")
 	}
-	
+
 	token := strings.TrimPrefix(authHeader, "Bearer ")
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
-		return "", fmt.Errorf("invalid JWT format")
+		return nil, fmt.Errorf("invalid JWT format")
 	}
-	
+
 	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return "", fmt.Errorf("failed to decode JWT payload")
+		return nil, fmt.Errorf("failed to decode JWT payload")
 	}
-	
+
 	var claims map[string]interface{}
 	if err := json.Unmarshal(payload, &claims); err != nil {
-		return "", fmt.Errorf("failed to parse JWT claims")
+		return nil, fmt.Errorf("failed to parse JWT claims")
 	}
-	
+	return claims, nil
+}
+
+func ExtractUserFromToken(authHeader string) (string, error) {
+	claims, err := ExtractTokenClaims(authHeader)
+	if err != nil {
+		return "", err
+	}
+
 	if sub, ok := claims["sub"].(string); ok {
 		return sub, nil
 	}
-	
+
 	return "", fmt.Errorf("user ID not found in token")
 }
 
@@ -0,0 +1,26 @@
+package shared
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestExtractTokenClaims(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub": "user-1", "custom:tenant": "acme"}`))
+	claims, err := ExtractTokenClaims("Bearer header." + payload + ".signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "user-1" || claims["custom:tenant"] != "acme" {
+		t.Errorf("claims = %v", claims)
+	}
+	if sub, err := ExtractUserFromToken("Bearer header." + payload + ".signature"); err != nil || sub != "user-1" {
+		t.Errorf("user = %q, %v; want user-1", sub, err)
+	}
+
+	for _, header := range []string{"", "Basic abc", "Bearer not-a-jwt", "Bearer a.!!!.c"} {
+		if _, err := ExtractTokenClaims(header); err == nil {
+			t.Errorf("%q: want an error", header)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Package tenant resolves the organization a request runs for. Several
+// organizations can share one deployment: each request belongs to one
+// tenant, taken from the verified token, and the tenant's configuration
+// overrides the deployment defaults for the model, default persona, quotas
+// and provider key. The assistant and ingest share this package so a
+// document is stored under the tenant, user key and embedding provider the
+// assistant will search with.
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Providers a tenant can run on.
+const (
+	Gemini = "gemini"
+	OpenAI = "openai"
+)
+
+// Config is one tenant's overrides. Zero fields keep the defaults.
+type Config struct {
+	ChatModel         string `json:"chatModel,omitempty"` // for the tenant's provider
+	Persona           string `json:"persona,omitempty"`   // default persona for new sessions
+	DailyTokenQuota   int    `json:"dailyTokenQuota,omitempty"`
+	MonthlyTokenQuota int    `json:"monthlyTokenQuota,omitempty"`
+	// Provider is Gemini or OpenAI. Empty takes it from the key path, which
+	// must then name exactly one of them.
+	Provider string `json:"provider,omitempty"`
+	// SSMKeyPath is the tenant's own provider API key. Failover to the other
+	// provider needs FailoverSSMKeyPath too, so a tenant's traffic never
+	// bills another key.
+	SSMKeyPath         string `json:"ssmKeyPath,omitempty"`
+	FailoverSSMKeyPath string `json:"failoverSsmKeyPath,omitempty"`
+	// InternalAPIs names the assistant's internal APIs the tenant's users may
+	// call through the model. Only Default may call them all unlisted.
+	InternalAPIs []string `json:"internalApis,omitempty"`
+}
+
+// Settings are a deployment's tenancy rules and the defaults a tenant's
+// Config overrides.
+type Settings struct {
+	Claim       string // token claim naming the tenant
+	GroupPrefix string // else a Cognito group named GroupPrefix + tenant ID
+	Default     string // tenant of tokens naming none; keeps the pre-tenant keys
+
+	SSMKeyPath        string // provider key, and so provider, of tenants without one
+	DailyTokenQuota   int
+	MonthlyTokenQuota int
+}
+
+// Tenant is the organization a request runs for.
+type Tenant struct {
+	Id string
+	Config
+
+	defaults Settings
+}
+
+// Store looks up tenant configuration. ok is false for a tenant that has
+// none.
+type Store interface {
+	Get(ctx context.Context, tenantId string) (cfg Config, ok bool, err error)
+}
+
+var (
+	ErrUnknown   = errors.New("unknown tenant")
+	ErrAmbiguous = errors.New("token names more than one tenant")
+
+	idPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+)
+
+// InvalidIdError is a tenant ID that is unsafe to use in keys.
+type InvalidIdError struct {
+	Id string
+}
+
+func (e *InvalidIdError) Error() string { return fmt.Sprintf("invalid tenant ID %q", e.Id) }
+
+// Rejected reports whether err means the token's tenant cannot be served,
+// as opposed to its configuration being unreadable or broken.
+func Rejected(err error) bool {
+	var invalid *InvalidIdError
+	return errors.Is(err, ErrUnknown) || errors.Is(err, ErrAmbiguous) || errors.As(err, &invalid)
+}
+
+// IdFromClaims reads the tenant from the Claim claim, else from a
+// GroupPrefix Cognito group. A token with neither belongs to Default.
+func (s Settings) IdFromClaims(claims map[string]interface{}) (string, error) {
+	id, _ := claims[s.Claim].(string)
+	if id == "" {
+		groups, _ := claims["cognito:groups"].([]interface{})
+		for _, g := range groups {
+			name, _ := g.(string)
+			if t, ok := strings.CutPrefix(name, s.GroupPrefix); ok {
+				if id != "" && id != t {
+					return "", ErrAmbiguous
+				}
+				id = t
+			}
+		}
+	}
+	if id == "" {
+		return s.Default, nil
+	}
+	if !idPattern.MatchString(id) {
+		return "", &InvalidIdError{Id: id}
+	}
+	return id, nil
+}
+
+// ForClaims resolves the tenant a token belongs to.
+func (s Settings) ForClaims(ctx context.Context, store Store, claims map[string]interface{}) (Tenant, error) {
+	id, err := s.IdFromClaims(claims)
+	if err != nil {
+		return Tenant{}, err
+	}
+	return s.Resolve(ctx, store, id)
+}
+
+// Resolve loads the tenant's configuration from store, which may be nil.
+// Only Default may run without one, and only it survives the store being
+// unreadable, so a misconfigured deployment fails closed for everyone else.
+// A configuration whose provider cannot be told is an error.
+func (s Settings) Resolve(ctx context.Context, store Store, id string) (Tenant, error) {
+	t := Tenant{Id: id, defaults: s}
+	if store == nil {
+		if id == s.Default {
+			return t, nil
+		}
+		return t, ErrUnknown
+	}
+	cfg, ok, err := store.Get(ctx, id)
+	switch {
+	case err != nil && id == s.Default:
+		return t, nil
+	case err != nil:
+		return t, err
+	case !ok && id != s.Default:
+		return t, ErrUnknown
+	}
+	t.Config = cfg
+	if _, err := provider(cfg.Provider, t.KeyPath()); err != nil {
+		return t, fmt.Errorf("tenant %s: %w", id, err)
+	}
+	return t, nil
+}
+
+// Fallback is Default with no overrides, the tenant of work done outside a
+// request.
+func (s Settings) Fallback() Tenant {
+	return Tenant{Id: s.Default, defaults: s}
+}
+
+// ScopedUserId is the key the tenant's user is stored under in DynamoDB and
+// aiknowledge. Default keeps the bare sub, so data written before tenants
+// existed stays reachable.
+func (t Tenant) ScopedUserId(sub string) string {
+	if t.Id == t.defaults.Default || t.Id == "" {
+		return sub
+	}
+	return t.Id + "#" + sub
+}
+
+// KeyPath is the SSM parameter holding the tenant's provider API key.
+func (t Tenant) KeyPath() string {
+	if t.SSMKeyPath != "" {
+		return t.SSMKeyPath
+	}
+	return t.defaults.SSMKeyPath
+}
+
+// Provider is Gemini or OpenAI, or "" for a configuration Resolve would
+// have rejected.
+func (t Tenant) Provider() string {
+	p, _ := provider(t.Config.Provider, t.KeyPath())
+	return p
+}
+
+func (t Tenant) Quotas() (daily, monthly int) {
+	daily, monthly = t.defaults.DailyTokenQuota, t.defaults.MonthlyTokenQuota
+	if t.DailyTokenQuota > 0 {
+		daily = t.DailyTokenQuota
+	}
+	if t.MonthlyTokenQuota > 0 {
+		monthly = t.MonthlyTokenQuota
+	}
+	return daily, monthly
+}
+
+// provider is the explicit provider, else the one the key path names.
+func provider(explicit, keyPath string) (string, error) {
+	switch explicit {
+	case Gemini, OpenAI:
+		return explicit, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown provider %q", explicit)
+	}
+	gemini, openai := strings.Contains(keyPath, Gemini), strings.Contains(keyPath, OpenAI)
+	switch {
+	case gemini && !openai:
+		return Gemini, nil
+	case openai && !gemini:
+		return OpenAI, nil
+	}
+	return "", fmt.Errorf("key path %q does not name one provider; set provider", keyPath)
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying t.
+func NewContext(ctx context.Context, t Tenant) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the request's tenant; outside a request it is
+// Fallback.
+func (s Settings) FromContext(ctx context.Context) Tenant {
+	if t, ok := ctx.Value(contextKey{}).(Tenant); ok {
+		return t
+	}
+	return s.Fallback()
+}
+
+// SecretStore reads a secret by name.
+type SecretStore interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// SSMStore reads every tenant's configuration from one JSON parameter, an
+// object of tenant ID to Config, and keeps it for ttl.
+type SSMStore struct {
+	secrets SecretStore
+	path    string
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	tenants map[string]Config
+	loaded  time.Time
+}
+
+func NewSSMStore(secrets SecretStore, path string, ttl time.Duration) *SSMStore {
+	return &SSMStore{secrets: secrets, path: path, ttl: ttl, now: time.Now}
+}
+
+func (s *SSMStore) Get(ctx context.Context, tenantId string) (Config, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tenants == nil || s.now().Sub(s.loaded) > s.ttl {
+		raw, err := s.secrets.Get(ctx, s.path)
+		if err != nil {
+			return Config{}, false, err
+		}
+		var tenants map[string]Config
+		if err := json.Unmarshal([]byte(raw), &tenants); err != nil {
+			return Config{}, false, fmt.Errorf("parsing %s: %w", s.path, err)
+		}
+		s.tenants, s.loaded = tenants, s.now()
+	}
+	cfg, ok := s.tenants[tenantId]
+	return cfg, ok, nil
+}
@@ -0,0 +1,184 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var settings = Settings{
+	Claim:             "custom:tenant",
+	GroupPrefix:       "tenant-",
+	Default:           "default",
+	SSMKeyPath:        "/yoursai/gemini/apiKey",
+	DailyTokenQuota:   100,
+	MonthlyTokenQuota: 1000,
+}
+
+type mapStore map[string]Config
+
+func (m mapStore) Get(ctx context.Context, tenantId string) (Config, bool, error) {
+	cfg, ok := m[tenantId]
+	return cfg, ok, nil
+}
+
+type failingStore struct{}
+
+func (failingStore) Get(ctx context.Context, tenantId string) (Config, bool, error) {
+	return Config{}, false, errors.New("ssm unavailable")
+}
+
+func TestIdFromClaims(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  map[string]interface{}
+		want    string
+		wantErr bool
+	}{
+		{"no tenant is the default", map[string]interface{}{"sub": "u1"}, "default", false},
+		{"custom claim", map[string]interface{}{"custom:tenant": "acme"}, "acme", false},
+		{"tenant group", map[string]interface{}{"cognito:groups": []interface{}{"hr", "tenant-acme"}}, "acme", false},
+		{"claim wins over group", map[string]interface{}{"custom:tenant": "acme", "cognito:groups": []interface{}{"tenant-globex"}}, "acme", false},
+		{"same group twice", map[string]interface{}{"cognito:groups": []interface{}{"tenant-acme", "tenant-acme"}}, "acme", false},
+		{"two tenant groups", map[string]interface{}{"cognito:groups": []interface{}{"tenant-acme", "tenant-globex"}}, "", true},
+		{"unsafe ID", map[string]interface{}{"custom:tenant": "acme#admin"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := settings.IdFromClaims(tt.claims)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !Rejected(err) {
+				t.Errorf("err = %v is not a rejection", err)
+			}
+			if got != tt.want {
+				t.Errorf("tenant = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveFailsClosed(t *testing.T) {
+	ctx := context.Background()
+	store := mapStore{"acme": {ChatModel: "gpt-acme"}}
+	if _, err := settings.Resolve(ctx, store, "globex"); !errors.Is(err, ErrUnknown) {
+		t.Errorf("unconfigured tenant: err = %v, want ErrUnknown", err)
+	}
+	if tenant, err := settings.Resolve(ctx, store, "default"); err != nil || tenant.ChatModel != "" {
+		t.Errorf("default tenant = %+v, %v; want no overrides", tenant, err)
+	}
+	if _, err := settings.Resolve(ctx, nil, "acme"); !errors.Is(err, ErrUnknown) {
+		t.Errorf("no tenant store: err = %v, want ErrUnknown", err)
+	}
+	if _, err := settings.Resolve(ctx, failingStore{}, "default"); err != nil {
+		t.Errorf("default tenant with an unreadable store: err = %v, want none", err)
+	}
+	_, err := settings.Resolve(ctx, failingStore{}, "acme")
+	if err == nil || Rejected(err) {
+		t.Errorf("unreadable store: err = %v, want a configuration error", err)
+	}
+}
+
+func TestResolveProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    string
+		wantErr bool
+	}{
+		{"deployment key", Config{}, Gemini, false},
+		{"tenant key names openai", Config{SSMKeyPath: "/acme/openai/apiKey"}, OpenAI, false},
+		{"explicit provider", Config{Provider: OpenAI, SSMKeyPath: "/acme/llm-key"}, OpenAI, false},
+		{"explicit provider wins", Config{Provider: Gemini, SSMKeyPath: "/acme/openai/apiKey"}, Gemini, false},
+		{"key names neither", Config{SSMKeyPath: "/acme/llm-key"}, "", true},
+		{"key names both", Config{SSMKeyPath: "/acme/openai-to-gemini/apiKey"}, "", true},
+		{"unknown provider", Config{Provider: "anthropic"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant, err := settings.Resolve(context.Background(), mapStore{"acme": tt.cfg}, "acme")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if Rejected(err) {
+					t.Errorf("err = %v; a broken configuration is not the token's fault", err)
+				}
+				return
+			}
+			if got := tenant.Provider(); got != tt.want {
+				t.Errorf("provider = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTenantDefaults(t *testing.T) {
+	ctx := context.Background()
+	acme, err := settings.Resolve(ctx, mapStore{"acme": {DailyTokenQuota: 5, SSMKeyPath: "/acme/openai/apiKey"}}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := acme.ScopedUserId("u1"); got != "acme#u1" {
+		t.Errorf("scoped user = %q, want acme#u1", got)
+	}
+	if daily, monthly := acme.Quotas(); daily != 5 || monthly != 1000 {
+		t.Errorf("quotas = %d/%d, want 5/1000", daily, monthly)
+	}
+	if got := acme.KeyPath(); got != "/acme/openai/apiKey" {
+		t.Errorf("key path = %q", got)
+	}
+
+	fallback := settings.FromContext(ctx)
+	if fallback.Id != "default" || fallback.ScopedUserId("u1") != "u1" {
+		t.Errorf("fallback = %+v, want the default tenant with bare subs", fallback)
+	}
+	if fallback.KeyPath() != settings.SSMKeyPath || fallback.Provider() != Gemini {
+		t.Errorf("fallback key = %q/%q, want the deployment's", fallback.KeyPath(), fallback.Provider())
+	}
+	if got := settings.FromContext(NewContext(ctx, acme)); got.Id != "acme" {
+		t.Errorf("tenant from context = %q, want acme", got.Id)
+	}
+}
+
+type countingSecrets struct {
+	value string
+	calls int
+}
+
+func (c *countingSecrets) Get(ctx context.Context, name string) (string, error) {
+	c.calls++
+	return c.value, nil
+}
+
+func TestSSMStoreCaches(t *testing.T) {
+	ctx := context.Background()
+	secrets := &countingSecrets{value: `{"acme": {"chatModel": "gpt-acme", "provider": "openai"}}`}
+	store := NewSSMStore(secrets, "/yoursai/tenants", time.Minute)
+	now := time.Unix(1700000000, 0)
+	store.now = func() time.Time { return now }
+
+	cfg, ok, err := store.Get(ctx, "acme")
+	if err != nil || !ok || cfg.ChatModel != "gpt-acme" || cfg.Provider != OpenAI {
+		t.Fatalf("acme = %+v, %v, %v", cfg, ok, err)
+	}
+	if _, ok, _ := store.Get(ctx, "globex"); ok {
+		t.Error("globex has a configuration")
+	}
+	if secrets.calls != 1 {
+		t.Errorf("loads = %d, want 1 within the TTL", secrets.calls)
+	}
+	now = now.Add(2 * time.Minute)
+	store.Get(ctx, "acme")
+	if secrets.calls != 2 {
+		t.Errorf("loads = %d, want 2 after the TTL", secrets.calls)
+	}
+
+	secrets.value = "not json"
+	now = now.Add(2 * time.Minute)
+	if _, _, err := store.Get(ctx, "acme"); err == nil {
+		t.Error("malformed configuration: want an error")
+	}
+}
@@ -0,0 +1,141 @@
+// Package throttle keeps outbound provider calls within a published
+// requests-per-minute and tokens-per-minute quota.
+package throttle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a provider's published quota for one model. Zero means the
+// dimension is not limited.
+type Limit struct {
+	RPM int // requests per minute
+	TPM int // tokens per minute
+}
+
+// Throttle is a pair of token buckets, one for requests and one for
+// tokens. Each refills continuously at its per-minute rate and holds at most
+// one minute's worth, so idle capacity allows a burst but never more than
+// the quota allows.
+type Throttle struct {
+	mu       sync.Mutex
+	limit    Limit
+	requests float64
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+}
+
+// New returns a throttle that starts with a full minute's quota. now is the
+// clock; nil means time.Now.
+func New(limit Limit, now func() time.Time) *Throttle {
+	if now == nil {
+		now = time.Now
+	}
+	return &Throttle{
+		limit:    limit,
+		requests: float64(limit.RPM),
+		tokens:   float64(limit.TPM),
+		last:     now(),
+		now:      now,
+	}
+}
+
+// reserve takes one request and n tokens if both are available and otherwise
+// returns how long until they will be.
+func (t *Throttle) reserve(n int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	elapsed := now.Sub(t.last).Minutes()
+	t.last = now
+	if t.limit.RPM > 0 {
+		t.requests = math.Min(float64(t.limit.RPM), t.requests+elapsed*float64(t.limit.RPM))
+	}
+	if t.limit.TPM > 0 {
+		t.tokens = math.Min(float64(t.limit.TPM), t.tokens+elapsed*float64(t.limit.TPM))
+		// A request bigger than a whole minute's quota would never fit
+		if n > t.limit.TPM {
+			n = t.limit.TPM
+		}
+	}
+
+	var wait time.Duration
+	if t.limit.RPM > 0 && t.requests < 1 {
+		wait = minutesToDuration((1 - t.requests) / float64(t.limit.RPM))
+	}
+	if t.limit.TPM > 0 && t.tokens < float64(n) {
+		if w := minutesToDuration((float64(n) - t.tokens) / float64(t.limit.TPM)); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	if t.limit.RPM > 0 {
+		t.requests--
+	}
+	if t.limit.TPM > 0 {
+		t.tokens -= float64(n)
+	}
+	return 0
+}
+
+// Wait blocks until the call fits within the limits or ctx is done.
+func (t *Throttle) Wait(ctx context.Context, tokens int) error {
+	for {
+		wait := t.reserve(tokens)
+		if wait == 0 {
+			return nil
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return fmt.Errorf("%w: next slot in %v is past the deadline", ErrThrottled, wait)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// ErrThrottled means the next free slot is past the caller's deadline.
+var ErrThrottled = errors.New("provider rate limit")
+
+func minutesToDuration(m float64) time.Duration {
+	return time.Duration(math.Ceil(m * float64(time.Minute)))
+}
+
+// Set holds one throttle per key, created on first use.
+type Set struct {
+	mu        sync.Mutex
+	throttles map[string]*Throttle
+	now       func() time.Time
+}
+
+// NewSet returns an empty set. now is the clock; nil means time.Now.
+func NewSet(now func() time.Time) *Set {
+	return &Set{throttles: map[string]*Throttle{}, now: now}
+}
+
+// Wait waits on the throttle for key, creating it with limit if this is the
+// first call for key. Later calls keep the limit the throttle was made with.
+func (s *Set) Wait(ctx context.Context, key string, limit Limit, tokens int) error {
+	s.mu.Lock()
+	t, ok := s.throttles[key]
+	if !ok {
+		t = New(limit, s.now)
+		s.throttles[key] = t
+	}
+	s.mu.Unlock()
+	return t.Wait(ctx, tokens)
+}
@@ -0,0 +1,68 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestReserveRefills(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	th := New(Limit{RPM: 60, TPM: 600}, clock.now)
+
+	for i := 0; i < 60; i++ {
+		if wait := th.reserve(10); wait != 0 {
+			t.Fatalf("call %d waited %v inside the quota", i, wait)
+		}
+	}
+	if wait := th.reserve(10); wait != time.Second {
+		t.Errorf("61st call wait = %v, want 1s", wait)
+	}
+
+	clock.advance(time.Second)
+	if wait := th.reserve(10); wait != 0 {
+		t.Errorf("wait after refill = %v, want 0", wait)
+	}
+}
+
+func TestReserveCapsOversizedCalls(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	th := New(Limit{TPM: 100}, clock.now)
+	if wait := th.reserve(1000); wait != 0 {
+		t.Errorf("a call larger than the quota waited %v on a full bucket", wait)
+	}
+}
+
+func TestWaitPastDeadline(t *testing.T) {
+	th := New(Limit{RPM: 1}, nil)
+	th.reserve(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := th.Wait(ctx, 0); !errors.Is(err, ErrThrottled) {
+		t.Errorf("err = %v, want ErrThrottled", err)
+	}
+}
+
+func TestSetKeepsThrottlesApart(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	s := NewSet(clock.now)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := s.Wait(ctx, "a", Limit{RPM: 1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(ctx, "b", Limit{RPM: 1}, 0); err != nil {
+		t.Errorf("b shared a's bucket: %v", err)
+	}
+	if err := s.Wait(ctx, "a", Limit{RPM: 1}, 0); !errors.Is(err, ErrThrottled) {
+		t.Errorf("second call on a: err = %v, want ErrThrottled", err)
+	}
+}
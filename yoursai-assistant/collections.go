@@ -0,0 +1,34 @@
+package main
+
+// Knowledge-base chunks belong to collections. A collection is owned by a
+// user or a team, and collection_members grants principals the owner,
+// editor or reader role on it. Principals are "user:<sub>" for a user and
+// "team:<group>" for each Cognito group the user is in; yoursai-ingest
+// manages collections and their members.
+
+// SearchScope is what one search may see: the tenant's chunks in
+// collections any of Principals can read, narrowed by Filter. UserId is
+// the tenant-scoped caller the database checks the rows against.
+type SearchScope struct {
+	TenantId   string
+	UserId     string
+	Principals []string
+	Filter     *MetadataFilter
+}
+
+func userPrincipal(userId string) string { return "user:" + userId }
+
+func teamPrincipal(team string) string { return "team:" + team }
+
+// callerPrincipals lists the principals the token holds: the user and one
+// team per cognito:groups entry.
+func callerPrincipals(userId string, claims map[string]interface{}) []string {
+	principals := []string{userPrincipal(userId)}
+	groups, _ := claims["cognito:groups"].([]interface{})
+	for _, g := range groups {
+		if team, ok := g.(string); ok && team != "" {
+			principals = append(principals, teamPrincipal(team))
+		}
+	}
+	return principals
+}
@@ -1,28 +1,136 @@
 package main
 
+import "os"
+
 const (
 	// AI Models
-	GeminiModel        = "gemini-2.5-flash-lite"
-	OpenAIModel        = "gpt-5-nano"
-	EmbeddingModel     = "text-embedding-004"
+	GeminiModel          = "gemini-2.5-flash-lite"
+	OpenAIModel          = "gpt-5-nano"
+	EmbeddingModel       = "text-embedding-004"
+	OpenAIEmbeddingModel = "text-embedding-3-small" // for tenants on an OpenAI key, matching yoursai-ingest
 	
 	// API URLs
-	GeminiAPIURL       = "https://generativelanguage.googleapis.com/v1beta/models/" + GeminiModel + ":generateContent"
-	EmbeddingAPIURL    = "https://generativelanguage.googleapis.com/v1beta/models/" + EmbeddingModel + ":embedContent"
-	OpenAIAPIURL       = "https://api.openai.com/v1/chat/completions"
+	GeminiAPIURL          = "https://generativelanguage.googleapis.com/v1beta/models/" + GeminiModel + ":generateContent"
+	EmbeddingAPIURL       = "https://generativelanguage.googleapis.com/v1beta/models/" + EmbeddingModel + ":embedContent"
+	OpenAIAPIURL          = "https://api.openai.com/v1/chat/completions"
+	OpenAIEmbeddingAPIURL = "https://api.openai.com/v1/embeddings"
 	
 	SSMKeyPath         = "/yoursai/gemini/apiKey"
 	AWSRegion          = "us-east-1"
+
+	// Client-side provider rate limits, per Lambda container (see providerLimits)
+	GeminiChatRPM       = 4000
+	GeminiChatTPM       = 4000000
+	GeminiEmbeddingRPM  = 1500
+	OpenAIEmbeddingRPM  = 3000
+	OpenAIEmbeddingTPM  = 1000000
+	OpenAIChatRPM       = 500
+	OpenAIChatTPM       = 200000
+	OpenAIModerationRPM = 1000
+
+	// Retry policy for outbound provider calls (full-jitter exponential backoff)
+	RetryMaxAttempts          = 3
+	RetryBaseDelayMs          = 500
+	RetryMaxDelayMs           = 8000
+	RetryMaxRetryAfterSeconds = 20 // a longer Retry-After is not waited out
+
+	// Tracing
+	ServiceName     = "yoursai-assistant"
+	TracingExporter = "none" // "otlp", "stdout" or "none"
+
+	// CloudWatch embedded metrics, written to stdout
+	Metrics          = "on"
+	MetricsNamespace = "YoursAI"
+
+	// Structured logging
+	LogLevel               = "info" // "debug" also logs message content in full
+	LogContent             = "hash" // "hash" or "truncate"; how content is logged below debug
+	LogContentPreviewChars = 40
+
+	// Chat provider failover; SSMKeyPath picks the primary provider
+	GeminiKeyPath                 = "/yoursai/gemini/apiKey"
+	OpenAIKeyPath                 = "/yoursai/openai/apiKey"
+	ChatFailover                  = "on" // "on" falls back to the other provider
+	ChatProviderTimeoutSeconds    = 30
+	CircuitBreakerThreshold       = 3   // consecutive failures before a provider is skipped
+	CircuitBreakerCooldownSeconds = 30  // how long it is skipped before a probe request
+	ProviderKeyCacheSeconds       = 300 // how long a failover key read from SSM is reused
+
 	DynamoTableName    = "ChatHistory"
+	SessionTableName   = "ChatSessions"
+	DefaultPersona     = "assistant"
 	MaxMessageLength   = 3000
 	MaxOutputTokens    = 1024
 	Temperature        = 0.2
 	RateLimitPerMin    = 60
 	RateLimitWindow    = 120 // seconds
+	RateLimitTableName = "RateLimits"
+	RateLimitBackend   = "dynamodb" // "dynamodb" or "memory"
 	MaxChatsPerSession = 30
-	APICallDelay       = 2000 // milliseconds between API calls
 	ContextExchanges   = 5    // number of recent conversation exchanges for RAG context
 
+	// Standalone query rewriting before retrieval
+	QueryRewrite          = "on" // "off" embeds the recent exchanges plus the question instead
+	QueryRewriteMaxTokens = 64
+
+	// Content-addressed embedding cache; an in-memory LRU sits in front of the backend
+	EmbeddingCacheBackend   = "postgres" // "postgres", "dynamodb", "memory" or "off"
+	EmbeddingCacheTableName = "EmbeddingCache"
+	EmbeddingCacheLRUSize   = 1000
+	EmbeddingCacheTTLDays   = 30 // dynamodb backend only
+
+	// Retrieval strategy; requests may override it with retrievalStrategy
+	RetrievalStrategy = "single" // "single", "multi-query", "hyde" or "multi-query+hyde"
+	RetrievalTopK     = 3        // chunks per search and after fusion
+	MultiQueryCount   = 3        // paraphrases generated for multi-query
+	HyDEMaxTokens     = 200
+
+	// Metadata filters on chat requests (tags, document IDs, date range)
+	MaxFilterValues        = 100 // tags or document IDs per filter
+	MaxFilterMetadataBytes = 4096
+
+	// Prompt-injection screening of retrieved documents
+	InjectionClassifier = "off"        // "on" adds an LLM check after the heuristics
+	InjectionAction     = "quarantine" // "quarantine" drops suspicious chunks, "flag" keeps them marked
+
+	// Input and output moderation
+	ModerationPolicy         = "violence=block,self-harm=block,sexual/minors=block,hate=block,harassment=warn,dangerous=block,illicit=block,credentials=warn,provider-block=block,checker-failure=log"
+	ModerationDefaultAction  = "log"      // action for categories not in ModerationPolicy
+	ModerationProviderCheck  = "on"       // call the OpenAI moderation endpoint when using OpenAI
+	ModerationAuditBackend   = "dynamodb" // "dynamodb" or "log"
+	ModerationAuditTableName = "ModerationAudit"
+	OpenAIModerationModel    = "omni-moderation-latest"
+	OpenAIModerationAPIURL   = "https://api.openai.com/v1/moderations"
+	ModerationBlockedReply   = "Sorry, I can't help with that request."
+
+	// PII masking before text is sent to embedding and generation APIs
+	PIIRedaction = "on" // "on" or "off"
+
+	// Tool calling
+	MaxToolIterations    = 4       // model turns that may request tools before a final answer is forced
+	ToolTimeoutSeconds   = 10      // default per-tool timeout
+	ToolMaxResponseBytes = 16 * 1024
+
+	// Token usage accounting and quotas (prompt + completion + embedding tokens)
+	UsageTableName           = "UsageLedger"
+	UsageBackend             = "dynamodb" // "dynamodb" or "memory"
+	UsageLedgerRetentionDays = 90
+	DailyTokenQuota          = 200000
+	MonthlyTokenQuota        = 3000000
+
+	// Multi-tenancy; the tenant comes from TenantClaim, else from a Cognito
+	// group named TenantGroupPrefix + tenant ID
+	TenantClaim              = "custom:tenant"
+	TenantGroupPrefix        = "tenant-"
+	DefaultTenant            = "default" // tokens without a tenant; keeps the pre-tenant keys
+	TenantConfigPath         = "/yoursai/tenants" // JSON object of tenant ID to TenantConfig
+	TenantConfigCacheSeconds = 300
+
+	// Offline answer-quality evaluation (go run . eval)
+	JudgeMaxTokens          = 300
+	EvalChunkTokens         = 500  // yoursai-ingest MaxTokensPerChunk
+	EvalRegressionTolerance = 0.25 // mean drop on the 1-5 judge scale that fails a run
+
 	// Database connection pool settings
 	MaxOpenConns    = 10
 	MaxIdleConns    = 5
@@ -49,3 +157,11 @@ You must not:
 - Pretend to be a human
 - Output secrets or credentials
 - Give incomplete answers or cut off mid-sentence.`
+
+// envOrDefault lets deployments override a compiled-in setting without a rebuild.
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
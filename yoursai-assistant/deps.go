@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"shared/embedcache"
+	"shared/ratelimit"
+	"shared/tenant"
+	"shared/throttle"
+)
+
+// Deps is everything the chat handler reaches outside the process: secrets,
+// tenant configuration, chat history and session settings, the knowledge
+// base, rate limits, the usage ledger, the moderation audit, the embedding
+// cache, the model APIs and the clock. main wires the AWS, Postgres and
+// provider implementations; tests pass fakes and httptest servers. With no
+// Tenants only DefaultTenant is served.
+type Deps struct {
+	Secrets        SecretStore
+	Tenants        TenantStore
+	History        HistoryStore
+	Sessions       SessionStore
+	Vectors        VectorStore
+	Limiter        ratelimit.Limiter // per-user chat requests
+	Usage          UsageStore
+	Audit          ModerationAuditStore
+	EmbeddingCache *embedcache.Cache // nil turns caching off
+	Keys           *keyCache         // failover provider keys, read through Secrets
+	Providers      Providers
+	Now            func() time.Time
+}
+
+// SecretStore reads configuration secrets such as API keys and database
+// credentials by Parameter Store path.
+type SecretStore interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// HistoryStore keeps the exchanges of each chat session.
+type HistoryStore interface {
+	// Load returns the session's recent exchanges, oldest first.
+	Load(ctx context.Context, userId, sessionId string) ([]ChatExchange, error)
+	Save(ctx context.Context, userId, sessionId string, record ChatRecord) error
+}
+
+// ChatRecord is one exchange as it is stored.
+type ChatRecord struct {
+	UserMessage    string
+	AIReply        string
+	RetrievalQuery string // masked query used for retrieval, kept so bad answers can be traced
+	Time           time.Time
+}
+
+// errSessionExists is returned by SessionStore.Create when the session
+// already has settings.
+var errSessionExists = errors.New("session already exists")
+
+// SessionStore holds what a session fixes at creation time.
+type SessionStore interface {
+	// Get reports whether the session exists. It must see a Create that
+	// has already returned, and a session without settings is returned as
+	// found with a zero SessionSettings.
+	Get(ctx context.Context, userId, sessionId string) (SessionSettings, bool, error)
+	// Create pins settings to a new session and returns errSessionExists
+	// when another request got there first.
+	Create(ctx context.Context, userId, sessionId string, settings SessionSettings, now time.Time) error
+}
+
+// VectorStore searches the document chunks in scope. Retrieval and the
+// search tool are skipped for a request when the store is not Available.
+type VectorStore interface {
+	Available(ctx context.Context) bool
+	Search(ctx context.Context, embedding []float64, scope SearchScope) ([]SearchResult, error)
+}
+
+// Providers are the model API endpoints and the circuit breakers and
+// throttles guarding them.
+type Providers struct {
+	GeminiURL          string
+	OpenAIURL          string
+	EmbeddingURL       string // Gemini embedContent
+	OpenAIEmbeddingURL string
+	ModerationURL      string
+	Breakers           *breakerSet
+	Throttles          *throttle.Set
+}
+
+func defaultProviders() Providers {
+	return Providers{
+		GeminiURL:          GeminiAPIURL,
+		OpenAIURL:          OpenAIAPIURL,
+		EmbeddingURL:       EmbeddingAPIURL,
+		OpenAIEmbeddingURL: OpenAIEmbeddingAPIURL,
+		ModerationURL:      OpenAIModerationAPIURL,
+		Breakers:           providerBreakers,
+		Throttles:          throttle.NewSet(nil),
+	}
+}
+
+// newAWSDeps wires the production dependencies: SSM, DynamoDB, pgvector and
+// the public provider APIs, with the backends the *_BACKEND variables pick.
+func newAWSDeps(ctx context.Context) *Deps {
+	secrets := ssmSecretStore{}
+	return &Deps{
+		Secrets:        secrets,
+		Tenants:        tenant.NewSSMStore(secrets, TenantConfigPath, TenantConfigCacheSeconds*time.Second),
+		History:        dynamoHistoryStore{},
+		Sessions:       dynamoSessionStore{},
+		Vectors:        &pgVectorStore{secrets: secrets},
+		Limiter:        newChatRateLimiter(ctx),
+		Usage:          newUsageStore(ctx),
+		Audit:          newModerationAuditStore(ctx),
+		EmbeddingCache: newEmbeddingCache(ctx, secrets),
+		Keys:           newKeyCache(secrets, ProviderKeyCacheSeconds*time.Second, time.Now),
+		Providers:      defaultProviders(),
+		Now:            time.Now,
+	}
+}
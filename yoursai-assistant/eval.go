@@ -0,0 +1,784 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/chunker"
+	"shared/embedcache"
+	"shared/ratelimit"
+)
+
+// The eval subcommand replays a question set through the chat handler, has
+// a judge model score every answer and compares the run with a baseline:
+//
+//	go run . eval -out report.json
+//	go run . eval -baseline testdata/eval/baseline.json
+//
+// History, sessions and the vector store are in memory; the chat, embedding
+// and judge calls go to the configured provider, keyed from GEMINI_API_KEY or
+// OPENAI_API_KEY when set and from Parameter Store otherwise.
+
+const judgePrompt = `You grade answers from a company knowledge-base assistant.
+You are given the user's question, the documents retrieved for it, an optional reference answer and the assistant's answer.
+Score each criterion from 1 (poor) to 5 (excellent):
+- faithfulness: every claim in the answer is supported by the retrieved documents; without documents, the answer admits what it does not know
+- relevance: the answer addresses the question that was asked
+- completeness: the answer covers everything the question needs, judged against the reference answer when there is one
+Reply with only a JSON object: {"faithfulness": n, "relevance": n, "completeness": n, "reason": "one sentence"}`
+
+// errEvalRegression is returned when a run scores worse than its baseline.
+var errEvalRegression = errors.New("answer quality regressed against the baseline")
+
+// EvalCase is one question of an evaluation set.
+type EvalCase struct {
+	Question          string `json:"question"`
+	Reference         string `json:"reference,omitempty"` // what a complete answer says
+	Persona           string `json:"persona,omitempty"`
+	RetrievalStrategy string `json:"retrievalStrategy,omitempty"`
+}
+
+// JudgeInput is what the judge sees for one answer.
+type JudgeInput struct {
+	Question  string
+	Reference string
+	Context   string // fenced retrieved documents, as the model saw them
+	Answer    string
+}
+
+// JudgeScores are 1-5 grades for one answer.
+type JudgeScores struct {
+	Faithfulness int    `json:"faithfulness"`
+	Relevance    int    `json:"relevance"`
+	Completeness int    `json:"completeness"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// Judge grades answers. Name identifies it in reports.
+type Judge interface {
+	Name() string
+	Score(ctx context.Context, in JudgeInput) (JudgeScores, error)
+}
+
+// llmJudge asks the configured chat model for the grades.
+type llmJudge struct {
+	deps   *Deps
+	apiKey string
+}
+
+func (j *llmJudge) Name() string {
+	ctx := context.Background() // eval runs as DefaultTenant
+	return chatProviderName(ctx) + "/" + chatModelName(ctx)
+}
+
+func (j *llmJudge) Score(ctx context.Context, in JudgeInput) (JudgeScores, error) {
+	documents := in.Context
+	if documents == "" {
+		documents = "(no documents were retrieved)"
+	}
+	reference := in.Reference
+	if reference == "" {
+		reference = "(none)"
+	}
+	prompt := fmt.Sprintf("Question:\n%s\n\nRetrieved documents:\n%s\n\nReference answer:\n%s\n\nAssistant's answer:\n%s",
+		in.Question, documents, reference, in.Answer)
+	text, _, err := j.deps.completeText(ctx, j.apiKey, judgePrompt, prompt, JudgeMaxTokens)
+	if err != nil {
+		return JudgeScores{}, err
+	}
+	return parseJudgeScores(text)
+}
+
+// parseJudgeScores reads the judge's JSON, tolerating a code fence or a
+// sentence around it.
+func parseJudgeScores(text string) (JudgeScores, error) {
+	start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return JudgeScores{}, fmt.Errorf("judge reply has no JSON object: %q", text)
+	}
+	var scores JudgeScores
+	if err := json.Unmarshal([]byte(text[start:end+1]), &scores); err != nil {
+		return JudgeScores{}, fmt.Errorf("judge reply is not valid JSON: %w", err)
+	}
+	for _, s := range []int{scores.Faithfulness, scores.Relevance, scores.Completeness} {
+		if s < 1 || s > 5 {
+			return JudgeScores{}, fmt.Errorf("judge score %d is outside 1-5", s)
+		}
+	}
+	return scores, nil
+}
+
+// EvalConfig records what produced a report, so a diff can say what changed.
+type EvalConfig struct {
+	Provider    string   `json:"provider"` // the configured primary
+	Model       string   `json:"model"`
+	Models      []string `json:"models,omitempty"` // provider/model of every reply, failover included
+	Temperature float64  `json:"temperature"`
+	// PromptSHA256 hashes the template of each persona@version the cases
+	// render, shared sections included
+	PromptSHA256      map[string]string `json:"promptSha256"`
+	RetrievalStrategy string            `json:"retrievalStrategy"`
+	Judge             string            `json:"judge"`
+}
+
+// currentEvalConfig describes a run of cases before it starts; run fills in
+// Models from the replies.
+func currentEvalConfig(judge string, cases []EvalCase) EvalConfig {
+	strategy, _ := resolveRetrievalStrategy("")
+	ctx := context.Background() // eval runs as DefaultTenant
+	prompts := map[string]string{}
+	for _, c := range cases {
+		name := c.Persona
+		if name == "" {
+			name = tenantPersona(tenantFrom(ctx))
+		}
+		// An unknown persona fails the case before anything is rendered
+		if t, ok := getPromptTemplate(name, 0); ok {
+			sum := sha256.Sum256([]byte(t.Text))
+			prompts[templateKey(t.Name, t.Version)] = hex.EncodeToString(sum[:])
+		}
+	}
+	return EvalConfig{
+		Provider:          chatProviderName(ctx),
+		Model:             chatModelName(ctx),
+		Temperature:       Temperature,
+		PromptSHA256:      prompts,
+		RetrievalStrategy: strategy,
+		Judge:             judge,
+	}
+}
+
+// EvalScores are mean judge scores.
+type EvalScores struct {
+	Faithfulness float64 `json:"faithfulness"`
+	Relevance    float64 `json:"relevance"`
+	Completeness float64 `json:"completeness"`
+}
+
+// dimensions lists the scores in report order.
+func (s EvalScores) dimensions() []struct {
+	name  string
+	value float64
+} {
+	return []struct {
+		name  string
+		value float64
+	}{{"faithfulness", s.Faithfulness}, {"relevance", s.Relevance}, {"completeness", s.Completeness}}
+}
+
+// EvalCaseResult is one replayed question.
+type EvalCaseResult struct {
+	EvalCase
+	Answer  string      `json:"answer"`
+	Model   string      `json:"model,omitempty"`   // provider/model that replied
+	Sources []string    `json:"sources,omitempty"` // retrieved documents
+	Scores  JudgeScores `json:"scores"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// EvalReport is a whole run. Failed cases score zero, so a pipeline error
+// drags the means down like a bad answer would.
+type EvalReport struct {
+	Config    EvalConfig       `json:"config"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Mean      EvalScores       `json:"mean"`
+	Failed    int              `json:"failed"`
+	Cases     []EvalCaseResult `json:"cases"`
+}
+
+// evalRunner replays cases through the handler. Searches go through a
+// recorder so the judge sees the documents the answer was grounded on.
+type evalRunner struct {
+	deps    *Deps
+	judge   Judge
+	vectors *recordingVectorStore
+}
+
+func newEvalRunner(d *Deps, judge Judge) *evalRunner {
+	recorder := &recordingVectorStore{inner: d.Vectors}
+	replay := *d
+	replay.Vectors = recorder
+	return &evalRunner{deps: &replay, judge: judge, vectors: recorder}
+}
+
+func (r *evalRunner) run(ctx context.Context, cases []EvalCase) EvalReport {
+	report := EvalReport{Config: currentEvalConfig(r.judge.Name(), cases), CreatedAt: r.deps.Now().UTC()}
+	models := map[string]bool{}
+	for i, c := range cases {
+		result := r.runCase(ctx, i, c)
+		if result.Model != "" && !models[result.Model] {
+			models[result.Model] = true
+			report.Config.Models = append(report.Config.Models, result.Model)
+		}
+		if result.Error != "" {
+			report.Failed++
+			slog.WarnContext(ctx, "Eval case failed", "question", c.Question, "error", result.Error)
+		}
+		report.Mean.Faithfulness += float64(result.Scores.Faithfulness)
+		report.Mean.Relevance += float64(result.Scores.Relevance)
+		report.Mean.Completeness += float64(result.Scores.Completeness)
+		report.Cases = append(report.Cases, result)
+	}
+	sort.Strings(report.Config.Models)
+	if n := float64(len(cases)); n > 0 {
+		report.Mean.Faithfulness /= n
+		report.Mean.Relevance /= n
+		report.Mean.Completeness /= n
+	}
+	return report
+}
+
+func (r *evalRunner) runCase(ctx context.Context, i int, c EvalCase) EvalCaseResult {
+	result := EvalCaseResult{EvalCase: c}
+	r.vectors.reset()
+
+	// A user per case keeps rate limits and quotas out of the way, and a
+	// fresh session keeps earlier answers out of the history
+	userId := fmt.Sprintf("eval-user-%d", i)
+	body, _ := json.Marshal(Request{
+		SessionId:         fmt.Sprintf("eval-%d", i),
+		Message:           c.Question,
+		Persona:           c.Persona,
+		RetrievalStrategy: c.RetrievalStrategy,
+	})
+	resp, err := r.deps.handler(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Path:       "/chat",
+		Headers:    map[string]string{"Authorization": evalBearerToken(userId)},
+		Body:       string(body),
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if resp.StatusCode != 200 {
+		result.Error = fmt.Sprintf("chat returned %d: %s", resp.StatusCode, resp.Body)
+		return result
+	}
+	var reply Response
+	if err := json.Unmarshal([]byte(resp.Body), &reply); err != nil {
+		result.Error = "invalid chat response: " + err.Error()
+		return result
+	}
+	result.Answer = reply.Reply
+	result.Model = reply.Provider + "/" + reply.Model
+
+	retrieved := r.vectors.results()
+	seen := map[string]bool{}
+	for _, doc := range retrieved {
+		if !seen[doc.DocumentName] {
+			seen[doc.DocumentName] = true
+			result.Sources = append(result.Sources, doc.DocumentName)
+		}
+	}
+
+	scores, err := r.judge.Score(ctx, JudgeInput{
+		Question:  c.Question,
+		Reference: c.Reference,
+		Context:   fenceDocuments(retrieved),
+		Answer:    reply.Reply,
+	})
+	if err != nil {
+		result.Error = "judge: " + err.Error()
+		return result
+	}
+	result.Scores = scores
+	return result
+}
+
+// evalBearerToken builds an unsigned JWT for the handler; in production API
+// Gateway has verified the token before the handler runs.
+func evalBearerToken(userId string) string {
+	payload, _ := json.Marshal(map[string]string{"sub": userId})
+	return "Bearer e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+// EvalDiff compares a run with its baseline.
+type EvalDiff struct {
+	Baseline    EvalScores
+	Current     EvalScores
+	Changes     []string // configuration and question-set differences
+	Regressions []string
+	Cases       []EvalCaseDiff
+}
+
+// EvalCaseDiff is a question whose grades or failure state moved.
+type EvalCaseDiff struct {
+	Question      string
+	Before, After JudgeScores
+	BeforeError   string
+	AfterError    string
+}
+
+// diffReports compares current with baseline. A mean that drops by more
+// than tolerance, or a question that used to succeed and now fails, is a
+// regression.
+func diffReports(baseline, current EvalReport, tolerance float64) EvalDiff {
+	diff := EvalDiff{Baseline: baseline.Mean, Current: current.Mean}
+
+	b, c := baseline.Config, current.Config
+	for _, field := range []struct{ name, before, after string }{
+		{"provider", b.Provider, c.Provider},
+		{"model", b.Model, c.Model},
+		{"models that replied", strings.Join(b.Models, ", "), strings.Join(c.Models, ", ")},
+		{"temperature", fmt.Sprint(b.Temperature), fmt.Sprint(c.Temperature)},
+		{"retrieval strategy", b.RetrievalStrategy, c.RetrievalStrategy},
+		{"judge", b.Judge, c.Judge},
+	} {
+		if field.before != field.after {
+			diff.Changes = append(diff.Changes, fmt.Sprintf("%s: %s -> %s", field.name, field.before, field.after))
+		}
+	}
+	diff.Changes = append(diff.Changes, promptChanges(b.PromptSHA256, c.PromptSHA256)...)
+
+	before := baseline.Mean.dimensions()
+	for i, dim := range current.Mean.dimensions() {
+		if drop := before[i].value - dim.value; drop > tolerance {
+			diff.Regressions = append(diff.Regressions, fmt.Sprintf("mean %s fell from %.2f to %.2f", dim.name, before[i].value, dim.value))
+		}
+	}
+
+	old := map[string]EvalCaseResult{}
+	for _, r := range baseline.Cases {
+		old[r.Question] = r
+	}
+	for _, r := range current.Cases {
+		prev, ok := old[r.Question]
+		if !ok {
+			diff.Changes = append(diff.Changes, fmt.Sprintf("new question: %q", r.Question))
+			continue
+		}
+		delete(old, r.Question)
+		if prev.Error == "" && r.Error != "" {
+			diff.Regressions = append(diff.Regressions, fmt.Sprintf("%q now fails: %s", r.Question, r.Error))
+		}
+		if !sameGrades(prev.Scores, r.Scores) || (prev.Error == "") != (r.Error == "") {
+			diff.Cases = append(diff.Cases, EvalCaseDiff{
+				Question:    r.Question,
+				Before:      prev.Scores,
+				After:       r.Scores,
+				BeforeError: prev.Error,
+				AfterError:  r.Error,
+			})
+		}
+	}
+	var removed []string
+	for q := range old {
+		removed = append(removed, q)
+	}
+	sort.Strings(removed)
+	for _, q := range removed {
+		diff.Changes = append(diff.Changes, fmt.Sprintf("question no longer in the set: %q", q))
+	}
+	return diff
+}
+
+// promptChanges lists the persona templates whose hash differs, in name
+// order. A persona only one run rendered shows as none on the other side.
+func promptChanges(before, after map[string]string) []string {
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		if before[k] != after[k] {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make([]string, 0, len(names))
+	for _, k := range names {
+		changes = append(changes, fmt.Sprintf("prompt %s: %s -> %s", k, shortHash(before[k]), shortHash(after[k])))
+	}
+	return changes
+}
+
+// sameGrades ignores the judge's reason, which varies between runs.
+func sameGrades(a, b JudgeScores) bool {
+	return a.Faithfulness == b.Faithfulness && a.Relevance == b.Relevance && a.Completeness == b.Completeness
+}
+
+func shortHash(h string) string {
+	if h == "" {
+		return "none"
+	}
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return h
+}
+
+func printEvalReport(w io.Writer, report EvalReport) {
+	fmt.Fprintf(w, "%d questions, %d failed, %s judged by %s\n\n", len(report.Cases), report.Failed, report.Config.Model, report.Config.Judge)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "faithfulness\trelevance\tcompleteness\tquestion")
+	for _, r := range report.Cases {
+		if r.Error != "" {
+			fmt.Fprintf(tw, "-\t-\t-\t%s (failed: %s)\n", r.Question, r.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\n", r.Scores.Faithfulness, r.Scores.Relevance, r.Scores.Completeness, r.Question)
+	}
+	fmt.Fprintf(tw, "%.2f\t%.2f\t%.2f\tmean\n", report.Mean.Faithfulness, report.Mean.Relevance, report.Mean.Completeness)
+	tw.Flush()
+}
+
+func printEvalDiff(w io.Writer, diff EvalDiff) {
+	fmt.Fprintln(w, "\nAgainst the baseline:")
+	for _, change := range diff.Changes {
+		fmt.Fprintln(w, "  "+change)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tbaseline\tcurrent\tchange")
+	before := diff.Baseline.dimensions()
+	for i, dim := range diff.Current.dimensions() {
+		fmt.Fprintf(tw, "%s\t%.2f\t%.2f\t%+.2f\n", dim.name, before[i].value, dim.value, dim.value-before[i].value)
+	}
+	tw.Flush()
+	for _, c := range diff.Cases {
+		fmt.Fprintf(w, "  %q: %s -> %s\n", c.Question, formatCaseScores(c.Before, c.BeforeError), formatCaseScores(c.After, c.AfterError))
+	}
+	for _, r := range diff.Regressions {
+		fmt.Fprintln(w, "REGRESSION: "+r)
+	}
+}
+
+func formatCaseScores(s JudgeScores, errText string) string {
+	if errText != "" {
+		return "failed"
+	}
+	return fmt.Sprintf("%d/%d/%d", s.Faithfulness, s.Relevance, s.Completeness)
+}
+
+// runEval is the eval subcommand.
+func runEval(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	questionsPath := fs.String("questions", "testdata/eval/questions.jsonl", "JSON Lines question set")
+	corpusDir := fs.String("corpus", "../yoursai-eval/testdata/corpus", "directory of .md and .txt documents to retrieve from")
+	outPath := fs.String("out", "", "write the report as JSON to this file")
+	baselinePath := fs.String("baseline", "", "compare with this earlier report and fail on a regression")
+	tolerance := fs.Float64("tolerance", EvalRegressionTolerance, "largest mean score drop that is not a regression")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if os.Getenv("METRICS") == "" {
+		os.Setenv("METRICS", "off")
+	}
+
+	cases, err := loadEvalCases(*questionsPath)
+	if err != nil {
+		return err
+	}
+	var baseline *EvalReport
+	if *baselinePath != "" {
+		raw, err := os.ReadFile(*baselinePath)
+		if err != nil {
+			return err
+		}
+		baseline = &EvalReport{}
+		if err := json.Unmarshal(raw, baseline); err != nil {
+			return fmt.Errorf("reading baseline %s: %w", *baselinePath, err)
+		}
+	}
+
+	secrets := envSecretStore{fallback: ssmSecretStore{}}
+	apiKey, err := secrets.Get(ctx, SSMKeyPath)
+	if err != nil {
+		return fmt.Errorf("getting API key: %w", err)
+	}
+	// Only the providers are real; everything else stays in the process
+	d := &Deps{
+		Secrets:        secrets,
+		History:        newMemoryHistoryStore(),
+		Sessions:       newMemorySessionStore(),
+		Limiter:        ratelimit.NewMemory(RateLimitPerMin, RateLimitWindow, nil),
+		Usage:          newMemoryUsageStore(),
+		Audit:          logModerationAudit{},
+		EmbeddingCache: embedcache.New(EmbeddingCacheLRUSize, nil),
+		Keys:           newKeyCache(secrets, ProviderKeyCacheSeconds*time.Second, time.Now),
+		Providers:      defaultProviders(),
+		Now:            time.Now,
+	}
+	docs, err := loadEvalCorpus(*corpusDir)
+	if err != nil {
+		return err
+	}
+	if d.Vectors, err = newMemoryVectorStore(ctx, d, apiKey, docs); err != nil {
+		return err
+	}
+
+	report := newEvalRunner(d, &llmJudge{deps: d, apiKey: apiKey}).run(ctx, cases)
+	printEvalReport(stdout, report)
+	if *outPath != "" {
+		raw, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*outPath, append(raw, '\n'), 0o644); err != nil {
+			return err
+		}
+	}
+	if baseline != nil {
+		diff := diffReports(*baseline, report, *tolerance)
+		printEvalDiff(stdout, diff)
+		if len(diff.Regressions) > 0 {
+			return errEvalRegression
+		}
+	}
+	return nil
+}
+
+func loadEvalCases(path string) ([]EvalCase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cases []EvalCase
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+		var c EvalCase
+		if err := json.Unmarshal([]byte(raw), &c); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if strings.TrimSpace(c.Question) == "" {
+			return nil, fmt.Errorf("%s:%d: question is required", path, line)
+		}
+		cases = append(cases, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("%s has no questions", path)
+	}
+	return cases, nil
+}
+
+// evalDocument is one corpus file, named by its path under the corpus dir.
+type evalDocument struct {
+	name, text string
+}
+
+func loadEvalCorpus(dir string) ([]evalDocument, error) {
+	var docs []evalDocument
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if entry.IsDir() || (ext != ".md" && ext != ".txt") {
+			return nil
+		}
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(dir, path)
+		docs = append(docs, evalDocument{name: filepath.ToSlash(name), text: string(text)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no .md or .txt files in %s", dir)
+	}
+	return docs, nil
+}
+
+// envSecretStore serves the provider API keys from GEMINI_API_KEY and
+// OPENAI_API_KEY and everything else from the fallback.
+type envSecretStore struct {
+	fallback SecretStore
+}
+
+func (s envSecretStore) Get(ctx context.Context, name string) (string, error) {
+	env := map[string]string{GeminiKeyPath: "GEMINI_API_KEY", OpenAIKeyPath: "OPENAI_API_KEY"}[name]
+	if v := os.Getenv(env); env != "" && v != "" {
+		return v, nil
+	}
+	return s.fallback.Get(ctx, name)
+}
+
+// memoryHistoryStore keeps history for one eval run.
+type memoryHistoryStore struct {
+	mu      sync.Mutex
+	records map[string][]ChatRecord
+}
+
+func newMemoryHistoryStore() *memoryHistoryStore {
+	return &memoryHistoryStore{records: map[string][]ChatRecord{}}
+}
+
+func (s *memoryHistoryStore) Load(ctx context.Context, userId, sessionId string) ([]ChatExchange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := []ChatExchange{}
+	for _, r := range s.records[userId+"#"+sessionId] {
+		history = append(history, ChatExchange{UserMessage: r.UserMessage, AIReply: r.AIReply})
+	}
+	return history, nil
+}
+
+func (s *memoryHistoryStore) Save(ctx context.Context, userId, sessionId string, record ChatRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[userId+"#"+sessionId] = append(s.records[userId+"#"+sessionId], record)
+	return nil
+}
+
+// memorySessionStore keeps session settings for one eval run.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	settings map[string]SessionSettings
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{settings: map[string]SessionSettings{}}
+}
+
+func (s *memorySessionStore) Get(ctx context.Context, userId, sessionId string) (SessionSettings, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings, ok := s.settings[userId+"#"+sessionId]
+	return settings, ok, nil
+}
+
+func (s *memorySessionStore) Create(ctx context.Context, userId, sessionId string, settings SessionSettings, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.settings[userId+"#"+sessionId]; ok {
+		return errSessionExists
+	}
+	s.settings[userId+"#"+sessionId] = settings
+	return nil
+}
+
+// memoryVectorStore is a brute-force L2 search over a chunked corpus, the
+// same ranking pgVectorStore gets from embedding <-> $1.
+type memoryVectorStore struct {
+	chunks []memoryChunk
+}
+
+type memoryChunk struct {
+	result    SearchResult
+	embedding []float64
+}
+
+func newMemoryVectorStore(ctx context.Context, d *Deps, apiKey string, docs []evalDocument) (*memoryVectorStore, error) {
+	store := &memoryVectorStore{}
+	for _, doc := range docs {
+		for _, chunk := range chunker.Split(doc.text, EvalChunkTokens) {
+			embedding, _, err := d.generateEmbedding(ctx, chunk, apiKey)
+			if err != nil {
+				return nil, fmt.Errorf("embedding %s: %w", doc.name, err)
+			}
+			store.chunks = append(store.chunks, memoryChunk{
+				result:    SearchResult{Content: chunk, DocumentName: doc.name},
+				embedding: embedding,
+			})
+		}
+	}
+	return store, nil
+}
+
+func (s *memoryVectorStore) Available(ctx context.Context) bool { return len(s.chunks) > 0 }
+
+func (s *memoryVectorStore) Search(ctx context.Context, embedding []float64, scope SearchScope) ([]SearchResult, error) {
+	if !scope.Filter.empty() {
+		// Eval corpus files carry no metadata to filter on
+		return nil, fmt.Errorf("metadata filters are not supported in eval")
+	}
+	results := make([]SearchResult, 0, len(s.chunks))
+	for _, c := range s.chunks {
+		if len(c.embedding) != len(embedding) {
+			return nil, fmt.Errorf("embedding dimensions differ: %d and %d", len(c.embedding), len(embedding))
+		}
+		var sq float64
+		for i := range embedding {
+			sq += (embedding[i] - c.embedding[i]) * (embedding[i] - c.embedding[i])
+		}
+		r := c.result
+		r.Distance = math.Sqrt(sq)
+		results = append(results, r)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Distance < results[j].Distance })
+	if len(results) > RetrievalTopK {
+		results = results[:RetrievalTopK]
+	}
+	return results, nil
+}
+
+// recordingVectorStore passes searches through and keeps what they
+// returned for the current case.
+type recordingVectorStore struct {
+	inner VectorStore
+	mu    sync.Mutex
+	found []SearchResult
+}
+
+func (s *recordingVectorStore) Available(ctx context.Context) bool {
+	return s.inner != nil && s.inner.Available(ctx)
+}
+
+func (s *recordingVectorStore) Search(ctx context.Context, embedding []float64, scope SearchScope) ([]SearchResult, error) {
+	results, err := s.inner.Search(ctx, embedding, scope)
+	if err == nil {
+		s.mu.Lock()
+		s.found = append(s.found, results...)
+		s.mu.Unlock()
+	}
+	return results, err
+}
+
+func (s *recordingVectorStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.found = nil
+}
+
+// results returns the distinct chunks found since the last reset, closest
+// first.
+func (s *recordingVectorStore) results() []SearchResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := map[SearchResult]bool{}
+	var unique []SearchResult
+	for _, r := range s.found {
+		key := SearchResult{Content: r.Content, DocumentName: r.DocumentName}
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, r)
+		}
+	}
+	sort.SliceStable(unique, func(i, j int) bool { return unique[i].Distance < unique[j].Distance })
+	return unique
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeJudge returns fixed grades and keeps what it was asked.
+type fakeJudge struct {
+	scores JudgeScores
+	err    error
+	inputs []JudgeInput
+}
+
+func (j *fakeJudge) Name() string { return "fake" }
+
+func (j *fakeJudge) Score(ctx context.Context, in JudgeInput) (JudgeScores, error) {
+	j.inputs = append(j.inputs, in)
+	return j.scores, j.err
+}
+
+func TestEvalRunnerReplaysQuestionsThroughTheHandler(t *testing.T) {
+	env := newTestEnv(t)
+	env.vectors.results = []SearchResult{{Content: "Laptops are collected from the service desk.", DocumentName: "onboarding.md", Distance: 0.2}}
+	env.api.script("/embed", embeddingReply(0.1, 0.2, 0.3))
+	env.api.script("/gemini", geminiReply("Collect it from the service desk.", "STOP"))
+	judge := &fakeJudge{scores: JudgeScores{Faithfulness: 5, Relevance: 4, Completeness: 3}}
+
+	report := newEvalRunner(env.deps, judge).run(context.Background(), []EvalCase{
+		{Question: "Where do I pick up my laptop on my first day?", Reference: "The service desk."},
+		{Question: "What does the pirate persona say about laptops?", Persona: "pirate"},
+	})
+
+	if len(report.Cases) != 2 || report.Failed != 1 {
+		t.Fatalf("cases = %d, failed = %d; want 2 and 1", len(report.Cases), report.Failed)
+	}
+	answered := report.Cases[0]
+	if answered.Answer != "Collect it from the service desk." || answered.Error != "" {
+		t.Errorf("first case = %+v", answered)
+	}
+	if !reflect.DeepEqual(answered.Sources, []string{"onboarding.md"}) {
+		t.Errorf("sources = %v, want [onboarding.md]", answered.Sources)
+	}
+	if !strings.Contains(report.Cases[1].Error, "400") {
+		t.Errorf("second case error = %q, want the handler's 400", report.Cases[1].Error)
+	}
+
+	if len(judge.inputs) != 1 {
+		t.Fatalf("judge called %d times, want only for the answered case", len(judge.inputs))
+	}
+	in := judge.inputs[0]
+	if in.Reference != "The service desk." || !strings.Contains(in.Context, `<document source="onboarding.md">`) {
+		t.Errorf("judge input = %+v", in)
+	}
+
+	// The failed case scores zero and halves every mean
+	want := EvalScores{Faithfulness: 2.5, Relevance: 2, Completeness: 1.5}
+	if report.Mean != want {
+		t.Errorf("mean = %+v, want %+v", report.Mean, want)
+	}
+	if report.Config.Judge != "fake" || report.Config.Model != chatModelName(context.Background()) {
+		t.Errorf("config = %+v", report.Config)
+	}
+	if want := []string{"gemini/" + GeminiModel}; !reflect.DeepEqual(report.Config.Models, want) || answered.Model != want[0] {
+		t.Errorf("models = %v (case %q), want %v from the reply", report.Config.Models, answered.Model, want)
+	}
+	// Only the persona the answered case rendered; the unknown one renders nothing
+	persona, _ := getPromptTemplate(DefaultPersona, 0)
+	if hashes := report.Config.PromptSHA256; len(hashes) != 1 || hashes[templateKey(persona.Name, persona.Version)] == "" {
+		t.Errorf("prompt hashes = %v, want one for %s", hashes, DefaultPersona)
+	}
+}
+
+func TestLLMJudgeAsksTheChatModel(t *testing.T) {
+	env := newTestEnv(t)
+	env.api.script("/gemini", geminiReply("```json\n{\"faithfulness\": 4, \"relevance\": 5, \"completeness\": 2, \"reason\": \"Misses the badge.\"}\n```", "STOP"))
+
+	judge := &llmJudge{deps: env.deps, apiKey: "gemini-test-key"}
+	scores, err := judge.Score(context.Background(), JudgeInput{Question: "Where is my laptop?", Answer: "At the desk."})
+	if err != nil {
+		t.Fatalf("Score: %v", err)
+	}
+	if want := (JudgeScores{Faithfulness: 4, Relevance: 5, Completeness: 2, Reason: "Misses the badge."}); scores != want {
+		t.Errorf("scores = %+v, want %+v", scores, want)
+	}
+
+	requests := env.api.requestsTo("/gemini")
+	if len(requests) != 1 {
+		t.Fatalf("judge calls = %d, want 1", len(requests))
+	}
+	if !strings.Contains(systemInstructionOf(requests[0]), "faithfulness") {
+		t.Error("judge prompt was not sent as the system instruction")
+	}
+	contents, _ := json.Marshal(requests[0]["contents"])
+	if !strings.Contains(string(contents), "(no documents were retrieved)") || !strings.Contains(string(contents), "At the desk.") {
+		t.Errorf("judge message = %s", contents)
+	}
+}
+
+func TestParseJudgeScoresRejectsBadReplies(t *testing.T) {
+	for name, reply := range map[string]string{
+		"no JSON":       "The answer is good.",
+		"invalid JSON":  `{"faithfulness": 4,`,
+		"out of range":  `{"faithfulness": 6, "relevance": 5, "completeness": 5}`,
+		"missing grade": `{"faithfulness": 4, "relevance": 5}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseJudgeScores(reply); err == nil {
+				t.Errorf("parseJudgeScores(%q) accepted the reply", reply)
+			}
+		})
+	}
+}
+
+func TestDiffReports(t *testing.T) {
+	grades := func(f, r, c int) JudgeScores { return JudgeScores{Faithfulness: f, Relevance: r, Completeness: c} }
+	baseline := EvalReport{
+		Config: EvalConfig{Model: "gemini-a", Models: []string{"gemini/gemini-a"}, Temperature: 0.2, PromptSHA256: map[string]string{"assistant@1": "aaaaaaaaaaaaaaaa"}},
+		Mean:   EvalScores{Faithfulness: 4.5, Relevance: 4.5, Completeness: 4},
+		Cases: []EvalCaseResult{
+			{EvalCase: EvalCase{Question: "q1"}, Scores: grades(5, 5, 4)},
+			{EvalCase: EvalCase{Question: "q2"}, Scores: grades(4, 4, 4)},
+			{EvalCase: EvalCase{Question: "gone"}, Scores: grades(4, 4, 4)},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		current         EvalReport
+		wantRegressions int
+		wantChanges     []string
+		wantCases       int
+	}{
+		{
+			name:    "unchanged",
+			current: baseline,
+		},
+		{
+			name: "small drop within tolerance",
+			current: EvalReport{
+				Config: baseline.Config,
+				Mean:   EvalScores{Faithfulness: 4.3, Relevance: 4.5, Completeness: 4},
+				Cases:  baseline.Cases,
+			},
+		},
+		{
+			name: "model change that hurts faithfulness",
+			current: EvalReport{
+				Config: EvalConfig{Model: "gemini-b", Models: []string{"gemini/gemini-b", "openai/gpt-x"}, Temperature: 0.2, PromptSHA256: map[string]string{"assistant@1": "aaaaaaaaaaaaaaaa"}},
+				Mean:   EvalScores{Faithfulness: 3.5, Relevance: 4.5, Completeness: 4},
+				Cases: []EvalCaseResult{
+					{EvalCase: EvalCase{Question: "q1"}, Scores: grades(3, 5, 4), Answer: "different"},
+					baseline.Cases[1],
+					baseline.Cases[2],
+				},
+			},
+			wantRegressions: 1,
+			wantChanges: []string{
+				"model: gemini-a -> gemini-b",
+				"models that replied: gemini/gemini-a -> gemini/gemini-b, openai/gpt-x",
+			},
+			wantCases: 1,
+		},
+		{
+			name: "question now fails and the set changed",
+			current: EvalReport{
+				Config: EvalConfig{Model: "gemini-a", Models: []string{"gemini/gemini-a"}, Temperature: 0.7, PromptSHA256: map[string]string{"assistant@1": "bbbbbbbbbbbbbbbb", "policy-qa@1": "cccccccccccccccc"}},
+				Mean:   EvalScores{Faithfulness: 4.5, Relevance: 4.5, Completeness: 4},
+				Cases: []EvalCaseResult{
+					baseline.Cases[0],
+					{EvalCase: EvalCase{Question: "q2"}, Error: "chat returned 500"},
+					{EvalCase: EvalCase{Question: "new"}, Scores: grades(5, 5, 5)},
+				},
+			},
+			wantRegressions: 1,
+			wantChanges: []string{
+				"temperature: 0.2 -> 0.7",
+				"prompt assistant@1: aaaaaaaaaaaa -> bbbbbbbbbbbb",
+				"prompt policy-qa@1: none -> cccccccccccc",
+				`new question: "new"`,
+				`question no longer in the set: "gone"`,
+			},
+			wantCases: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := diffReports(baseline, tt.current, EvalRegressionTolerance)
+			if len(diff.Regressions) != tt.wantRegressions {
+				t.Errorf("regressions = %q, want %d", diff.Regressions, tt.wantRegressions)
+			}
+			if !reflect.DeepEqual(diff.Changes, tt.wantChanges) {
+				t.Errorf("changes = %q, want %q", diff.Changes, tt.wantChanges)
+			}
+			if len(diff.Cases) != tt.wantCases {
+				t.Errorf("changed cases = %+v, want %d", diff.Cases, tt.wantCases)
+			}
+		})
+	}
+}
+
+func TestMemoryVectorStoreRanksByL2Distance(t *testing.T) {
+	store := &memoryVectorStore{}
+	for i, v := range [][]float64{{0, 0}, {3, 4}, {1, 0}, {0, 2}} {
+		store.chunks = append(store.chunks, memoryChunk{
+			result:    SearchResult{DocumentName: string(rune('a' + i))},
+			embedding: v,
+		})
+	}
+	results, err := store.Search(context.Background(), []float64{0, 0}, SearchScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range results {
+		got = append(got, r.DocumentName)
+	}
+	if want := []string{"a", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ranking = %v, want %v (top %d)", got, want, RetrievalTopK)
+	}
+	if _, err := store.Search(context.Background(), []float64{0}, SearchScope{}); err == nil {
+		t.Error("expected an error for a query of the wrong dimension")
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/ratelimit"
+	"shared/throttle"
+)
+
+// TestMain keeps every backend that is not part of Deps in memory, so the
+// suite never touches AWS, Postgres or the network.
+func TestMain(m *testing.M) {
+	for key, value := range map[string]string{
+		"QUERY_REWRITE": "off",
+		"METRICS":       "off",
+	} {
+		os.Setenv(key, value)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+var testNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeSecrets serves secrets from a map.
+type fakeSecrets map[string]string
+
+func (f fakeSecrets) Get(ctx context.Context, name string) (string, error) {
+	if v, ok := f[name]; ok {
+		return v, nil
+	}
+	return "", errors.New("parameter not found: " + name)
+}
+
+// fakeHistory keeps exchanges in memory, keyed by user and session.
+type fakeHistory struct {
+	mu      sync.Mutex
+	records map[string][]ChatRecord
+}
+
+func newFakeHistory() *fakeHistory {
+	return &fakeHistory{records: map[string][]ChatRecord{}}
+}
+
+func (f *fakeHistory) Load(ctx context.Context, userId, sessionId string) ([]ChatExchange, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	history := []ChatExchange{}
+	for _, r := range f.records[userId+"/"+sessionId] {
+		history = append(history, ChatExchange{UserMessage: r.UserMessage, AIReply: r.AIReply})
+	}
+	return history, nil
+}
+
+func (f *fakeHistory) Save(ctx context.Context, userId, sessionId string, record ChatRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records[userId+"/"+sessionId] = append(f.records[userId+"/"+sessionId], record)
+	return nil
+}
+
+func (f *fakeHistory) saved(userId, sessionId string) []ChatRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.records[userId+"/"+sessionId]
+}
+
+// fakeSessions keeps session settings in memory.
+type fakeSessions struct {
+	mu       sync.Mutex
+	settings map[string]SessionSettings
+}
+
+func newFakeSessions() *fakeSessions {
+	return &fakeSessions{settings: map[string]SessionSettings{}}
+}
+
+func (f *fakeSessions) Get(ctx context.Context, userId, sessionId string) (SessionSettings, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.settings[userId+"/"+sessionId]
+	return s, ok, nil
+}
+
+func (f *fakeSessions) Create(ctx context.Context, userId, sessionId string, settings SessionSettings, now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.settings[userId+"/"+sessionId]; ok {
+		return errSessionExists
+	}
+	f.settings[userId+"/"+sessionId] = settings
+	return nil
+}
+
+// fakeTenants serves tenant configuration from a map.
+type fakeTenants map[string]TenantConfig
+
+func (f fakeTenants) Get(ctx context.Context, tenantId string) (TenantConfig, bool, error) {
+	cfg, ok := f[tenantId]
+	return cfg, ok, nil
+}
+
+// fakeVectors returns canned results and counts searches.
+type fakeVectors struct {
+	mu          sync.Mutex
+	unavailable bool
+	results     []SearchResult
+	searches    int
+	scopes      []SearchScope // scope of each search
+}
+
+func (f *fakeVectors) Available(ctx context.Context) bool { return !f.unavailable }
+
+func (f *fakeVectors) Search(ctx context.Context, embedding []float64, scope SearchScope) ([]SearchResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.searches++
+	f.scopes = append(f.scopes, scope)
+	return append([]SearchResult(nil), f.results...), nil
+}
+
+func (f *fakeVectors) searchCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.searches
+}
+
+// fakeResponse is one scripted provider reply.
+type fakeResponse struct {
+	status int
+	body   interface{}
+}
+
+// fakeAPI stands in for the provider APIs. Each path serves its scripted
+// responses in order and repeats the last one; every request body is kept.
+type fakeAPI struct {
+	mu        sync.Mutex
+	responses map[string][]fakeResponse
+	requests  map[string][]map[string]interface{}
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{responses: map[string][]fakeResponse{}, requests: map[string][]map[string]interface{}{}}
+}
+
+func (f *fakeAPI) script(path string, responses ...fakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[path] = responses
+}
+
+func (f *fakeAPI) requestsTo(path string) []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	f.mu.Lock()
+	f.requests[r.URL.Path] = append(f.requests[r.URL.Path], body)
+	queue := f.responses[r.URL.Path]
+	if len(queue) == 0 {
+		f.mu.Unlock()
+		http.Error(w, "unexpected request to "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	resp := queue[0]
+	if len(queue) > 1 {
+		f.responses[r.URL.Path] = queue[1:]
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	json.NewEncoder(w).Encode(resp.body)
+}
+
+// testEnv is a Deps wired to fakes and one fake provider server.
+type testEnv struct {
+	deps     *Deps
+	api      *fakeAPI
+	history  *fakeHistory
+	sessions *fakeSessions
+	vectors  *fakeVectors
+	usage    *memoryUsageStore
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	api := newFakeAPI()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	env := &testEnv{
+		api:      api,
+		history:  newFakeHistory(),
+		sessions: newFakeSessions(),
+		vectors:  &fakeVectors{},
+		usage:    newMemoryUsageStore(),
+	}
+	env.deps = &Deps{
+		Secrets:  fakeSecrets{GeminiKeyPath: "gemini-test-key", OpenAIKeyPath: "openai-test-key"},
+		Tenants:  fakeTenants{},
+		History:  env.history,
+		Sessions: env.sessions,
+		Vectors:  env.vectors,
+		Usage:    env.usage,
+		Audit:    logModerationAudit{},
+		Providers: Providers{
+			GeminiURL:          server.URL + "/gemini",
+			OpenAIURL:          server.URL + "/openai",
+			EmbeddingURL:       server.URL + "/embed",
+			OpenAIEmbeddingURL: server.URL + "/openai-embed",
+			ModerationURL:      server.URL + "/moderation",
+			Breakers: newBreakerSet(func(name string) *CircuitBreaker {
+				return newCircuitBreaker(name, CircuitBreakerThreshold, time.Minute)
+			}),
+			Throttles: throttle.NewSet(nil),
+		},
+		Now: func() time.Time { return testNow },
+	}
+	env.deps.Limiter = ratelimit.NewMemory(RateLimitPerMin, RateLimitWindow, env.deps.Now)
+	env.deps.Keys = newKeyCache(env.deps.Secrets, ProviderKeyCacheSeconds*time.Second, env.deps.Now)
+	return env
+}
+
+// chat sends a POST to the handler as the given user.
+func (e *testEnv) chat(t *testing.T, userId string, body Request) (events.APIGatewayProxyResponse, Response) {
+	t.Helper()
+	return e.chatWithClaims(t, map[string]interface{}{"sub": userId}, body)
+}
+
+func (e *testEnv) chatWithClaims(t *testing.T, claims map[string]interface{}, body Request) (events.APIGatewayProxyResponse, Response) {
+	t.Helper()
+	raw, _ := json.Marshal(body)
+	resp, err := e.deps.handler(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Path:       "/chat",
+		Headers:    map[string]string{"Authorization": bearerToken(claims)},
+		Body:       string(raw),
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	var parsed Response
+	json.Unmarshal([]byte(resp.Body), &parsed)
+	return resp, parsed
+}
+
+// bearerToken builds an unsigned JWT; API Gateway has already verified it
+// by the time the handler runs.
+func bearerToken(claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	return "Bearer e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func geminiReply(text, finishReason string) fakeResponse {
+	return fakeResponse{status: http.StatusOK, body: map[string]interface{}{
+		"candidates": []interface{}{map[string]interface{}{
+			"content":      map[string]interface{}{"role": "model", "parts": []interface{}{map[string]interface{}{"text": text}}},
+			"finishReason": finishReason,
+		}},
+		"usageMetadata": map[string]interface{}{"promptTokenCount": 10, "candidatesTokenCount": 5},
+	}}
+}
+
+func openAIReply(text string) fakeResponse {
+	return fakeResponse{status: http.StatusOK, body: map[string]interface{}{
+		"choices": []interface{}{map[string]interface{}{
+			"message":       map[string]interface{}{"role": "assistant", "content": text},
+			"finish_reason": "stop",
+		}},
+		"usage": map[string]interface{}{"prompt_tokens": 10, "completion_tokens": 5},
+	}}
+}
+
+func embeddingReply(values ...float64) fakeResponse {
+	return fakeResponse{status: http.StatusOK, body: map[string]interface{}{
+		"embedding": map[string]interface{}{"values": values},
+	}}
+}
+
+// systemInstructionOf returns the system prompt of a Gemini request.
+func systemInstructionOf(req map[string]interface{}) string {
+	si, _ := req["systemInstruction"].(map[string]interface{})
+	parts, _ := si["parts"].([]interface{})
+	var b strings.Builder
+	for _, p := range parts {
+		part, _ := p.(map[string]interface{})
+		text, _ := part["text"].(string)
+		b.WriteString(text)
+	}
+	return b.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MetadataFilter narrows retrieval to matching documents. Every set field
+// must match; the conditions are applied in the vector search's WHERE
+// clause, so the top chunks are the best of the matching documents.
+type MetadataFilter struct {
+	Tags          []string `json:"tags,omitempty"`          // documents carrying all of these tags
+	DocumentIds   []string `json:"documentIds,omitempty"`   // any of these documents
+	CollectionIds []string `json:"collectionIds,omitempty"` // any of these collections; unreadable ones match nothing
+	DateFrom      string   `json:"dateFrom,omitempty"`      // YYYY-MM-DD, inclusive, on the document date
+	DateTo        string   `json:"dateTo,omitempty"`        // YYYY-MM-DD, inclusive
+	// Metadata matches by JSON containment: {"department": "hr"} matches any
+	// document whose metadata has that key and value
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+const filterDateLayout = "2006-01-02"
+
+// empty reports whether the filter matches every document.
+func (f *MetadataFilter) empty() bool {
+	return f == nil || (len(f.Tags) == 0 && len(f.DocumentIds) == 0 && len(f.CollectionIds) == 0 &&
+		f.DateFrom == "" && f.DateTo == "" && len(f.Metadata) == 0)
+}
+
+// validate checks a filter from a request. A nil filter is valid.
+func (f *MetadataFilter) validate() error {
+	if f == nil {
+		return nil
+	}
+	if len(f.Tags) > MaxFilterValues || len(f.DocumentIds) > MaxFilterValues || len(f.CollectionIds) > MaxFilterValues {
+		return fmt.Errorf("at most %d tags, document IDs or collection IDs each", MaxFilterValues)
+	}
+	for _, tag := range f.Tags {
+		if tag == "" {
+			return fmt.Errorf("tags must not be empty")
+		}
+	}
+	for _, id := range f.DocumentIds {
+		if id == "" {
+			return fmt.Errorf("document IDs must not be empty")
+		}
+	}
+	for _, id := range f.CollectionIds {
+		if id == "" {
+			return fmt.Errorf("collection IDs must not be empty")
+		}
+	}
+	var from, to time.Time
+	var err error
+	if f.DateFrom != "" {
+		if from, err = time.Parse(filterDateLayout, f.DateFrom); err != nil {
+			return fmt.Errorf("dateFrom must be YYYY-MM-DD")
+		}
+	}
+	if f.DateTo != "" {
+		if to, err = time.Parse(filterDateLayout, f.DateTo); err != nil {
+			return fmt.Errorf("dateTo must be YYYY-MM-DD")
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return fmt.Errorf("dateTo is before dateFrom")
+	}
+	if f.Metadata != nil {
+		raw, err := json.Marshal(f.Metadata)
+		if err != nil {
+			return fmt.Errorf("metadata is not valid JSON")
+		}
+		if len(raw) > MaxFilterMetadataBytes {
+			return fmt.Errorf("metadata is larger than %d bytes", MaxFilterMetadataBytes)
+		}
+	}
+	return nil
+}
+
+// sqlConditions returns the filter as WHERE conditions on aiknowledge,
+// numbering placeholders after the args already bound, and the args
+// extended with the filter's values.
+func (f *MetadataFilter) sqlConditions(args []interface{}) ([]string, []interface{}) {
+	if f.empty() {
+		return nil, args
+	}
+	var conds []string
+	bind := func(cond string, value interface{}) {
+		args = append(args, value)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if len(f.Tags) > 0 {
+		tags, _ := json.Marshal(f.Tags)
+		bind("tags @> $%d::jsonb", string(tags))
+	}
+	if len(f.DocumentIds) > 0 {
+		bind("document_id = ANY($%d)", pq.Array(f.DocumentIds))
+	}
+	if len(f.CollectionIds) > 0 {
+		bind("collection_id = ANY($%d)", pq.Array(f.CollectionIds))
+	}
+	if f.DateFrom != "" {
+		bind("document_date >= $%d::date", f.DateFrom)
+	}
+	if f.DateTo != "" {
+		bind("document_date <= $%d::date", f.DateTo)
+	}
+	if len(f.Metadata) > 0 {
+		metadata, _ := json.Marshal(f.Metadata)
+		bind("metadata @> $%d::jsonb", string(metadata))
+	}
+	return conds, args
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"shared/llm"
+)
+
+// chatModelName is the generation model of the tenant's provider.
+func chatModelName(ctx context.Context) string {
+	if m := tenantFrom(ctx).ChatModel; m != "" {
+		return m
+	}
+	if isGeminiAPI(ctx) {
+		return GeminiModel
+	}
+	return OpenAIModel
+}
+
+// chatProviderName is the tenant's provider, as used in throttle keys.
+func chatProviderName(ctx context.Context) string {
+	return tenantFrom(ctx).Provider()
+}
+
+// geminiModelURL points a Gemini generateContent URL naming GeminiModel at
+// model instead.
+func geminiModelURL(url, model string) string {
+	return strings.Replace(url, "/models/"+GeminiModel+":", "/models/"+model+":", 1)
+}
+
+// completeText runs one short, non-conversational generation against the
+// tenant's provider and model. It is used by helper stages such as
+// classifiers; the main chat reply has its own path with auto-continue.
+func (d *Deps) completeText(ctx context.Context, apiKey, systemInstruction, prompt string, maxTokens int) (text string, usage TokenUsage, err error) {
+	provider, model := chatProviderName(ctx), chatModelName(ctx)
+	ctx, span := startSpan(ctx, "llm.complete",
+		attribute.String("llm.provider", provider),
+		attribute.String("llm.model", model))
+	defer func() {
+		span.SetAttributes(usageAttributes(usage)...)
+		endSpan(span, err)
+	}()
+
+	url := d.Providers.OpenAIURL
+	if provider == "gemini" {
+		url = geminiModelURL(d.Providers.GeminiURL, model)
+	}
+	req, err := llm.Completion{
+		Provider:  provider,
+		Model:     model,
+		URL:       url,
+		APIKey:    apiKey,
+		System:    systemInstruction,
+		Prompt:    prompt,
+		MaxTokens: maxTokens,
+	}.Request(ctx)
+	if err != nil {
+		return "", TokenUsage{}, err
+	}
+	// Roughly four bytes of JSON per prompt token, plus the reply budget
+	if err := throttleProvider(ctx, d.Providers.Throttles, tenantFrom(ctx).KeyPath(), provider, model, int(req.ContentLength)/4+maxTokens); err != nil {
+		return "", TokenUsage{}, err
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+
+	start := time.Now()
+	resp, err := doWithRetry(ctx, client, req)
+	recordProviderCall(provider, model, start, resp, err)
+	if err != nil {
+		return "", TokenUsage{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", TokenUsage{}, fmt.Errorf("AI API returned status %d", resp.StatusCode)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", TokenUsage{}, err
+	}
+	text, err = llm.Text(provider, result)
+	return text, parseTokenUsage(result), err
+}
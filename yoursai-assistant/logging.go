@@ -0,0 +1,13 @@
+package main
+
+import "shared/logging"
+
+// initLogging sends JSON logs to stdout at LOG_LEVEL. LOG_CONTENT=truncate
+// keeps a short prefix of logged user and model text.
+func initLogging() {
+	preview := 0
+	if envOrDefault("LOG_CONTENT", LogContent) == "truncate" {
+		preview = LogContentPreviewChars
+	}
+	logging.Init(envOrDefault("LOG_LEVEL", LogLevel), preview)
+}
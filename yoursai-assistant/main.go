@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -21,7 +21,15 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+
+	"shared"
+	"shared/embedcache"
+	"shared/llm"
+	"shared/logging"
+	"shared/ratelimit"
+	"shared/redact"
 )
 
 var (
@@ -32,73 +40,33 @@ var (
 type Request struct {
 	SessionId string `json:"sessionId"`
 	Message   string `json:"message"`
-}
-
-func extractUserFromToken(authHeader string) (string, error) {
-	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-		return "", fmt.Errorf("missing or invalid authorization header")
-	}
-	
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-	parts := strings.Split(token, ".")
-	if len(parts) != 3 {
-		return "", fmt.Errorf("invalid JWT format")
-	}
-	
-	// Decode payload (second part)
-	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
-	if err != nil {
-		return "", fmt.Errorf("failed to decode JWT payload")
-	}
-	
-	var claims map[string]interface{}
-	if err := json.Unmarshal(payload, &claims); err != nil {
-		return "", fmt.Errorf("failed to parse JWT claims")
-	}
-	
-	// Extract user ID from 'sub' claim
-	if sub, ok := claims["sub"].(string); ok {
-		return sub, nil
-	}
-	
-	return "", fmt.Errorf("user ID not found in token")
+	Persona   string `json:"persona,omitempty"` // only honoured when the session is created
+	// RetrievalStrategy overrides the configured strategy for this message:
+	// "single", "multi-query", "hyde" or "multi-query+hyde"
+	RetrievalStrategy string `json:"retrievalStrategy,omitempty"`
+	// Filter limits retrieval and the search tool to matching documents
+	Filter *MetadataFilter `json:"filter,omitempty"`
 }
 
 type Response struct {
-	Reply     string `json:"reply"`
-	SessionId string `json:"sessionId"`
+	Reply     string   `json:"reply"`
+	SessionId string   `json:"sessionId"`
+	Provider  string   `json:"provider,omitempty"` // chat provider that served the reply
+	Model     string   `json:"model,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
 }
 
-func retryWithBackoff(fn func() (*http.Response, error), maxRetries int) (*http.Response, error) {
-	retryDelays := []int{2, 5, 10} // configurable retry delays in seconds
-	
-	for i := 0; i < maxRetries; i++ {
-		resp, err := fn()
-		if err != nil {
-			return nil, err
-		}
-		
-		// Retry on rate limiting (429) and service unavailable (503)
-		if resp.StatusCode != 429 && resp.StatusCode != 503 {
-			return resp, nil
-		}
-		
-		resp.Body.Close()
-		
-		if i == maxRetries-1 {
-			return resp, nil // Return the last error response
-		}
-		
-		// Use configurable retry delays
-		delaySeconds := retryDelays[i]
-		delay := time.Duration(delaySeconds) * time.Second
-		log.Printf("API error %d, retrying in %v (attempt %d/%d)", resp.StatusCode, delay, i+1, maxRetries)
-		time.Sleep(delay)
-	}
-	return nil, fmt.Errorf("max retries exceeded")
-}
+// dynamoHistoryStore keeps chat history in the ChatHistory table.
+type dynamoHistoryStore struct{}
+
+func (dynamoHistoryStore) Load(ctx context.Context, userId, sessionId string) (history []ChatExchange, err error) {
+	defer recordStageLatency("history", time.Now())
+	ctx, span := startSpan(ctx, "dynamodb.get_history")
+	defer func() {
+		span.SetAttributes(attribute.Int("chat.history.exchanges", len(history)))
+		endSpan(span, err)
+	}()
 
-func getChatHistory(ctx context.Context, userId, sessionId string) ([]string, error) {
 	cfg, _ := config.LoadDefaultConfig(ctx)
 	db := dynamodb.NewFromConfig(cfg)
 
@@ -116,32 +84,41 @@ func getChatHistory(ctx context.Context, userId, sessionId string) ([]string, er
 		return nil, err
 	}
 
-	history := []string{}
+	history = []ChatExchange{}
 	for _, item := range out.Items {
 		userMsg, userOk := item["userMessage"].(*types.AttributeValueMemberS)
 		aiMsg, aiOk := item["aiReply"].(*types.AttributeValueMemberS)
 		if userOk && aiOk {
-			history = append(history,
-				"User: "+userMsg.Value+"\nAI: "+aiMsg.Value)
+			history = append(history, ChatExchange{UserMessage: userMsg.Value, AIReply: aiMsg.Value})
 		}
 	}
 	return history, nil
 }
 
-func saveChat(ctx context.Context, userId, sessionId, userMsg, aiMsg string) error {
+func (dynamoHistoryStore) Save(ctx context.Context, userId, sessionId string, record ChatRecord) (err error) {
+	defer recordStageLatency("save", time.Now())
+	ctx, span := startSpan(ctx, "dynamodb.save_chat")
+	defer func() { endSpan(span, err) }()
+
 	cfg, _ := config.LoadDefaultConfig(ctx)
 	db := dynamodb.NewFromConfig(cfg)
 
+	item := map[string]types.AttributeValue{
+		"userId":     &types.AttributeValueMemberS{Value: userId},
+		"sessionId":  &types.AttributeValueMemberS{Value: sessionId},
+		"timestamp":  &types.AttributeValueMemberS{Value: record.Time.Format(time.RFC3339)},
+		"userMessage": &types.AttributeValueMemberS{Value: record.UserMessage},
+		"aiReply":    &types.AttributeValueMemberS{Value: record.AIReply},
+	}
+	// Keep the (masked) query used for retrieval so bad answers can be traced
+	if record.RetrievalQuery != "" {
+		item["retrievalQuery"] = &types.AttributeValueMemberS{Value: record.RetrievalQuery}
+	}
+
 	// Save new chat
-	_, err := db.PutItem(ctx, &dynamodb.PutItemInput{
+	_, err = db.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String("ChatHistory"),
-		Item: map[string]types.AttributeValue{
-			"userId":     &types.AttributeValueMemberS{Value: userId},
-			"sessionId":  &types.AttributeValueMemberS{Value: sessionId},
-			"timestamp":  &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
-			"userMessage": &types.AttributeValueMemberS{Value: userMsg},
-			"aiReply":    &types.AttributeValueMemberS{Value: aiMsg},
-		},
+		Item:      item,
 	})
 	if err != nil {
 		return err
@@ -182,7 +159,17 @@ func cleanupOldChats(ctx context.Context, userId, sessionId string, db *dynamodb
 	}
 }
 
-func getParameter(ctx context.Context, name string) (string, error) {
+// ssmSecretStore reads secrets from SSM Parameter Store.
+type ssmSecretStore struct{}
+
+func (ssmSecretStore) Get(ctx context.Context, name string) (string, error) {
+	return getParameter(ctx, name)
+}
+
+func getParameter(ctx context.Context, name string) (value string, err error) {
+	ctx, span := startSpan(ctx, "ssm.get_parameter", attribute.String("ssm.parameter", name))
+	defer func() { endSpan(span, err) }()
+
 	cfg, _ := config.LoadDefaultConfig(ctx)
 	client := ssm.NewFromConfig(cfg)
 
@@ -196,14 +183,14 @@ func getParameter(ctx context.Context, name string) (string, error) {
 	return *out.Parameter.Value, nil
 }
 
-func getDBPool(ctx context.Context) (*sql.DB, error) {
+func getDBPool(ctx context.Context, secrets SecretStore) (*sql.DB, error) {
 	var err error
 	dbOnce.Do(func() {
-		host, e1 := getParameter(ctx, DBHostPath)
-		username, e2 := getParameter(ctx, DBUsernamePath)
-		password, e3 := getParameter(ctx, DBPasswordPath)
-		database, e4 := getParameter(ctx, DBDatabasePath)
-		port, e5 := getParameter(ctx, DBPortPath)
+		host, e1 := secrets.Get(ctx, DBHostPath)
+		username, e2 := secrets.Get(ctx, DBUsernamePath)
+		password, e3 := secrets.Get(ctx, DBPasswordPath)
+		database, e4 := secrets.Get(ctx, DBDatabasePath)
+		port, e5 := secrets.Get(ctx, DBPortPath)
 		
 		if e1 != nil || e2 != nil || e3 != nil || e4 != nil || e5 != nil {
 			err = fmt.Errorf("failed to get DB parameters")
@@ -229,92 +216,234 @@ func getDBPool(ctx context.Context) (*sql.DB, error) {
 	return dbPool, err
 }
 
-func generateEmbedding(ctx context.Context, text string, apiKey string) ([]float64, error) {
-	payload := map[string]interface{}{
-		"model": EmbeddingModel,
-		"content": map[string]interface{}{
-			"parts": []map[string]string{
-				{"text": text},
-			},
-		},
+// embeddingProvider and embeddingModelName pick the embeddings the tenant's
+// documents were stored with; yoursai-ingest takes the provider from the
+// same shared/tenant configuration.
+func embeddingProvider(ctx context.Context) string {
+	return tenantFrom(ctx).Provider()
+}
+
+func embeddingModelName(ctx context.Context) string {
+	if isOpenAIAPI(ctx) {
+		return OpenAIEmbeddingModel
+	}
+	return EmbeddingModel
+}
+
+// generateEmbedding returns the embedding for text and the tokens spent on
+// it, which is zero when the embedding came from the cache.
+func (d *Deps) generateEmbedding(ctx context.Context, text string, apiKey string) (embedding []float64, tokens int, err error) {
+	ctx, span := startSpan(ctx, "embedding", attribute.String("llm.model", embeddingModelName(ctx)))
+	defer func() { endSpan(span, err) }()
+
+	cache := d.EmbeddingCache
+	key := embedcache.Key(embeddingProvider(ctx), embeddingModelName(ctx), text)
+	if cache != nil {
+		if embedding, ok := cache.Get(ctx, key); ok {
+			span.SetAttributes(attribute.Bool("embedding.cache_hit", true))
+			return embedding, 0, nil
+		}
 	}
+	span.SetAttributes(attribute.Bool("embedding.cache_hit", false))
 
-	body, _ := json.Marshal(payload)
-	req, _ := http.NewRequestWithContext(ctx, "POST", EmbeddingAPIURL+"?key="+apiKey, bytes.NewBuffer(body))
+	embedding, tokens, err = d.fetchEmbedding(ctx, text, apiKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	span.SetAttributes(usageAttributes(TokenUsage{EmbeddingTokens: tokens})...)
+	if cache != nil {
+		cache.Put(ctx, key, embedding)
+	}
+	return embedding, tokens, nil
+}
+
+func (d *Deps) fetchEmbedding(ctx context.Context, text string, apiKey string) ([]float64, int, error) {
+	provider, model := embeddingProvider(ctx), embeddingModelName(ctx)
+	var req *http.Request
+	switch provider {
+	case "openai":
+		body, _ := json.Marshal(map[string]interface{}{"model": model, "input": text})
+		req, _ = http.NewRequestWithContext(ctx, "POST", d.Providers.OpenAIEmbeddingURL, bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	case "gemini":
+		body, _ := json.Marshal(map[string]interface{}{
+			"model": model,
+			"content": map[string]interface{}{
+				"parts": []map[string]string{
+					{"text": text},
+				},
+			},
+		})
+		req, _ = http.NewRequestWithContext(ctx, "POST", d.Providers.EmbeddingURL+"?key="+apiKey, bytes.NewBuffer(body))
+	default:
+		return nil, 0, fmt.Errorf("no embedding provider configured")
+	}
 	req.Header.Set("Content-Type", "application/json")
 
+	if err := throttleProvider(ctx, d.Providers.Throttles, tenantFrom(ctx).KeyPath(), provider, model, estimateTokens(text)); err != nil {
+		return nil, 0, err
+	}
 	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := doWithRetry(ctx, client, req)
+	recordProviderCall(provider, model, start, resp, err)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("embedding API returned status %d", resp.StatusCode)
+	}
 
 	var result map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	// Gemini's embedContent does not report token usage, so estimate it for
+	// the ledger; OpenAI reports the exact count
+	tokens := estimateTokens(text)
+	var values []interface{}
+	if provider == "openai" {
+		if data, ok := result["data"].([]interface{}); ok && len(data) > 0 {
+			first, _ := data[0].(map[string]interface{})
+			values, _ = first["embedding"].([]interface{})
+		}
+		if usage, ok := result["usage"].(map[string]interface{}); ok {
+			if promptTokens, ok := usage["prompt_tokens"].(float64); ok {
+				tokens = int(promptTokens)
+			}
+		}
+	} else if embedding, ok := result["embedding"].(map[string]interface{}); ok {
+		values, _ = embedding["values"].([]interface{})
+	}
+	if len(values) == 0 {
+		return nil, 0, fmt.Errorf("invalid %s embedding response format", provider)
 	}
 
-	embedding := result["embedding"].(map[string]interface{})["values"].([]interface{})
-	embedVec := make([]float64, len(embedding))
-	for i, v := range embedding {
-		embedVec[i] = v.(float64)
+	embedVec := make([]float64, len(values))
+	for i, v := range values {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid embedding value type at index %d", i)
+		}
+		embedVec[i] = f
 	}
-	
-	return embedVec, nil
+	return embedVec, tokens, nil
 }
 
-func vectorSearch(ctx context.Context, db *sql.DB, embedding []float64, userId string) ([]string, error) {
+// SearchResult is one chunk returned by a VectorStore search.
+type SearchResult struct {
+	Content      string
+	DocumentName string
+	Distance     float64 // L2 distance from the query embedding; lower is closer
+	Flagged      bool    // kept despite looking like a prompt injection, here or at ingest
+}
+
+// pgVectorStore searches the aiknowledge table. The connection pool is
+// opened on first use with credentials from secrets.
+type pgVectorStore struct {
+	secrets SecretStore
+}
+
+func (s *pgVectorStore) Available(ctx context.Context) bool {
+	_, err := getDBPool(ctx, s.secrets)
+	return err == nil
+}
+
+func (s *pgVectorStore) Search(ctx context.Context, embedding []float64, scope SearchScope) (results []SearchResult, err error) {
+	ctx, span := startSpan(ctx, "pgvector.search",
+		attribute.Int("retrieval.top_k", RetrievalTopK),
+		attribute.Bool("retrieval.filtered", !scope.Filter.empty()))
+	defer func() {
+		span.SetAttributes(retrievalAttributes(results)...)
+		endSpan(span, err)
+	}()
+
+	db, err := getDBPool(ctx, s.secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	// The row-level security policies read the caller from the transaction
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := setRowSecurity(ctx, tx, scope.TenantId, scope.UserId, scope.Principals); err != nil {
+		return nil, err
+	}
+
 	// Use PostgreSQL array parameter directly - no manual string construction
-	query := `SELECT content, document_name FROM aiknowledge WHERE user_id = $2 ORDER BY embedding <-> $1 LIMIT 3`
-	rows, err := db.Query(query, embedding, userId)
+	// Chunks quarantined at ingest time are never retrieved; ones ingest only
+	// flagged come back marked
+	query, args := vectorSearchQuery(embedding, scope)
+	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var results []string
 	for rows.Next() {
 		var content, docName string
-		if err := rows.Scan(&content, &docName); err != nil {
+		var flagged bool
+		var distance float64
+		if err := rows.Scan(&content, &docName, &flagged, &distance); err != nil {
 			continue
 		}
-		
-		// Include document name in the result
-		if docName != "" {
-			results = append(results, fmt.Sprintf("[From: %s] %s", docName, content))
-		} else {
-			results = append(results, content)
-		}
+		results = append(results, SearchResult{Content: content, DocumentName: docName, Distance: distance, Flagged: flagged})
 	}
 	
 	return results, nil
 }
 
-func getAPIKey(ctx context.Context) (string, error) {
-	cfg, _ := config.LoadDefaultConfig(ctx)
-	client := ssm.NewFromConfig(cfg)
-
-	out, err := client.GetParameter(ctx, &ssm.GetParameterInput{
-		Name:           aws.String(SSMKeyPath),
-		WithDecryption: aws.Bool(true),
-	})
-	if err != nil {
-		return "", err
-	}
-	return *out.Parameter.Value, nil
+// setRowSecurity sets the verified caller the aiknowledge row-level security
+// policies check (db/migrations/006_row_level_security.sql). The settings
+// are local to tx, so a pooled connection never carries them to the next
+// request.
+func setRowSecurity(ctx context.Context, tx *sql.Tx, tenantId, userId string, principals []string) error {
+	_, err := tx.ExecContext(ctx, `SELECT set_config('yoursai.tenant_id', $1, true),
+		set_config('yoursai.user_id', $2, true),
+		set_config('yoursai.principals', $3::text[]::text, true)`,
+		tenantId, userId, pq.Array(principals))
+	return err
 }
 
-func isGeminiAPI() bool {
-	return strings.Contains(SSMKeyPath, "gemini")
+// vectorSearchQuery builds the similarity search. The tenant, collection
+// membership and the filter go in the WHERE clause, so the LIMIT counts
+// only chunks the caller may read; row-level security enforces the same
+// rules underneath.
+func vectorSearchQuery(embedding []float64, scope SearchScope) (string, []interface{}) {
+	where := []string{
+		"tenant_id = $2",
+		"collection_id IN (SELECT collection_id FROM collection_members WHERE principal = ANY($3))",
+		"NOT quarantined",
+	}
+	conds, args := scope.Filter.sqlConditions([]interface{}{embedding, scope.TenantId, pq.Array(scope.Principals)})
+	where = append(where, conds...)
+	args = append(args, RetrievalTopK)
+	query := fmt.Sprintf(`SELECT content, document_name, quarantine_reason <> '' AS flagged, embedding <-> $1 AS distance FROM aiknowledge WHERE %s ORDER BY distance LIMIT $%d`,
+		strings.Join(where, " AND "), len(args))
+	return query, args
 }
 
-func isOpenAIAPI() bool {
-	return strings.Contains(SSMKeyPath, "openai")
+func (d *Deps) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	defer recordStageLatency("request", time.Now())
+	ctx, span := startSpan(ctx, "chat.request",
+		attribute.String("http.method", request.HTTPMethod),
+		attribute.String("http.path", request.Path),
+		attribute.String("aws.apigateway.request_id", request.RequestContext.RequestID))
+	resp, err := d.handleChat(ctx, request)
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	endSpan(span, err)
+	flushTraces(ctx)
+	return resp, err
 }
 
-func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	log.Printf("Received API Gateway request")
+func (d *Deps) handleChat(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx = logging.WithFields(ctx, "requestId", request.RequestContext.RequestID)
+	slog.InfoContext(ctx, "Received API Gateway request", "method", request.HTTPMethod, "path", request.Path)
 	
 	// Extract user ID from Authorization header
 	authHeader := request.Headers["Authorization"]
@@ -322,9 +451,9 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		authHeader = request.Headers["authorization"] // case-insensitive fallback
 	}
 	
-	userId, err := extractUserFromToken(authHeader)
+	userId, err := shared.ExtractUserFromToken(authHeader)
 	if err != nil {
-		log.Printf("Authentication failed: %v", err)
+		slog.WarnContext(ctx, "Authentication failed", "error", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 401,
 			Headers: map[string]string{
@@ -334,10 +463,46 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			Body: `{"error": "Authentication required"}`,
 		}, nil
 	}
+
+	// Everything below runs as the caller's tenant: keys are scoped to it
+	// and its configuration applies
+	claims, _ := shared.ExtractTokenClaims(authHeader)
+	tenant, err := d.tenantForClaims(ctx, claims)
+	if err != nil {
+		slog.WarnContext(ctx, "Tenant rejected", "error", err)
+		return tenantErrorResponse(err), nil
+	}
+	ctx = withTenant(ctx, tenant)
+	userId = tenant.ScopedUserId(userId)
+	ctx = logging.WithFields(ctx, "tenant", tenant.Id, "userId", userId)
 	
+	// Enforce the per-user chat limit before spending any provider quota
+	decision, err := d.Limiter.Allow(ctx, "chat#"+userId)
+	if err != nil {
+		// Fail open so a DynamoDB hiccup does not take chat down with it
+		slog.ErrorContext(ctx, "Rate limiter error", "error", err)
+	} else if !decision.Allowed {
+		slog.WarnContext(ctx, "Rate limit exceeded", "retryAfter", decision.RetryAfter.String())
+		return events.APIGatewayProxyResponse{
+			StatusCode: 429,
+			Headers:    ratelimit.Headers(decision),
+			Body:       `{"error": "Too many requests. Please slow down."}`,
+		}, nil
+	}
+
+	// Usage summary endpoint
+	if request.HTTPMethod == "GET" && strings.HasSuffix(request.Path, "/usage") {
+		return d.handleUsage(ctx, userId, request.QueryStringParameters["sessionId"])
+	}
+
+	// Persona catalogue for the session picker
+	if request.HTTPMethod == "GET" && strings.HasSuffix(request.Path, "/personas") {
+		return handlePersonas()
+	}
+
 	var req Request
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
-		log.Printf("Error parsing request body: %v", err)
+		slog.WarnContext(ctx, "Error parsing request body", "error", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
 			Headers: map[string]string{
@@ -353,10 +518,48 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	if sessionId == "" {
 		sessionId = uuid.New().String()
 	}
+
+	if req.Persona != "" {
+		if _, ok := getPromptTemplate(req.Persona, 0); !ok {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+					"Content-Type": "application/json",
+				},
+				Body: `{"error": "Unknown persona"}`,
+			}, nil
+		}
+	}
+
+	strategy, ok := resolveRetrievalStrategy(req.RetrievalStrategy)
+	if !ok {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+				"Content-Type": "application/json",
+			},
+			Body: `{"error": "Unknown retrieval strategy"}`,
+		}, nil
+	}
+
+	if err := req.Filter.validate(); err != nil {
+		body, _ := json.Marshal(map[string]string{"error": "Invalid filter: " + err.Error()})
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+				"Content-Type": "application/json",
+			},
+			Body: string(body),
+		}, nil
+	}
+	// Retrieval sees every collection the caller can read, narrowed by the filter
+	scope := SearchScope{TenantId: tenant.Id, UserId: userId, Principals: callerPrincipals(userId, claims), Filter: req.Filter}
 	
-	// Structured logging for observability
-	fmt.Printf(`{"session":"%s","msg":"%s","time":"%s"}`+"\n",
-		sessionId, req.Message, time.Now().Format(time.RFC3339))
+	ctx = logging.WithFields(ctx, "sessionId", sessionId)
+	slog.InfoContext(ctx, "Chat request", logging.Content("message", req.Message), "persona", req.Persona, "retrievalStrategy", strategy)
 	
 	// Validate message length
 	if len(req.Message) > MaxMessageLength {
@@ -391,9 +594,17 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}
 	}
 	
-	apiKey, err := getAPIKey(ctx)
+	// Enforce daily and monthly token quotas
+	quota, err := d.getQuotaStatus(ctx, userId, d.Now())
 	if err != nil {
-		log.Printf("Error getting API key: %v", err)
+		slog.ErrorContext(ctx, "Quota check failed", "error", err)
+	} else if wait := quota.Exceeded(d.Now()); wait > 0 {
+		return quotaExceededResponse(wait), nil
+	}
+
+	apiKey, err := d.Secrets.Get(ctx, tenant.KeyPath())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting API key", "error", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Headers: map[string]string{
@@ -404,162 +615,151 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}, nil
 	}
 
-	// Get conversation history for context
-	history, _ := getChatHistory(ctx, userId, sessionId)
+	// Mask PII before any text leaves for a third-party API; the vault restores
+	// it in the reply shown to this user. One vault serves the whole request
+	// so placeholders agree across the message, history and retrieved context
+	pii := redact.NewVault(envOrDefault("PII_REDACTION", PIIRedaction) == "on")
+	maskedMessage := pii.Redact(req.Message)
 
-	conversation := ""
-	for _, h := range history {
-		conversation += h + "\n"
+	// Moderate the user's message before it reaches retrieval or the model
+	checkers := d.moderationCheckers(ctx, apiKey)
+	inputDecision := runModeration(ctx, checkers, ModerationInput{Stage: "input", Text: maskedMessage})
+	d.auditModeration(ctx, userId, sessionId, req.Message, inputDecision)
+	if inputDecision.Action == ModerationBlock {
+		return moderationBlockedResponse(sessionId), nil
+	}
+
+	// Get conversation history for context
+	history, _ := d.History.Load(ctx, userId, sessionId)
+	for i := range history {
+		history[i].UserMessage = pii.Redact(history[i].UserMessage)
+		history[i].AIReply = pii.Redact(history[i].AIReply)
 	}
 
 	// Perform vector search for relevant knowledge (only for substantial queries)
-	db, err := getDBPool(ctx)
-	var vectorContext string
+	searchable := d.Vectors != nil && d.Vectors.Available(ctx)
+	var vectorContext, retrievalQuery string
 	useRag := len(req.Message) > 30
+	recordRAGDecision(!searchable || !useRag)
 	
-	if err == nil && useRag {
-		// Add delay before API call
-		time.Sleep(time.Duration(APICallDelay) * time.Millisecond)
-
-		// Build contextual query using recent conversation history
-		contextualQuery := req.Message
-		if len(history) > 0 {
-			// Get last ContextExchanges exchanges for context
-			startIdx := 0
-			if len(history) > ContextExchanges {
-				startIdx = len(history) - ContextExchanges
-			}
-			recentContext := ""
-			for i := startIdx; i < len(history); i++ {
-				recentContext += history[i] + "\n"
-			}
-			contextualQuery = recentContext + "Current question: " + req.Message
-		}
-
-		// Generate embedding for contextual query
-		embedding, err := generateEmbedding(ctx, contextualQuery, apiKey)
-		if err == nil {
-			// Search for similar content
-			searchResults, err := vectorSearch(ctx, db, embedding, userId)
-			if err == nil && len(searchResults) > 0 {
-				vectorContext = "\n\nRelevant Knowledge:\n"
-				for _, result := range searchResults {
-					vectorContext += "- " + result + "\n"
-				}
+	if searchable && useRag {
+		// Rewrite the follow-up into a standalone search query
+		retrievalQuery = d.buildRetrievalQuery(ctx, apiKey, userId, sessionId, history, maskedMessage)
+
+		// Search for similar content using the selected strategy
+		searchResults, err := d.retrieve(ctx, apiKey, userId, sessionId, strategy, retrievalQuery, scope)
+		if err == nil && len(searchResults) > 0 {
+			for i := range searchResults {
+				searchResults[i].Content = pii.Redact(searchResults[i].Content)
 			}
+			// Retrieved text is untrusted: screen it, then fence it off from the instructions
+			searchResults = d.screenRetrievedChunks(ctx, apiKey, userId, sessionId, searchResults)
+			vectorContext = fenceDocuments(searchResults)
 		}
 	}
 
-	// Add delay before main API call
-	time.Sleep(time.Duration(APICallDelay) * time.Millisecond)
-
-	// Build final prompt in correct order: System → Conversation → Documents → User
-	finalPrompt := SystemPrompt
-	if conversation != "" {
-		finalPrompt += "\n\nConversation so far:\n" + conversation
-	}
-	if vectorContext != "" {
-		finalPrompt += vectorContext
-	}
-	finalPrompt += "\nUser: " + req.Message
-
-	var payload map[string]interface{}
-	if isGeminiAPI() {
-		payload = map[string]interface{}{
-			"contents": []map[string]interface{}{
-				{
-					"parts": []map[string]string{
-						{"text": finalPrompt},
-					},
-				},
-			},
-			"generationConfig": map[string]interface{}{
-				"maxOutputTokens": MaxOutputTokens,
-				"temperature":     Temperature,
-			},
-		}
-	} else if isOpenAIAPI() {
-		payload = map[string]interface{}{
-			"model": OpenAIModel,
-			"messages": []map[string]string{
-				{"role": "user", "content": finalPrompt},
-			},
-			"max_tokens":  MaxOutputTokens,
-			"temperature": Temperature,
-		}
+	// System instruction carries the rules and retrieved documents; history
+	// and the new message go out as separate user/assistant turns
+	persona, err := d.resolveSessionPersona(ctx, userId, sessionId, req.Persona)
+	if err != nil {
+		slog.WarnContext(ctx, "Falling back to default persona", "error", err)
+		persona, _ = getPromptTemplate(DefaultPersona, 0)
 	}
-
-	body, _ := json.Marshal(payload)
-	log.Printf("Sending request to AI API")
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	
-	// Use retry logic for rate limiting
-	resp, err := retryWithBackoff(func() (*http.Response, error) {
-		var httpReq *http.Request
-		if isGeminiAPI() {
-			httpReq, _ = http.NewRequestWithContext(ctx, "POST", GeminiAPIURL+"?key="+apiKey, bytes.NewBuffer(body))
-		} else if isOpenAIAPI() {
-			httpReq, _ = http.NewRequestWithContext(ctx, "POST", OpenAIAPIURL, bytes.NewBuffer(body))
-			httpReq.Header.Set("Authorization", "Bearer "+apiKey)
-		}
-		httpReq.Header.Set("Content-Type", "application/json")
-		return client.Do(httpReq)
-	}, 3)
-	
+	systemInstruction, err := renderPrompt(persona, promptDataFor(authHeader, vectorContext, d.Now()))
 	if err != nil {
-		log.Printf("Error calling Gemini API: %v", "Request failed - timeout or network error")
+		slog.ErrorContext(ctx, "Error rendering prompt", "persona", persona.Name, "error", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Headers: map[string]string{
 				"Access-Control-Allow-Origin": "*",
 				"Content-Type": "application/json",
 			},
-			Body: `{"error": "Failed to call AI service"}`,
+			Body: `{"error": "Failed to build prompt"}`,
 		}, nil
 	}
-	defer resp.Body.Close()
+	// The profile variables can carry the user's own email, so mask the whole instruction
+	systemInstruction = pii.Redact(systemInstruction)
+	messages := buildMessages(history, maskedMessage)
 
-	log.Printf("Got response from AI API with status code: %d", resp.StatusCode)
+	// Tools the model may call; search is bound to this caller's collections
+	tools := d.buildDefaultTools(ctx, apiKey, userId, sessionId, scope, searchable, pii)
 
-	// Fail-safe for AI API downtime
-	if resp.StatusCode != 200 {
-		log.Printf("AI API returned non-200 status: %d", resp.StatusCode)
-		response := Response{
-			Reply:     "AI service is temporarily unavailable. Try again.",
-			SessionId: sessionId,
+	// Gemini or OpenAI, whichever is healthy; failover keeps the reply coming
+	router := d.newChatRouter(ctx, apiKey)
+
+	var result ChatResult
+	var providerFindings []ModerationFinding // Gemini's safety ratings on the final response
+	for iteration := 0; ; iteration++ {
+		// Once the iteration budget is spent, ask without tools to force a text answer
+		offered := tools
+		if iteration >= MaxToolIterations {
+			offered = nil
 		}
-		responseBody, _ := json.Marshal(response)
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Headers: map[string]string{
-				"Access-Control-Allow-Origin": "*",
-				"Content-Type": "application/json",
-			},
-			Body: string(responseBody),
-		}, nil
-	}
 
-	var geminiResp map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&geminiResp); err != nil {
-		log.Printf("Error decoding response: %v", err)
-		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
-			Headers: map[string]string{
-				"Access-Control-Allow-Origin": "*",
-				"Content-Type": "application/json",
-			},
-			Body: `{"error": "Failed to decode AI response"}`,
-		}, nil
+		slog.DebugContext(ctx, "Sending request to AI API", "iteration", iteration)
+		result, err = router.Generate(ctx, systemInstruction, messages, offered)
+
+		// Fail-safe for AI API downtime
+		if err != nil {
+			slog.ErrorContext(ctx, "AI API unavailable", "error", err)
+			response := Response{
+				Reply:     "AI service is temporarily unavailable. Try again.",
+				SessionId: sessionId,
+			}
+			responseBody, _ := json.Marshal(response)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 200,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+					"Content-Type": "application/json",
+				},
+				Body: string(responseBody),
+			}, nil
+		}
+
+		slog.InfoContext(ctx, "Got response from AI API", "provider", result.Provider.Name, "model", result.Provider.Model)
+		d.recordUsage(ctx, userId, sessionId, result.Provider.Model, "chat", parseTokenUsage(result.Resp))
+
+		// A Gemini safety block leaves no text to parse, so catch it before
+		// parsing; lesser findings join the output stage below
+		providerFindings = nil
+		if result.Provider.Name == "gemini" {
+			providerDecision := runModeration(ctx, []ModerationChecker{&geminiSafetyChecker{}}, ModerationInput{Stage: "output", ProviderResponse: result.Resp})
+			if providerDecision.Action == ModerationBlock {
+				d.auditModeration(ctx, userId, sessionId, "", providerDecision)
+				return moderationBlockedResponse(sessionId), nil
+			}
+			providerFindings = providerDecision.Findings
+		}
+
+		calls := parseToolCalls(result.Resp)
+		if len(calls) == 0 {
+			break
+		}
+		if iteration >= MaxToolIterations {
+			// Tools were withdrawn and the model still asked for one; go with
+			// whatever text came back rather than looping on
+			slog.WarnContext(ctx, "Model kept calling tools past the iteration limit", "iteration", iteration, "calls", len(calls))
+			break
+		}
+
+		// Run the requested tools and hand their results back for the next turn
+		messages = append(messages, ChatMessage{Role: "assistant", ToolCalls: calls})
+		for _, call := range calls {
+			slog.InfoContext(ctx, "Running tool", "tool", call.Name, "iteration", iteration+1)
+			toolResult := pii.Redact(tools.Call(ctx, call))
+			messages = append(messages, ChatMessage{Role: "tool", Content: toolResult, ToolCallId: call.Id, ToolName: call.Name})
+		}
 	}
+	geminiResp := result.Resp
 
-	// Parse response based on API type
+	// Parse response based on the provider that answered
 	var reply string
-	if isGeminiAPI() {
+	if result.Provider.Name == "gemini" {
 		// Check if response has expected structure
 		candidates, ok := geminiResp["candidates"].([]interface{})
 	if !ok || len(candidates) == 0 {
-		log.Printf("No candidates in response")
+		slog.WarnContext(ctx, "No candidates in response")
 		return events.APIGatewayProxyResponse{
 			StatusCode: 200,
 			Headers: map[string]string{
@@ -608,7 +808,7 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			}, nil
 		}
 		reply = replyText
-	} else if isOpenAIAPI() {
+	} else {
 		// Parse OpenAI response
 		choices, ok := geminiResp["choices"].([]interface{})
 		if !ok || len(choices) == 0 {
@@ -622,72 +822,74 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			}, nil
 		}
 
-		choice := choices[0].(map[string]interface{})
-		message := choice["message"].(map[string]interface{})
-		reply = message["content"].(string)
-	}
-
-	// Check if response was truncated due to token limit (only for Gemini)
-	if isGeminiAPI() {
-		candidates, _ := geminiResp["candidates"].([]interface{})
-		if len(candidates) > 0 {
-			candidate := candidates[0].(map[string]interface{})
-			finishReason, hasFinishReason := candidate["finishReason"].(string)
-			if hasFinishReason && finishReason == "MAX_TOKENS" {
-		// Auto-continue the response
-		continuePrompt := SystemPrompt
-		if conversation != "" {
-			continuePrompt += "\n\nConversation so far:\n" + conversation
-		}
-		continuePrompt += "\nUser: " + req.Message + "\nAI: " + reply + "\nUser: Continue exactly from the last word. Do not repeat. Complete the previous response."
-		
-		continuePayload := map[string]interface{}{
-			"contents": []map[string]interface{}{
-				{
-					"parts": []map[string]string{
-						{"text": continuePrompt},
-					},
+		replyText, err := llm.OpenAIReply(geminiResp)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+					"Content-Type": "application/json",
 				},
-			},
-			"generationConfig": map[string]interface{}{
-				"maxOutputTokens": MaxOutputTokens,
-				"temperature":     Temperature,
-			},
+				Body: `{"error": "Invalid AI response format"}`,
+			}, nil
 		}
+		reply = replyText
+	}
 
-		continueBody, _ := json.Marshal(continuePayload)
-		continueReq, _ := http.NewRequestWithContext(ctx, "POST", GeminiAPIURL+"?key="+apiKey, bytes.NewBuffer(continueBody))
-		continueReq.Header.Set("Content-Type", "application/json")
-
-		continueResp, err := client.Do(continueReq)
-		if err == nil && continueResp.StatusCode == 200 {
-			defer continueResp.Body.Close()
-			var continueGeminiResp map[string]interface{}
-			if json.NewDecoder(continueResp.Body).Decode(&continueGeminiResp) == nil {
-				if continueCandidates, ok := continueGeminiResp["candidates"].([]interface{}); ok && len(continueCandidates) > 0 {
-					continueCandidate := continueCandidates[0].(map[string]interface{})
-					continueContent := continueCandidate["content"].(map[string]interface{})
-					continueParts := continueContent["parts"].([]interface{})
-					continueText := continueParts[0].(map[string]interface{})["text"].(string)
+	// Check if response was truncated due to token limit (only for Gemini)
+	if result.Provider.Name == "gemini" {
+		if _, finishReason, _ := llm.GeminiReply(geminiResp); finishReason == "MAX_TOKENS" {
+			// Auto-continue the response
+			continueCtx, continueSpan := startSpan(ctx, "llm.auto_continue")
+			continueMessages := append(messages,
+				ChatMessage{Role: "assistant", Content: reply},
+				ChatMessage{Role: "user", Content: "Continue exactly from the last word. Do not repeat. Complete the previous response."},
+			)
+			continued, err := router.Generate(continueCtx, systemInstruction, continueMessages, nil)
+			if err == nil {
+				d.recordUsage(ctx, userId, sessionId, continued.Provider.Model, "chat", parseTokenUsage(continued.Resp))
+				var continueText string
+				if continued.Provider.Name == "gemini" {
+					continueText, _, err = llm.GeminiReply(continued.Resp)
+				} else {
+					continueText, err = llm.OpenAIReply(continued.Resp)
+				}
+				if err == nil {
 					reply += continueText
 				}
 			}
+			endSpan(continueSpan, err)
 		}
-			}
-		}
 	}
 
+	// Moderate the model's reply before it is stored or shown
+	outputDecision := runModeration(ctx, checkers, ModerationInput{Stage: "output", Text: reply})
+	outputDecision.add(moderationPolicy(), providerFindings...)
+	d.auditModeration(ctx, userId, sessionId, reply, outputDecision)
+	if outputDecision.Action == ModerationBlock {
+		reply = ModerationBlockedReply
+	}
+	reply = pii.Restore(reply)
+
 	// Save chat to DynamoDB
-	err = saveChat(ctx, userId, sessionId, req.Message, reply)
+	err = d.History.Save(ctx, userId, sessionId, ChatRecord{
+		UserMessage:    req.Message,
+		AIReply:        reply,
+		RetrievalQuery: retrievalQuery,
+		Time:           d.Now(),
+	})
 	if err != nil {
-		log.Printf("DynamoDB error: %v", err)
+		slog.ErrorContext(ctx, "Failed to save chat", "error", err)
 	}
 
-	log.Printf("Successfully processed request, returning response")
+	slog.InfoContext(ctx, "Successfully processed request", logging.Content("reply", reply))
 	
 	response := Response{
 		Reply:     reply,
 		SessionId: sessionId,
+		Provider:  result.Provider.Name,
+		Model:     result.Provider.Model,
+		Warnings:  append(moderationWarnings(inputDecision), moderationWarnings(outputDecision)...),
 	}
 	responseBody, _ := json.Marshal(response)
 	
@@ -702,6 +904,17 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 }
 
 func main() {
-	lambda.Start(handler)
+	// The Lambda runtime starts the binary without arguments
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+		if err := runEval(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "eval:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	initLogging()
+	initTracing(context.Background())
+	lambda.Start(newAWSDeps(context.Background()).handler)
 }
 
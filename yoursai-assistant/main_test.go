@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/llm"
+)
+
+func TestHandlerRejectsUnauthenticatedRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"missing header", ""},
+		{"not a bearer token", "Basic dXNlcjpwYXNz"},
+		{"malformed JWT", "Bearer not-a-jwt"},
+		{"undecodable payload", "Bearer e30.!!!.sig"},
+		{"no sub claim", bearerToken(map[string]interface{}{"email": "a@example.com"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			resp, err := env.deps.handler(context.Background(), events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Path:       "/chat",
+				Headers:    map[string]string{"Authorization": tt.header},
+				Body:       `{"message": "hello"}`,
+			})
+			if err != nil {
+				t.Fatalf("handler returned error: %v", err)
+			}
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", resp.StatusCode)
+			}
+			if got := len(env.api.requestsTo("/gemini")); got != 0 {
+				t.Errorf("provider called %d times for an unauthenticated request", got)
+			}
+		})
+	}
+}
+
+func TestHandlerAnswersGreetingsWithoutCallingTheModel(t *testing.T) {
+	for _, message := range []string{"hi", "Hello!", "  hey  ", "Good Morning"} {
+		t.Run(message, func(t *testing.T) {
+			env := newTestEnv(t)
+			resp, body := env.chat(t, "user-greeting", Request{SessionId: "s1", Message: message})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if body.Reply != "Hello, How can I help you today?" {
+				t.Errorf("reply = %q", body.Reply)
+			}
+			if body.SessionId != "s1" {
+				t.Errorf("sessionId = %q, want s1", body.SessionId)
+			}
+			if got := len(env.api.requestsTo("/gemini")); got != 0 {
+				t.Errorf("provider called %d times for a greeting", got)
+			}
+		})
+	}
+}
+
+func TestHandlerRetrieval(t *testing.T) {
+	const longQuestion = "What does the onboarding guide say about laptop setup?"
+	tests := []struct {
+		name         string
+		message      string
+		unavailable  bool
+		wantSearches int
+		wantContext  bool
+	}{
+		{"long question uses RAG", longQuestion, false, 1, true},
+		{"short message skips RAG", "Thanks a lot", false, 0, false},
+		{"vector store unavailable skips RAG", longQuestion, true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.vectors.unavailable = tt.unavailable
+			env.vectors.results = []SearchResult{{Content: "Laptops are set up by IT on day one.", DocumentName: "onboarding.md", Distance: 0.2}}
+			env.api.script("/embed", embeddingReply(0.1, 0.2, 0.3))
+			env.api.script("/gemini", geminiReply("IT sets up your laptop.", "STOP"))
+
+			resp, body := env.chat(t, "user-rag-"+tt.name, Request{SessionId: "s1", Message: tt.message})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, body %s", resp.StatusCode, resp.Body)
+			}
+			if body.Reply != "IT sets up your laptop." {
+				t.Errorf("reply = %q", body.Reply)
+			}
+			if got := env.vectors.searchCount(); got != tt.wantSearches {
+				t.Errorf("searches = %d, want %d", got, tt.wantSearches)
+			}
+			if got := len(env.api.requestsTo("/embed")); got != tt.wantSearches {
+				t.Errorf("embedding calls = %d, want %d", got, tt.wantSearches)
+			}
+
+			requests := env.api.requestsTo("/gemini")
+			if len(requests) != 1 {
+				t.Fatalf("generate calls = %d, want 1", len(requests))
+			}
+			instruction := systemInstructionOf(requests[0])
+			if got := strings.Contains(instruction, "Laptops are set up by IT"); got != tt.wantContext {
+				t.Errorf("retrieved chunk in system instruction = %v, want %v", got, tt.wantContext)
+			}
+			if tt.wantContext && !strings.Contains(instruction, `<document source="onboarding.md">`) {
+				t.Errorf("retrieved chunk is not fenced:\n%s", instruction)
+			}
+
+			saved := env.history.saved("user-rag-"+tt.name, "s1")
+			if len(saved) != 1 {
+				t.Fatalf("saved %d exchanges, want 1", len(saved))
+			}
+			if tt.wantContext && saved[0].RetrievalQuery == "" {
+				t.Error("retrieval query was not saved with the exchange")
+			}
+			if !saved[0].Time.Equal(testNow) {
+				t.Errorf("saved time = %v, want the injected clock", saved[0].Time)
+			}
+		})
+	}
+}
+
+func TestHandlerScopesVectorSearchToCallerAndFilter(t *testing.T) {
+	env := newTestEnv(t)
+	env.vectors.results = []SearchResult{{Content: "Annual leave is 25 days.", DocumentName: "leave-2025.md", Distance: 0.1}}
+	env.api.script("/embed", embeddingReply(0.1, 0.2, 0.3))
+	env.api.script("/gemini", geminiReply("You get 25 days.", "STOP"))
+
+	filter := &MetadataFilter{Tags: []string{"policy"}, DateFrom: "2025-01-01", DateTo: "2025-12-31"}
+	claims := map[string]interface{}{"sub": "user-filter", "cognito:groups": []string{"hr", "engineering"}}
+	resp, _ := env.chatWithClaims(t, claims, Request{SessionId: "s1", Message: "How many days of annual leave do I get this year?", Filter: filter})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, resp.Body)
+	}
+	if len(env.vectors.scopes) != 1 {
+		t.Fatalf("searches = %d, want 1", len(env.vectors.scopes))
+	}
+	want := SearchScope{TenantId: DefaultTenant, UserId: "user-filter", Principals: []string{"user:user-filter", "team:hr", "team:engineering"}, Filter: filter}
+	if got := env.vectors.scopes[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("search scope = %+v, want %+v", got, want)
+	}
+}
+
+func TestVectorSearchQuery(t *testing.T) {
+	embedding := []float64{0.1, 0.2}
+	const readable = "WHERE tenant_id = $2 AND collection_id IN (SELECT collection_id FROM collection_members WHERE principal = ANY($3)) AND NOT quarantined"
+	tests := []struct {
+		name      string
+		filter    *MetadataFilter
+		wantWhere string
+		wantArgs  int
+	}{
+		{"no filter", nil,
+			readable + " ORDER BY distance LIMIT $4", 4},
+		{"empty filter", &MetadataFilter{},
+			readable + " ORDER BY distance LIMIT $4", 4},
+		{"tags and date range", &MetadataFilter{Tags: []string{"policy", "2025"}, DateFrom: "2025-01-01", DateTo: "2025-12-31"},
+			readable + " AND tags @> $4::jsonb AND document_date >= $5::date AND document_date <= $6::date ORDER BY distance LIMIT $7", 7},
+		{"document IDs and metadata", &MetadataFilter{DocumentIds: []string{"doc-1"}, Metadata: map[string]interface{}{"department": "hr"}},
+			readable + " AND document_id = ANY($4) AND metadata @> $5::jsonb ORDER BY distance LIMIT $6", 6},
+		{"collections", &MetadataFilter{CollectionIds: []string{"team-handbook"}},
+			readable + " AND collection_id = ANY($4) ORDER BY distance LIMIT $5", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := vectorSearchQuery(embedding, SearchScope{Principals: []string{"user:user-1"}, Filter: tt.filter})
+			if !strings.HasSuffix(query, tt.wantWhere) {
+				t.Errorf("query = %s\nwant suffix %s", query, tt.wantWhere)
+			}
+			if len(args) != tt.wantArgs {
+				t.Fatalf("args = %d, want %d", len(args), tt.wantArgs)
+			}
+			if args[len(args)-1] != RetrievalTopK {
+				t.Errorf("last arg = %v, want the top-k limit", args[len(args)-1])
+			}
+		})
+	}
+
+	_, args := vectorSearchQuery(embedding, SearchScope{Filter: &MetadataFilter{Tags: []string{"policy"}, Metadata: map[string]interface{}{"year": 2025}}})
+	if args[3] != `["policy"]` || args[4] != `{"year":2025}` {
+		t.Errorf("JSONB args = %v, %v", args[3], args[4])
+	}
+}
+
+func TestHandlerContinuesGeminiReplyCutOffAtMaxTokens(t *testing.T) {
+	env := newTestEnv(t)
+	env.api.script("/gemini",
+		geminiReply("The first half of the answer", "MAX_TOKENS"),
+		geminiReply(" and the second half.", "STOP"),
+	)
+
+	resp, body := env.chat(t, "user-continue", Request{SessionId: "s1", Message: "Explain it"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, resp.Body)
+	}
+	if want := "The first half of the answer and the second half."; body.Reply != want {
+		t.Errorf("reply = %q, want %q", body.Reply, want)
+	}
+
+	requests := env.api.requestsTo("/gemini")
+	if len(requests) != 2 {
+		t.Fatalf("generate calls = %d, want 2", len(requests))
+	}
+	contents, _ := json.Marshal(requests[1]["contents"])
+	if !strings.Contains(string(contents), "The first half of the answer") || !strings.Contains(string(contents), "Continue exactly from the last word") {
+		t.Errorf("continuation request does not carry the partial reply and instruction: %s", contents)
+	}
+}
+
+func TestHandlerStopsCallingToolsAfterTheIterationLimit(t *testing.T) {
+	env := newTestEnv(t)
+	env.api.script("/gemini", fakeResponse{status: http.StatusOK, body: map[string]interface{}{
+		"candidates": []interface{}{map[string]interface{}{
+			"content": map[string]interface{}{"role": "model", "parts": []interface{}{
+				map[string]interface{}{"text": "Checking the time."},
+				map[string]interface{}{"functionCall": map[string]interface{}{"name": "current_datetime", "args": map[string]interface{}{}}},
+			}},
+			"finishReason": "STOP",
+		}},
+	}})
+
+	resp, _ := env.chat(t, "user-tools", Request{SessionId: "s1", Message: "What time is it?"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, resp.Body)
+	}
+	if got := len(env.api.requestsTo("/gemini")); got != MaxToolIterations+1 {
+		t.Errorf("generate calls = %d, want %d", got, MaxToolIterations+1)
+	}
+}
+
+func TestHandlerParsesOpenAIReplyAfterFailover(t *testing.T) {
+	tests := []struct {
+		name       string
+		openAI     fakeResponse
+		wantStatus int
+		wantReply  string
+	}{
+		{"text reply", openAIReply("Served by OpenAI."), http.StatusOK, "Served by OpenAI."},
+		{"no choices", fakeResponse{status: http.StatusOK, body: map[string]interface{}{"choices": []interface{}{}}}, http.StatusOK, "No response from AI"},
+		{"choice without message", fakeResponse{status: http.StatusOK, body: map[string]interface{}{"choices": []interface{}{map[string]interface{}{"finish_reason": "stop"}}}}, http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.api.script("/gemini", fakeResponse{status: http.StatusServiceUnavailable, body: map[string]interface{}{"error": "overloaded"}})
+			env.api.script("/openai", tt.openAI)
+
+			resp, body := env.chat(t, "user-openai-"+tt.name, Request{SessionId: "s1", Message: "Which provider is this?"})
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if body.Reply != tt.wantReply {
+				t.Errorf("reply = %q, want %q", body.Reply, tt.wantReply)
+			}
+			if tt.wantReply == "Served by OpenAI." && (body.Provider != "openai" || body.Model != OpenAIModel) {
+				t.Errorf("provider = %q/%q, want openai/%s", body.Provider, body.Model, OpenAIModel)
+			}
+
+			requests := env.api.requestsTo("/openai")
+			if len(requests) != 1 {
+				t.Fatalf("OpenAI calls = %d, want 1", len(requests))
+			}
+			if requests[0]["model"] != OpenAIModel {
+				t.Errorf("OpenAI request model = %v", requests[0]["model"])
+			}
+		})
+	}
+}
+
+func TestParseOpenAIReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"content", `{"choices":[{"message":{"role":"assistant","content":"Hi there"}}]}`, "Hi there", false},
+		{"null content on a tool call turn", `{"choices":[{"message":{"role":"assistant","content":null,"tool_calls":[]}}]}`, "", false},
+		{"no choices", `{"choices":[]}`, "", true},
+		{"missing choices", `{"error":{"message":"bad"}}`, "", true},
+		{"choice is not an object", `{"choices":["oops"]}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.body), &result); err != nil {
+				t.Fatal(err)
+			}
+			got, err := llm.OpenAIReply(result)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerRejectsBadRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"invalid JSON", `{"message":`, http.StatusBadRequest, "Invalid request body"},
+		{"unknown persona", `{"message":"Hello there, assistant","persona":"pirate"}`, http.StatusBadRequest, "Unknown persona"},
+		{"unknown retrieval strategy", `{"message":"Hello there, assistant","retrievalStrategy":"psychic"}`, http.StatusBadRequest, "Unknown retrieval strategy"},
+		{"message too long", `{"message":"` + strings.Repeat("a", MaxMessageLength+1) + `"}`, http.StatusBadRequest, "Message too long"},
+		{"filter date not ISO", `{"message":"Hello there, assistant","filter":{"dateFrom":"01/02/2025"}}`, http.StatusBadRequest, "Invalid filter: dateFrom"},
+		{"filter date range reversed", `{"message":"Hello there, assistant","filter":{"dateFrom":"2025-06-01","dateTo":"2025-01-01"}}`, http.StatusBadRequest, "Invalid filter: dateTo is before dateFrom"},
+		{"filter empty tag", `{"message":"Hello there, assistant","filter":{"tags":["policy",""]}}`, http.StatusBadRequest, "Invalid filter: tags"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			resp, err := env.deps.handler(context.Background(), events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Path:       "/chat",
+				Headers:    map[string]string{"Authorization": bearerToken(map[string]interface{}{"sub": "user-bad-request"})},
+				Body:       tt.body,
+			})
+			if err != nil {
+				t.Fatalf("handler returned error: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus || !strings.Contains(resp.Body, tt.wantBody) {
+				t.Errorf("got %d %s, want %d containing %q", resp.StatusCode, resp.Body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandlerRecordsUsageOnTheInjectedClock(t *testing.T) {
+	env := newTestEnv(t)
+	env.api.script("/gemini", geminiReply("Twenty five days.", "STOP"))
+	if resp, _ := env.chat(t, "user-usage", Request{SessionId: "s1", Message: "How much annual leave do I get?"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat status = %d, body %s", resp.StatusCode, resp.Body)
+	}
+	for _, event := range env.usage.events {
+		if !event.Time.Equal(testNow) {
+			t.Errorf("%s usage recorded at %s, want the injected %s", event.Kind, event.Time, testNow)
+		}
+	}
+
+	resp, err := env.deps.handler(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod:            "GET",
+		Path:                  "/usage",
+		Headers:               map[string]string{"Authorization": bearerToken(map[string]interface{}{"sub": "user-usage"})},
+		QueryStringParameters: map[string]string{"sessionId": "s1"},
+	})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("usage: %d %s, %v", resp.StatusCode, resp.Body, err)
+	}
+	var usage UsageResponse
+	json.Unmarshal([]byte(resp.Body), &usage)
+	// Totals are read for the injected day, so they include the chat above
+	if usage.Daily.CompletionTokens != 5 || usage.Monthly.CompletionTokens != 5 || usage.Session == nil || usage.Session.CompletionTokens != 5 {
+		t.Errorf("usage = %s, want the chat's 5 completion tokens in every total", resp.Body)
+	}
+}
+
+func TestHandlerRateLimitsEachUser(t *testing.T) {
+	env := newTestEnv(t)
+	get := func(userId string) events.APIGatewayProxyResponse {
+		resp, _ := env.deps.handler(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod: "GET",
+			Path:       "/personas",
+			Headers:    map[string]string{"Authorization": bearerToken(map[string]interface{}{"sub": userId})},
+		})
+		return resp
+	}
+
+	// The clock never moves, so the bucket holds its burst and no more
+	burst := RateLimitPerMin * RateLimitWindow / 60
+	for i := 0; i < burst; i++ {
+		if resp := get("user-busy"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d", i+1, resp.StatusCode)
+		}
+	}
+	if resp := get("user-busy"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request past the burst: status = %d, want 429", resp.StatusCode)
+	}
+	if resp := get("user-quiet"); resp.StatusCode != http.StatusOK {
+		t.Errorf("another user: status = %d, want 200", resp.StatusCode)
+	}
+}
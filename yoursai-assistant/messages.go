@@ -0,0 +1,122 @@
+package main
+
+import "strings"
+
+// ChatExchange is one stored user message and the reply it received.
+type ChatExchange struct {
+	UserMessage string
+	AIReply     string
+}
+
+// String renders the exchange the way it is fed to the retrieval query.
+func (e ChatExchange) String() string {
+	return "User: " + e.UserMessage + "\nAI: " + e.AIReply
+}
+
+// ChatMessage is a provider-neutral conversation turn. Role is "user",
+// "assistant" or "tool"; the system prompt travels separately. An assistant
+// turn may carry ToolCalls, and a tool turn answers one of them.
+type ChatMessage struct {
+	Role       string
+	Content    string
+	ToolCalls  []ToolCall
+	ToolCallId string
+	ToolName   string
+}
+
+// buildMessages turns stored history plus the new message into alternating
+// user/assistant turns, ending with the user's message.
+func buildMessages(history []ChatExchange, userMessage string) []ChatMessage {
+	messages := make([]ChatMessage, 0, len(history)*2+1)
+	for _, h := range history {
+		// Both providers reject empty turns, and Gemini requires strict alternation
+		if strings.TrimSpace(h.UserMessage) == "" || strings.TrimSpace(h.AIReply) == "" {
+			continue
+		}
+		messages = append(messages,
+			ChatMessage{Role: "user", Content: h.UserMessage},
+			ChatMessage{Role: "assistant", Content: h.AIReply},
+		)
+	}
+	return append(messages, ChatMessage{Role: "user", Content: userMessage})
+}
+
+func buildGeminiPayload(systemInstruction string, messages []ChatMessage) map[string]interface{} {
+	contents := make([]map[string]interface{}, 0, len(messages))
+	for _, m := range messages {
+		switch {
+		case m.Role == "assistant" && len(m.ToolCalls) > 0:
+			// Echo the model's functionCall parts back unchanged
+			parts := make([]map[string]interface{}, 0, len(m.ToolCalls))
+			for _, call := range m.ToolCalls {
+				parts = append(parts, call.geminiPart())
+			}
+			contents = append(contents, map[string]interface{}{"role": "model", "parts": parts})
+		case m.Role == "tool":
+			part := map[string]interface{}{
+				"functionResponse": map[string]interface{}{
+					"name":     m.ToolName,
+					"response": map[string]interface{}{"result": m.Content},
+				},
+			}
+			// All responses to one model turn belong in a single user turn
+			if last := len(contents) - 1; last >= 0 && contents[last]["role"] == "user" {
+				if parts, ok := contents[last]["parts"].([]map[string]interface{}); ok {
+					contents[last]["parts"] = append(parts, part)
+					continue
+				}
+			}
+			contents = append(contents, map[string]interface{}{"role": "user", "parts": []map[string]interface{}{part}})
+		default:
+			role := "user"
+			if m.Role == "assistant" {
+				role = "model"
+			}
+			contents = append(contents, map[string]interface{}{
+				"role": role,
+				"parts": []map[string]string{
+					{"text": m.Content},
+				},
+			})
+		}
+	}
+
+	return map[string]interface{}{
+		"systemInstruction": map[string]interface{}{
+			"parts": []map[string]string{
+				{"text": systemInstruction},
+			},
+		},
+		"contents": contents,
+		"generationConfig": map[string]interface{}{
+			"maxOutputTokens": MaxOutputTokens,
+			"temperature":     Temperature,
+		},
+	}
+}
+
+func buildOpenAIPayload(systemInstruction string, messages []ChatMessage) map[string]interface{} {
+	openAIMessages := make([]map[string]interface{}, 0, len(messages)+1)
+	openAIMessages = append(openAIMessages, map[string]interface{}{"role": "system", "content": systemInstruction})
+	for _, m := range messages {
+		switch {
+		case m.Role == "assistant" && len(m.ToolCalls) > 0:
+			toolCalls := make([]map[string]interface{}, 0, len(m.ToolCalls))
+			for _, call := range m.ToolCalls {
+				toolCalls = append(toolCalls, call.openAIToolCall())
+			}
+			openAIMessages = append(openAIMessages, map[string]interface{}{"role": "assistant", "content": nil, "tool_calls": toolCalls})
+		case m.Role == "tool":
+			openAIMessages = append(openAIMessages, map[string]interface{}{"role": "tool", "tool_call_id": m.ToolCallId, "content": m.Content})
+		default:
+			openAIMessages = append(openAIMessages, map[string]interface{}{"role": m.Role, "content": m.Content})
+		}
+	}
+
+	return map[string]interface{}{
+		"model":       OpenAIModel,
+		"messages":    openAIMessages,
+		"max_tokens":  MaxOutputTokens,
+		"temperature": Temperature,
+	}
+}
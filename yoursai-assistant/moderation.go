@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"shared/throttle"
+)
+
+// ModerationAction is what the pipeline does with a flagged message, from
+// least to most severe.
+type ModerationAction string
+
+const (
+	ModerationAllow ModerationAction = "allow"
+	ModerationLog   ModerationAction = "log"
+	ModerationWarn  ModerationAction = "warn"
+	ModerationBlock ModerationAction = "block"
+)
+
+func (a ModerationAction) severity() int {
+	switch a {
+	case ModerationLog:
+		return 1
+	case ModerationWarn:
+		return 2
+	case ModerationBlock:
+		return 3
+	}
+	return 0
+}
+
+// ModerationInput is the text being checked. ProviderResponse is set for the
+// output stage so checkers can read provider-side safety signals.
+type ModerationInput struct {
+	Stage            string // "input" or "output"
+	Text             string
+	ProviderResponse map[string]interface{}
+}
+
+// ModerationFinding is one policy hit reported by a checker.
+type ModerationFinding struct {
+	Checker  string `json:"checker"`
+	Category string `json:"category"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ModerationChecker inspects a message and reports any policy hits.
+type ModerationChecker interface {
+	Name() string
+	Check(ctx context.Context, input ModerationInput) ([]ModerationFinding, error)
+}
+
+// ModerationDecision is the pipeline's verdict for one stage.
+type ModerationDecision struct {
+	Stage    string              `json:"stage"`
+	Action   ModerationAction    `json:"action"`
+	Findings []ModerationFinding `json:"findings,omitempty"`
+}
+
+// moderationPolicy maps a finding category to an action. It reads
+// MODERATION_POLICY, a comma separated list of category=action pairs;
+// entries with an unknown action are skipped.
+func moderationPolicy() map[string]ModerationAction {
+	policy := map[string]ModerationAction{}
+	for _, entry := range strings.Split(envOrDefault("MODERATION_POLICY", ModerationPolicy), ",") {
+		category, action, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		a := ModerationAction(strings.TrimSpace(action))
+		if !ok || category == "" || (a != ModerationAllow && a.severity() == 0) {
+			slog.Warn("Ignoring moderation policy entry", "entry", entry)
+			continue
+		}
+		policy[category] = a
+	}
+	return policy
+}
+
+// actionFor looks category up in policy. Categories not listed fall back to
+// ModerationDefaultAction.
+func actionFor(policy map[string]ModerationAction, category string) ModerationAction {
+	if action, ok := policy[category]; ok {
+		return action
+	}
+	return ModerationAction(envOrDefault("MODERATION_DEFAULT_ACTION", ModerationDefaultAction))
+}
+
+// add records findings and raises the action to the most severe one.
+func (d *ModerationDecision) add(policy map[string]ModerationAction, findings ...ModerationFinding) {
+	for _, f := range findings {
+		d.Findings = append(d.Findings, f)
+		if action := actionFor(policy, f.Category); action.severity() > d.Action.severity() {
+			d.Action = action
+		}
+	}
+}
+
+// runModeration runs every checker and combines their findings into the most
+// severe action. A failing checker is recorded but does not block.
+func runModeration(ctx context.Context, checkers []ModerationChecker, input ModerationInput) ModerationDecision {
+	defer recordStageLatency("moderation", time.Now())
+	ctx, span := startSpan(ctx, "moderation", attribute.String("moderation.stage", input.Stage))
+	defer span.End()
+
+	decision := ModerationDecision{Stage: input.Stage, Action: ModerationAllow}
+	defer func() {
+		span.SetAttributes(
+			attribute.String("moderation.action", string(decision.Action)),
+			attribute.Int("moderation.findings", len(decision.Findings)))
+	}()
+	policy := moderationPolicy()
+	for _, c := range checkers {
+		findings, err := c.Check(ctx, input)
+		if err != nil {
+			slog.WarnContext(ctx, "Moderation checker failed", "checker", c.Name(), "error", err)
+			findings = []ModerationFinding{{Checker: c.Name(), Category: "checker-failure", Detail: err.Error()}}
+		}
+		decision.add(policy, findings...)
+	}
+	return decision
+}
+
+// policyRule is one keyword or regular expression in the local policy.
+type policyRule struct {
+	category string
+	re       *regexp.Regexp
+}
+
+// policyChecker matches messages against a local keyword/regex policy.
+type policyChecker struct {
+	rules []policyRule
+}
+
+var defaultPolicyRules = []policyRule{
+	{"dangerous", regexp.MustCompile(`(?i)\b(how\s+to\s+(make|build)\s+(a\s+)?(bomb|explosive|pipe\s*bomb)|synthesi[sz]e\s+(sarin|ricin|nerve\s+agent))\b`)},
+	{"self-harm", regexp.MustCompile(`(?i)\b(how\s+(can|do)\s+i\s+(kill|hurt)\s+myself|best\s+way\s+to\s+commit\s+suicide)\b`)},
+	{"illicit", regexp.MustCompile(`(?i)\b(buy|sell)\s+(stolen\s+credit\s+cards|fake\s+passports)\b`)},
+	{"credentials", regexp.MustCompile(`\b(AKIA[0-9A-Z]{16}|AIza[0-9A-Za-z_\-]{35}|sk-[A-Za-z0-9_\-]{20,})\b`)},
+}
+
+func (p *policyChecker) Name() string { return "policy" }
+
+func (p *policyChecker) Check(ctx context.Context, input ModerationInput) ([]ModerationFinding, error) {
+	var findings []ModerationFinding
+	for _, r := range p.rules {
+		if r.re.MatchString(input.Text) {
+			findings = append(findings, ModerationFinding{Checker: p.Name(), Category: r.category})
+		}
+	}
+	return findings, nil
+}
+
+// openAIModerationChecker calls the OpenAI moderation endpoint.
+type openAIModerationChecker struct {
+	apiKey    string
+	url       string
+	client    *http.Client
+	throttles *throttle.Set
+}
+
+func (o *openAIModerationChecker) Name() string { return "openai-moderation" }
+
+func (o *openAIModerationChecker) Check(ctx context.Context, input ModerationInput) ([]ModerationFinding, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"model": OpenAIModerationModel,
+		"input": input.Text,
+	})
+	req, _ := http.NewRequestWithContext(ctx, "POST", o.url, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+o.apiKey)
+
+	if err := throttleProvider(ctx, o.throttles, tenantFrom(ctx).KeyPath(), "openai", OpenAIModerationModel, 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := doWithRetry(ctx, o.client, req)
+	recordProviderCall("openai", OpenAIModerationModel, start, resp, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("moderation API returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	var findings []ModerationFinding
+	for _, r := range result.Results {
+		for category, hit := range r.Categories {
+			if hit {
+				// "violence/graphic" and "violence" share a policy entry
+				findings = append(findings, ModerationFinding{Checker: o.Name(), Category: normalizeCategory(category), Detail: category})
+			}
+		}
+	}
+	return findings, nil
+}
+
+func normalizeCategory(category string) string {
+	if category == "sexual/minors" {
+		return category
+	}
+	if i := strings.Index(category, "/"); i > 0 {
+		return category[:i]
+	}
+	return category
+}
+
+// geminiSafetyChecker reads the safetyRatings and block reasons Gemini attaches
+// to a generation response. It only has something to say at the output stage.
+type geminiSafetyChecker struct{}
+
+func (g *geminiSafetyChecker) Name() string { return "gemini-safety" }
+
+var geminiCategories = map[string]string{
+	"HARM_CATEGORY_HARASSMENT":        "harassment",
+	"HARM_CATEGORY_HATE_SPEECH":       "hate",
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT": "sexual",
+	"HARM_CATEGORY_DANGEROUS_CONTENT": "dangerous",
+	"HARM_CATEGORY_CIVIC_INTEGRITY":   "civic",
+}
+
+func (g *geminiSafetyChecker) Check(ctx context.Context, input ModerationInput) ([]ModerationFinding, error) {
+	if input.ProviderResponse == nil {
+		return nil, nil
+	}
+
+	var findings []ModerationFinding
+	if feedback, ok := input.ProviderResponse["promptFeedback"].(map[string]interface{}); ok {
+		if reason, ok := feedback["blockReason"].(string); ok && reason != "" {
+			findings = append(findings, ModerationFinding{Checker: g.Name(), Category: "provider-block", Detail: reason})
+		}
+	}
+
+	candidates, _ := input.ProviderResponse["candidates"].([]interface{})
+	for _, c := range candidates {
+		candidate, _ := c.(map[string]interface{})
+		if reason, _ := candidate["finishReason"].(string); reason == "SAFETY" || reason == "PROHIBITED_CONTENT" {
+			findings = append(findings, ModerationFinding{Checker: g.Name(), Category: "provider-block", Detail: reason})
+		}
+		ratings, _ := candidate["safetyRatings"].([]interface{})
+		for _, r := range ratings {
+			rating, _ := r.(map[string]interface{})
+			probability, _ := rating["probability"].(string)
+			blocked, _ := rating["blocked"].(bool)
+			if probability != "HIGH" && probability != "MEDIUM" && !blocked {
+				continue
+			}
+			category, _ := rating["category"].(string)
+			name, ok := geminiCategories[category]
+			if !ok {
+				name = strings.ToLower(category)
+			}
+			findings = append(findings, ModerationFinding{Checker: g.Name(), Category: name, Detail: probability})
+		}
+	}
+	return findings, nil
+}
+
+// moderationCheckers builds the enabled checker list for the tenant's
+// provider. Gemini's own safety ratings are not among them: the chat loop
+// reads those once per response, whichever provider ends up answering.
+func (d *Deps) moderationCheckers(ctx context.Context, apiKey string) []ModerationChecker {
+	checkers := []ModerationChecker{&policyChecker{rules: defaultPolicyRules}}
+	if isOpenAIAPI(ctx) && envOrDefault("MODERATION_PROVIDER_CHECK", ModerationProviderCheck) == "on" {
+		checkers = append(checkers, &openAIModerationChecker{
+			apiKey:    apiKey,
+			url:       d.Providers.ModerationURL,
+			client:    &http.Client{Timeout: 10 * time.Second},
+			throttles: d.Providers.Throttles,
+		})
+	}
+	return checkers
+}
+
+// ModerationAudit is one moderation decision as it is stored. The message
+// is kept only as a hash so the audit never holds user content.
+type ModerationAudit struct {
+	UserId      string
+	SessionId   string
+	Decision    ModerationDecision
+	ContentHash string
+	Time        time.Time
+}
+
+// ModerationAuditStore keeps a record of every moderation decision.
+type ModerationAuditStore interface {
+	Record(ctx context.Context, audit ModerationAudit) error
+}
+
+// newModerationAuditStore builds the store MODERATION_AUDIT_BACKEND names.
+func newModerationAuditStore(ctx context.Context) ModerationAuditStore {
+	if envOrDefault("MODERATION_AUDIT_BACKEND", ModerationAuditBackend) != "dynamodb" {
+		return logModerationAudit{}
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Moderation audit falling back to the log", "error", err)
+		return logModerationAudit{}
+	}
+	return dynamoModerationAudit{client: dynamodb.NewFromConfig(cfg), table: ModerationAuditTableName}
+}
+
+// auditModeration records a decision and logs instead of failing the request.
+func (d *Deps) auditModeration(ctx context.Context, userId, sessionId, text string, decision ModerationDecision) {
+	sum := sha256.Sum256([]byte(text))
+	err := d.Audit.Record(ctx, ModerationAudit{
+		UserId:      userId,
+		SessionId:   sessionId,
+		Decision:    decision,
+		ContentHash: hex.EncodeToString(sum[:]),
+		Time:        d.Now(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to write moderation audit", "error", err)
+	}
+}
+
+// logModerationAudit writes decisions to the log only.
+type logModerationAudit struct{}
+
+func (logModerationAudit) Record(ctx context.Context, audit ModerationAudit) error {
+	findings, _ := json.Marshal(audit.Decision.Findings)
+	slog.InfoContext(ctx, "Moderation audit", "stage", audit.Decision.Stage, "action", string(audit.Decision.Action), "findings", string(findings))
+	return nil
+}
+
+type dynamoModerationAudit struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func (d dynamoModerationAudit) Record(ctx context.Context, audit ModerationAudit) error {
+	findings, _ := json.Marshal(audit.Decision.Findings)
+	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]types.AttributeValue{
+			"userId":      &types.AttributeValueMemberS{Value: audit.UserId},
+			"auditKey":    &types.AttributeValueMemberS{Value: audit.Time.UTC().Format(time.RFC3339Nano) + "#" + uuid.New().String()},
+			"sessionId":   &types.AttributeValueMemberS{Value: audit.SessionId},
+			"stage":       &types.AttributeValueMemberS{Value: audit.Decision.Stage},
+			"action":      &types.AttributeValueMemberS{Value: string(audit.Decision.Action)},
+			"findings":    &types.AttributeValueMemberS{Value: string(findings)},
+			"contentHash": &types.AttributeValueMemberS{Value: audit.ContentHash},
+			"timestamp":   &types.AttributeValueMemberS{Value: audit.Time.Format(time.RFC3339)},
+		},
+	})
+	return err
+}
+
+// moderationWarnings turns findings into short user-facing notes for "warn".
+func moderationWarnings(decision ModerationDecision) []string {
+	if decision.Action != ModerationWarn {
+		return nil
+	}
+	policy := moderationPolicy()
+	seen := map[string]bool{}
+	var warnings []string
+	for _, f := range decision.Findings {
+		if actionFor(policy, f.Category) == ModerationWarn && !seen[f.Category] {
+			seen[f.Category] = true
+			warnings = append(warnings, fmt.Sprintf("%s content flagged: %s", decision.Stage, f.Category))
+		}
+	}
+	return warnings
+}
+
+// moderationBlockedResponse is returned instead of a reply when either stage blocks.
+func moderationBlockedResponse(sessionId string) events.APIGatewayProxyResponse {
+	response := Response{
+		Reply:     ModerationBlockedReply,
+		SessionId: sessionId,
+	}
+	responseBody, _ := json.Marshal(response)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+			"Content-Type":                "application/json",
+		},
+		Body: string(responseBody),
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestModerationPolicyFromConfig(t *testing.T) {
+	if got := actionFor(moderationPolicy(), "violence"); got != ModerationBlock {
+		t.Errorf("default policy: violence = %q, want block", got)
+	}
+
+	t.Setenv("MODERATION_POLICY", "violence=warn, harassment=block,spam=shout,=log")
+	want := map[string]ModerationAction{"violence": ModerationWarn, "harassment": ModerationBlock}
+	if got := moderationPolicy(); !reflect.DeepEqual(got, want) {
+		t.Errorf("policy = %v, want %v", got, want)
+	}
+}
+
+func TestGeminiSafetyIsCheckedOncePerReply(t *testing.T) {
+	env := newTestEnv(t)
+	for _, c := range env.deps.moderationCheckers(context.Background(), "key") {
+		if _, ok := c.(*geminiSafetyChecker); ok {
+			t.Fatal("output checkers include Gemini safety, which the chat loop already ran")
+		}
+	}
+
+	reply := geminiReply("Here you go.", "STOP")
+	candidate := reply.body.(map[string]interface{})["candidates"].([]interface{})[0].(map[string]interface{})
+	candidate["safetyRatings"] = []interface{}{map[string]interface{}{"category": "HARM_CATEGORY_HARASSMENT", "probability": "MEDIUM"}}
+	env.api.script("/gemini", reply)
+
+	resp, body := env.chat(t, "user-safety", Request{SessionId: "s1", Message: "Say something"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, resp.Body)
+	}
+	if want := []string{"output content flagged: harassment"}; !reflect.DeepEqual(body.Warnings, want) {
+		t.Errorf("warnings = %v, want %v", body.Warnings, want)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestResolveSessionPersonaPinsOnFirstUse(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	first, err := env.deps.resolveSessionPersona(ctx, "u1", "s1", "support-agent")
+	if err != nil || first.Name != "support-agent" {
+		t.Fatalf("first call = %s, %v", first.Name, err)
+	}
+	again, err := env.deps.resolveSessionPersona(ctx, "u1", "s1", "code-reviewer")
+	if err != nil || again.Name != "support-agent" {
+		t.Errorf("pinned session switched to %s, %v", again.Name, err)
+	}
+}
+
+func TestResolveSessionPersonaDefaultsForSessionsWithoutOne(t *testing.T) {
+	env := newTestEnv(t)
+	env.sessions.settings["u1/old"] = SessionSettings{}
+
+	got, err := env.deps.resolveSessionPersona(context.Background(), "u1", "old", "support-agent")
+	if err != nil || got.Name != DefaultPersona {
+		t.Errorf("got %s, %v; want the default persona", got.Name, err)
+	}
+}
+
+// lostRaceSessions never finds a session yet always reports that one exists,
+// like a store that can't read its own writes.
+type lostRaceSessions struct{ gets int }
+
+func (s *lostRaceSessions) Get(ctx context.Context, userId, sessionId string) (SessionSettings, bool, error) {
+	s.gets++
+	return SessionSettings{}, false, nil
+}
+
+func (s *lostRaceSessions) Create(ctx context.Context, userId, sessionId string, settings SessionSettings, now time.Time) error {
+	return errSessionExists
+}
+
+func TestResolveSessionPersonaRetriesOnce(t *testing.T) {
+	env := newTestEnv(t)
+	sessions := &lostRaceSessions{}
+	env.deps.Sessions = sessions
+
+	if _, err := env.deps.resolveSessionPersona(context.Background(), "u1", "s1", ""); err == nil {
+		t.Error("expected an error")
+	}
+	if sessions.gets != 2 {
+		t.Errorf("read the session %d times, want 2", sessions.gets)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"shared/ratelimit"
+)
+
+// newChatRateLimiter builds the per-user chat limiter RATE_LIMIT_BACKEND
+// names.
+func newChatRateLimiter(ctx context.Context) ratelimit.Limiter {
+	backend := envOrDefault("RATE_LIMIT_BACKEND", RateLimitBackend)
+	if backend == "memory" {
+		return ratelimit.NewMemory(RateLimitPerMin, RateLimitWindow, nil)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Rate limiter falling back to memory backend", "error", err)
+		return ratelimit.NewMemory(RateLimitPerMin, RateLimitWindow, nil)
+	}
+	table := envOrDefault("RATE_LIMIT_TABLE", RateLimitTableName)
+	return ratelimit.NewDynamo(dynamodb.NewFromConfig(cfg), table, RateLimitPerMin, RateLimitWindow, nil)
+}
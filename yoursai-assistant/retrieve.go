@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Retrieval strategies. Single embeds the retrieval query only; the others
+// add generated queries and fuse the result lists.
+const (
+	StrategySingle     = "single"
+	StrategyMultiQuery = "multi-query"
+	StrategyHyDE       = "hyde"
+	StrategyHybrid     = "multi-query+hyde"
+)
+
+var retrievalStrategies = map[string]bool{
+	StrategySingle:     true,
+	StrategyMultiQuery: true,
+	StrategyHyDE:       true,
+	StrategyHybrid:     true,
+}
+
+// resolveRetrievalStrategy picks the request's strategy, falling back to the
+// configured default. ok is false for a strategy name we don't know.
+func resolveRetrievalStrategy(requested string) (string, bool) {
+	if requested == "" {
+		requested = envOrDefault("RETRIEVAL_STRATEGY", RetrievalStrategy)
+	}
+	requested = strings.ToLower(strings.TrimSpace(requested))
+	return requested, retrievalStrategies[requested]
+}
+
+const multiQueryPrompt = `You help a document search engine find more relevant passages.
+Write %d alternative phrasings of the user's search query. Use different wording and synonyms, keep names and technical terms unchanged, and do not answer the query.
+Reply with one query per line and nothing else.`
+
+const hydePrompt = `Write a short passage, as it might appear in an internal document, that answers the user's question.
+It is used only to search for similar documents, so plausible wording matters more than accuracy. Reply with the passage only.`
+
+// expandQueries asks the model for n paraphrases of query.
+func (d *Deps) expandQueries(ctx context.Context, apiKey, query string, n int) ([]string, TokenUsage, error) {
+	reply, usage, err := d.completeText(ctx, apiKey, fmt.Sprintf(multiQueryPrompt, n), query, 60*n)
+	if err != nil {
+		return nil, usage, err
+	}
+
+	var queries []string
+	for _, line := range strings.Split(reply, "\n") {
+		// Models like to number or bullet lists even when told not to
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*0123456789.) "))
+		if line == "" || strings.EqualFold(line, query) {
+			continue
+		}
+		queries = append(queries, line)
+		if len(queries) == n {
+			break
+		}
+	}
+	if len(queries) == 0 {
+		return nil, usage, fmt.Errorf("no paraphrases in reply")
+	}
+	return queries, usage, nil
+}
+
+// hypotheticalAnswer generates the HyDE passage for query.
+func (d *Deps) hypotheticalAnswer(ctx context.Context, apiKey, query string) (string, TokenUsage, error) {
+	passage, usage, err := d.completeText(ctx, apiKey, hydePrompt, query, HyDEMaxTokens)
+	if err != nil {
+		return "", usage, err
+	}
+	passage = strings.TrimSpace(passage)
+	if passage == "" {
+		return "", usage, fmt.Errorf("empty hypothetical answer")
+	}
+	return passage, usage, nil
+}
+
+// retrieve runs the strategy for query and returns the fused top chunks. The
+// generation steps and the searches each run concurrently; a failed
+// generation step only narrows the search, it never fails the retrieval.
+func (d *Deps) retrieve(ctx context.Context, apiKey, userId, sessionId, strategy, query string, scope SearchScope) (fused []SearchResult, err error) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, "retrieval", attribute.String("retrieval.strategy", strategy))
+	defer func() {
+		recordStageLatency("retrieval", start)
+		if err == nil {
+			recordRetrieval(strategy, fused)
+		}
+		span.SetAttributes(retrievalAttributes(fused)...)
+		endSpan(span, err)
+	}()
+
+	searchTexts := []string{query}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	if strategy == StrategyMultiQuery || strategy == StrategyHybrid {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paraphrases, usage, err := d.expandQueries(ctx, apiKey, query, MultiQueryCount)
+			d.recordUsage(ctx, userId, sessionId, chatModelName(ctx), "multi-query", usage)
+			if err != nil {
+				slog.WarnContext(ctx, "Multi-query expansion failed", "error", err)
+				return
+			}
+			mu.Lock()
+			searchTexts = append(searchTexts, paraphrases...)
+			mu.Unlock()
+		}()
+	}
+	if strategy == StrategyHyDE || strategy == StrategyHybrid {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			passage, usage, err := d.hypotheticalAnswer(ctx, apiKey, query)
+			d.recordUsage(ctx, userId, sessionId, chatModelName(ctx), "hyde", usage)
+			if err != nil {
+				slog.WarnContext(ctx, "HyDE generation failed", "error", err)
+				return
+			}
+			mu.Lock()
+			searchTexts = append(searchTexts, passage)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	span.SetAttributes(attribute.Int("retrieval.searches", len(searchTexts)))
+
+	ranked := make([][]SearchResult, len(searchTexts))
+	errs := make([]error, len(searchTexts))
+	for i, text := range searchTexts {
+		wg.Add(1)
+		go func(i int, text string) {
+			defer wg.Done()
+			embedding, embeddingTokens, err := d.generateEmbedding(ctx, text, apiKey)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			d.recordUsage(ctx, userId, sessionId, embeddingModelName(ctx), "embedding", TokenUsage{EmbeddingTokens: embeddingTokens})
+			ranked[i], errs[i] = d.Vectors.Search(ctx, embedding, scope)
+		}(i, text)
+	}
+	wg.Wait()
+
+	var lists [][]SearchResult
+	var firstErr error
+	for i := range ranked {
+		if errs[i] != nil {
+			slog.WarnContext(ctx, "Retrieval search failed", "search", i+1, "of", len(searchTexts), "error", errs[i])
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		lists = append(lists, ranked[i])
+	}
+	if len(lists) == 0 {
+		return nil, firstErr
+	}
+	return fuseResults(lists, RetrievalTopK), nil
+}
+
+// fuseResults merges ranked lists with reciprocal rank fusion, so a chunk
+// found by several queries outranks one found near the top of a single list.
+func fuseResults(lists [][]SearchResult, topK int) []SearchResult {
+	const rrfK = 60.0
+
+	scores := map[string]float64{}
+	chunks := map[string]SearchResult{}
+	for _, list := range lists {
+		for rank, r := range list {
+			key := r.DocumentName + "\x00" + r.Content
+			scores[key] += 1 / (rrfK + float64(rank+1))
+			chunks[key] = r
+		}
+	}
+
+	keys := make([]string, 0, len(scores))
+	for k := range scores {
+		keys = append(keys, k)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > topK {
+		keys = keys[:topK]
+	}
+
+	fused := make([]SearchResult, 0, len(keys))
+	for _, k := range keys {
+		fused = append(fused, chunks[k])
+	}
+	return fused
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"shared/retry"
+)
+
+func defaultRetryPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts:   RetryMaxAttempts,
+		BaseDelay:     time.Duration(RetryBaseDelayMs) * time.Millisecond,
+		MaxDelay:      time.Duration(RetryMaxDelayMs) * time.Millisecond,
+		MaxRetryAfter: time.Duration(RetryMaxRetryAfterSeconds) * time.Second,
+		OnRetry:       recordRetry,
+	}
+}
+
+// doWithRetry sends req with the default policy.
+func doWithRetry(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	return defaultRetryPolicy().Do(ctx, client, req)
+}
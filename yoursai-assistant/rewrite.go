@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"shared/logging"
+)
+
+const queryRewritePrompt = `You rewrite follow-up questions for a document search engine.
+Given the conversation so far and the user's latest message, write one standalone search query that captures what the user is asking now.
+Resolve pronouns and references using the conversation, keep names, products and technical terms exactly as written, and leave out greetings and filler.
+Reply with the query only: no quotes, no explanation, no answer to the question.`
+
+// recentHistory returns the last ContextExchanges exchanges.
+func recentHistory(history []ChatExchange) []ChatExchange {
+	if len(history) > ContextExchanges {
+		return history[len(history)-ContextExchanges:]
+	}
+	return history
+}
+
+// concatenatedQuery is the fallback retrieval query: the recent exchanges
+// followed by the current question, embedded as one block.
+func concatenatedQuery(history []ChatExchange, message string) string {
+	if len(history) == 0 {
+		return message
+	}
+	recentContext := ""
+	for _, h := range recentHistory(history) {
+		recentContext += h.String() + "\n"
+	}
+	return recentContext + "Current question: " + message
+}
+
+// rewriteQuery asks the model to turn a follow-up message into a standalone
+// search query. A message with no history is already standalone and is
+// returned as is.
+func (d *Deps) rewriteQuery(ctx context.Context, apiKey string, history []ChatExchange, message string) (string, TokenUsage, error) {
+	if len(history) == 0 {
+		return message, TokenUsage{}, nil
+	}
+
+	var conversation strings.Builder
+	for _, h := range recentHistory(history) {
+		conversation.WriteString(h.String() + "\n")
+	}
+	prompt := fmt.Sprintf("Conversation:\n%s\nLatest message: %s", conversation.String(), message)
+
+	query, usage, err := d.completeText(ctx, apiKey, queryRewritePrompt, prompt, QueryRewriteMaxTokens)
+	if err != nil {
+		return "", usage, err
+	}
+	query = strings.Trim(strings.TrimSpace(query), "\"'`")
+	if query == "" {
+		return "", usage, fmt.Errorf("rewriter returned an empty query")
+	}
+	return query, usage, nil
+}
+
+// buildRetrievalQuery picks the text to embed for retrieval. It uses the
+// rewriter when enabled and falls back to the concatenated history when the
+// rewriter is off or fails.
+func (d *Deps) buildRetrievalQuery(ctx context.Context, apiKey, userId, sessionId string, history []ChatExchange, message string) string {
+	if envOrDefault("QUERY_REWRITE", QueryRewrite) != "on" {
+		return concatenatedQuery(history, message)
+	}
+
+	defer recordStageLatency("rewrite", time.Now())
+	ctx, span := startSpan(ctx, "retrieval.rewrite_query", attribute.Int("chat.history.exchanges", len(history)))
+	defer span.End()
+
+	query, usage, err := d.rewriteQuery(ctx, apiKey, history, message)
+	d.recordUsage(ctx, userId, sessionId, chatModelName(ctx), "rewrite", usage)
+	if err != nil {
+		span.SetAttributes(attribute.Bool("retrieval.rewrite_fallback", true))
+		slog.WarnContext(ctx, "Query rewrite failed, using conversation context", "error", err)
+		return concatenatedQuery(history, message)
+	}
+	slog.InfoContext(ctx, "Rewrote retrieval query", logging.Content("query", query))
+	return query
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"shared/retry"
+	"shared/throttle"
+)
+
+// ChatProvider is one chat-completion backend the router can send to.
+type ChatProvider struct {
+	Name   string // "gemini" or "openai"
+	Model  string
+	URL    string
+	APIKey string
+	// KeyPath is where APIKey lives in SSM. Breakers and throttles are kept
+	// per key, so one tenant's revoked or exhausted key affects only them.
+	KeyPath string
+	// loadKey fetches APIKey on first use, so a secondary provider's key is
+	// only read from SSM when we actually fail over to it
+	loadKey func(ctx context.Context) (string, error)
+}
+
+func (p *ChatProvider) key(ctx context.Context) (string, error) {
+	if p.APIKey == "" && p.loadKey != nil {
+		k, err := p.loadKey(ctx)
+		if err != nil {
+			return "", err
+		}
+		p.APIKey = k
+	}
+	return p.APIKey, nil
+}
+
+// payload builds the provider's request body, offering tools when given.
+func (p *ChatProvider) payload(systemInstruction string, messages []ChatMessage, tools *ToolRegistry) map[string]interface{} {
+	if p.Name == "gemini" {
+		payload := buildGeminiPayload(systemInstruction, messages)
+		if tools != nil && !tools.Empty() {
+			payload["tools"] = tools.geminiTools()
+		}
+		return payload
+	}
+	payload := buildOpenAIPayload(systemInstruction, messages)
+	payload["model"] = p.Model
+	if tools != nil && !tools.Empty() {
+		payload["tools"] = tools.openAITools()
+	}
+	return payload
+}
+
+func (p *ChatProvider) newRequest(ctx context.Context, apiKey string, body []byte) (*http.Request, error) {
+	url := p.URL
+	if p.Name == "gemini" {
+		url += "?key=" + apiKey
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if p.Name != "gemini" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// ChatResult is a decoded provider response and the provider that served it.
+type ChatResult struct {
+	Provider *ChatProvider
+	Resp     map[string]interface{}
+}
+
+var (
+	errAllProvidersFailed = errors.New("no chat provider available")
+	errProviderKey        = errors.New("loading API key")
+)
+
+// ChatRouter sends chat requests to the first healthy provider, failing over
+// to the next one on errors and timeouts. Once a provider has served a
+// request the router sticks with it, so a tool-calling loop stays on one
+// provider unless that provider starts failing.
+type ChatRouter struct {
+	Providers []*ChatProvider // in order of preference
+	Client    *http.Client
+	Breakers  *breakerSet
+	Throttles *throttle.Set
+	Keys      *keyCache // where loaded keys came from; nil when none are
+}
+
+// newChatRouter routes to the tenant's provider first and, with failover
+// on, to the other provider second. A tenant with its own key only fails
+// over when it has configured a key for the other provider too.
+func (d *Deps) newChatRouter(ctx context.Context, apiKey string) *ChatRouter {
+	tenant := tenantFrom(ctx)
+	gemini := &ChatProvider{Name: "gemini", Model: GeminiModel, URL: d.Providers.GeminiURL}
+	openai := &ChatProvider{Name: "openai", Model: OpenAIModel, URL: d.Providers.OpenAIURL}
+
+	primary, secondary := gemini, openai
+	secondaryKeyPath := OpenAIKeyPath
+	if isOpenAIAPI(ctx) {
+		primary, secondary = openai, gemini
+		secondaryKeyPath = GeminiKeyPath
+	}
+	if tenant.SSMKeyPath != "" {
+		secondaryKeyPath = tenant.FailoverSSMKeyPath
+	}
+	primary.APIKey = apiKey
+	primary.KeyPath = tenant.KeyPath()
+	secondary.KeyPath = secondaryKeyPath
+	if tenant.ChatModel != "" {
+		primary.Model = tenant.ChatModel
+		if primary == gemini {
+			primary.URL = geminiModelURL(primary.URL, tenant.ChatModel)
+		}
+	}
+	secondary.loadKey = func(ctx context.Context) (string, error) {
+		return d.Keys.Get(ctx, secondaryKeyPath)
+	}
+
+	providers := []*ChatProvider{primary}
+	if envOrDefault("CHAT_FAILOVER", ChatFailover) == "on" && secondaryKeyPath != "" {
+		providers = append(providers, secondary)
+	}
+	return &ChatRouter{
+		Providers: providers,
+		Client:    &http.Client{Timeout: time.Duration(ChatProviderTimeoutSeconds) * time.Second},
+		Breakers:  d.Providers.Breakers,
+		Throttles: d.Providers.Throttles,
+		Keys:      d.Keys,
+	}
+}
+
+// Generate sends one turn. tools may be nil to force a text answer.
+func (r *ChatRouter) Generate(ctx context.Context, systemInstruction string, messages []ChatMessage, tools *ToolRegistry) (result ChatResult, err error) {
+	defer recordStageLatency("generate", time.Now())
+	ctx, span := startSpan(ctx, "llm.generate")
+	defer func() {
+		if result.Provider != nil {
+			span.SetAttributes(attribute.String("llm.provider", result.Provider.Name))
+		}
+		endSpan(span, err)
+	}()
+
+	var failures []string
+	for i, p := range r.Providers {
+		breaker := r.Breakers.get(p.Name + "|" + p.KeyPath)
+		if !breaker.Allow() {
+			failures = append(failures, p.Name+": circuit open")
+			continue
+		}
+
+		// With another provider to fall back on, fail over instead of waiting out retries
+		policy := defaultRetryPolicy()
+		if i < len(r.Providers)-1 {
+			policy.MaxAttempts = 1
+		}
+
+		resp, status, err := r.send(ctx, p, systemInstruction, messages, tools, policy)
+		switch {
+		case err == nil:
+			breaker.Success()
+		case healthFailure(ctx, status, err):
+			breaker.Failure()
+		default:
+			// Whatever went wrong was on our side; a probe must not hold
+			// the breaker half-open forever
+			breaker.Release()
+		}
+		if err == nil {
+			if i > 0 {
+				slog.WarnContext(ctx, "Chat served by fallback provider", "provider", p.Name, "failures", strings.Join(failures, "; "))
+				r.prefer(i)
+			}
+			return ChatResult{Provider: p, Resp: resp}, nil
+		}
+
+		slog.WarnContext(ctx, "Chat provider failed", "provider", p.Name, "status", status, "error", err)
+		failures = append(failures, fmt.Sprintf("%s: %v", p.Name, err))
+
+		// A cancelled request fails the same way everywhere
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return ChatResult{}, fmt.Errorf("%w (%s)", errAllProvidersFailed, strings.Join(failures, "; "))
+}
+
+// send makes the call and returns the decoded body. status is 0 when no
+// HTTP response arrived.
+func (r *ChatRouter) send(ctx context.Context, p *ChatProvider, systemInstruction string, messages []ChatMessage, tools *ToolRegistry, policy retry.Policy) (result map[string]interface{}, status int, err error) {
+	ctx, span := startSpan(ctx, "llm.call",
+		attribute.String("llm.provider", p.Name),
+		attribute.String("llm.model", p.Model))
+	defer func() {
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if result != nil {
+			span.SetAttributes(usageAttributes(parseTokenUsage(result))...)
+		}
+		endSpan(span, err)
+	}()
+
+	apiKey, err := p.key(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", errProviderKey, err)
+	}
+	body, err := json.Marshal(p.payload(systemInstruction, messages, tools))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := throttleProvider(ctx, r.Throttles, p.KeyPath, p.Name, p.Model, len(body)/4+MaxOutputTokens); err != nil {
+		return nil, 0, err
+	}
+	req, err := p.newRequest(ctx, apiKey, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	resp, err := policy.Do(ctx, r.Client, req)
+	recordProviderCall(p.Name, p.Model, start, resp, err)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		// A rejected key may have been rotated; read it again next time
+		if (resp.StatusCode == 401 || resp.StatusCode == 403) && p.loadKey != nil && r.Keys != nil {
+			r.Keys.Invalidate(p.KeyPath)
+		}
+		return nil, resp.StatusCode, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("decoding response: %w", err)
+	}
+	return decoded, resp.StatusCode, nil
+}
+
+// prefer moves provider i to the front for the rest of this request.
+func (r *ChatRouter) prefer(i int) {
+	p := r.Providers[i]
+	r.Providers = append([]*ChatProvider{p}, append(r.Providers[:i:i], r.Providers[i+1:]...)...)
+}
+
+// healthFailure reports whether a failed call should count against the
+// provider's breaker. Our own throttle, a key we couldn't load and a caller
+// who went away say nothing about the provider.
+func healthFailure(ctx context.Context, status int, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, errThrottled) || errors.Is(err, errProviderKey) {
+		return false
+	}
+	return countsAgainstProvider(status)
+}
+
+// countsAgainstProvider reports whether a failure says something about the
+// provider's health. Transport errors (status 0), auth, throttling and
+// server errors do; a 400 is about our request and would only trip the
+// breaker for everyone else.
+func countsAgainstProvider(status int) bool {
+	return status == 0 || status == 401 || status == 403 || status == 408 || status == 429 || status >= 500
+}
+
+// keyCache keeps provider keys read from SSM for ttl, so a rotated key
+// takes effect within that time. A key the provider rejects is dropped at
+// once and read again on next use.
+type keyCache struct {
+	secrets SecretStore
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	keys    map[string]cachedKey
+}
+
+type cachedKey struct {
+	value   string
+	fetched time.Time
+}
+
+func newKeyCache(secrets SecretStore, ttl time.Duration, now func() time.Time) *keyCache {
+	return &keyCache{secrets: secrets, ttl: ttl, now: now, keys: map[string]cachedKey{}}
+}
+
+func (c *keyCache) Get(ctx context.Context, name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.keys[name]; ok && c.now().Sub(k.fetched) < c.ttl {
+		return k.value, nil
+	}
+	v, err := c.secrets.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	c.keys[name] = cachedKey{value: v, fetched: c.now()}
+	return v, nil
+}
+
+// Invalidate drops the key stored at name.
+func (c *keyCache) Invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.keys, name)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker stops sending to a provider after consecutive failures.
+// After the cooldown one probe request is let through: success closes the
+// breaker, failure opens it for another cooldown. Every request Allow lets
+// through must end in Success, Failure or Release.
+type CircuitBreaker struct {
+	name      string
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{name: name, threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow reports whether a request may be sent now.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			slog.Warn("Circuit opened", "breaker", b.name, "consecutiveFailures", b.failures)
+		}
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// Release ends a request that said nothing about the provider's health. A
+// probe gives up its slot so the next request can probe instead.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// breakerSet holds one breaker per provider and key for the life of the
+// container.
+type breakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+	newFn    func(name string) *CircuitBreaker
+}
+
+func newBreakerSet(newFn func(name string) *CircuitBreaker) *breakerSet {
+	return &breakerSet{breakers: map[string]*CircuitBreaker{}, newFn: newFn}
+}
+
+func (s *breakerSet) get(name string) *CircuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[name]
+	if !ok {
+		b = s.newFn(name)
+		s.breakers[name] = b
+	}
+	return b
+}
+
+var providerBreakers = newBreakerSet(func(name string) *CircuitBreaker {
+	return newCircuitBreaker(name, CircuitBreakerThreshold, time.Duration(CircuitBreakerCooldownSeconds)*time.Second)
+})
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"shared/throttle"
+)
+
+// breakerEnv routes between a fake Gemini and a fake OpenAI that share one
+// breaker set, on a clock the test moves by hand.
+type breakerEnv struct {
+	api      *fakeAPI
+	server   *httptest.Server
+	breakers *breakerSet
+	now      time.Time
+}
+
+func newBreakerEnv(t *testing.T) *breakerEnv {
+	t.Helper()
+	env := &breakerEnv{api: newFakeAPI(), now: testNow}
+	env.server = httptest.NewServer(env.api)
+	t.Cleanup(env.server.Close)
+	env.breakers = newBreakerSet(func(name string) *CircuitBreaker {
+		b := newCircuitBreaker(name, 2, time.Minute)
+		b.now = func() time.Time { return env.now }
+		return b
+	})
+	env.api.script("/openai", openAIReply("from openai"))
+	return env
+}
+
+// generate sends one turn through a fresh router, as each request does.
+func (e *breakerEnv) generate(ctx context.Context) (ChatResult, error) {
+	return e.generateWithKey(ctx, "/yoursai/gemini/apiKey")
+}
+
+// generateWithKey sends the Gemini leg with the key stored at keyPath.
+func (e *breakerEnv) generateWithKey(ctx context.Context, keyPath string) (ChatResult, error) {
+	router := &ChatRouter{
+		Providers: []*ChatProvider{
+			{Name: "gemini", Model: GeminiModel, URL: e.server.URL + "/gemini", APIKey: "k", KeyPath: keyPath},
+			{Name: "openai", Model: OpenAIModel, URL: e.server.URL + "/openai", APIKey: "k", KeyPath: OpenAIKeyPath},
+		},
+		Client:    e.server.Client(),
+		Breakers:  e.breakers,
+		Throttles: throttle.NewSet(nil),
+	}
+	return router.Generate(ctx, "system", []ChatMessage{{Role: "user", Content: "hi"}}, nil)
+}
+
+func (e *breakerEnv) geminiCalls() int { return len(e.api.requestsTo("/gemini")) }
+
+func (e *breakerEnv) expectProvider(t *testing.T, want string) {
+	t.Helper()
+	result, err := e.generate(context.Background())
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if result.Provider.Name != want {
+		t.Fatalf("served by %s, want %s", result.Provider.Name, want)
+	}
+}
+
+func TestCircuitBreakerTripsProbesAndRecovers(t *testing.T) {
+	env := newBreakerEnv(t)
+	env.api.script("/gemini", fakeResponse{status: http.StatusServiceUnavailable, body: map[string]string{}})
+
+	// Two failures in a row open the circuit
+	env.expectProvider(t, "openai")
+	env.expectProvider(t, "openai")
+	if calls := env.geminiCalls(); calls != 2 {
+		t.Fatalf("gemini calls = %d, want 2", calls)
+	}
+
+	// While open, gemini is skipped without a call
+	env.expectProvider(t, "openai")
+	if calls := env.geminiCalls(); calls != 2 {
+		t.Fatalf("gemini called %d times with the circuit open", calls)
+	}
+
+	// After the cooldown one probe goes out; a failed probe reopens it
+	env.now = env.now.Add(time.Minute)
+	env.expectProvider(t, "openai")
+	env.expectProvider(t, "openai")
+	if calls := env.geminiCalls(); calls != 3 {
+		t.Fatalf("gemini calls = %d, want exactly one probe", calls)
+	}
+
+	// A successful probe closes it again
+	env.now = env.now.Add(time.Minute)
+	env.api.script("/gemini", geminiReply("back", "STOP"))
+	env.expectProvider(t, "gemini")
+	env.expectProvider(t, "gemini")
+}
+
+func TestCircuitBreakerSurvivesABadRequestProbe(t *testing.T) {
+	env := newBreakerEnv(t)
+	env.api.script("/gemini",
+		fakeResponse{status: http.StatusServiceUnavailable, body: map[string]string{}},
+		fakeResponse{status: http.StatusServiceUnavailable, body: map[string]string{}},
+		fakeResponse{status: http.StatusBadRequest, body: map[string]string{}},
+		geminiReply("back", "STOP"),
+	)
+	env.expectProvider(t, "openai")
+	env.expectProvider(t, "openai")
+
+	// The probe gets a 400, which is about our request, not gemini's health
+	env.now = env.now.Add(time.Minute)
+	env.expectProvider(t, "openai")
+
+	// so the next request may probe straight away and close the circuit
+	env.expectProvider(t, "gemini")
+	if calls := env.geminiCalls(); calls != 4 {
+		t.Errorf("gemini calls = %d, want 4", calls)
+	}
+}
+
+func TestCircuitBreakerIgnoresCancelledRequests(t *testing.T) {
+	env := newBreakerEnv(t)
+	env.api.script("/gemini", geminiReply("ok", "STOP"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		if _, err := env.generate(ctx); !errors.Is(err, errAllProvidersFailed) {
+			t.Fatalf("err = %v, want errAllProvidersFailed", err)
+		}
+	}
+	env.expectProvider(t, "gemini")
+}
+
+func TestCircuitBreakerReleaseFreesTheProbe(t *testing.T) {
+	now := testNow
+	b := newCircuitBreaker("gemini", 1, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("second probe allowed while the first is out")
+	}
+	b.Release()
+	if !b.Allow() {
+		t.Error("released probe still holds the breaker")
+	}
+}
+
+func TestCircuitBreakersArePerKey(t *testing.T) {
+	env := newBreakerEnv(t)
+	env.api.script("/gemini", fakeResponse{status: http.StatusUnauthorized, body: map[string]string{}})
+
+	// A revoked key opens the circuit for its own tenant
+	for i := 0; i < 2; i++ {
+		if _, err := env.generateWithKey(context.Background(), "/acme/gemini/apiKey"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := env.generateWithKey(context.Background(), "/acme/gemini/apiKey"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := env.geminiCalls(); calls != 2 {
+		t.Fatalf("gemini calls = %d, want 2 before acme's circuit opened", calls)
+	}
+
+	// but another tenant's key still reaches Gemini
+	env.api.script("/gemini", geminiReply("fine", "STOP"))
+	result, err := env.generateWithKey(context.Background(), "/globex/gemini/apiKey")
+	if err != nil || result.Provider.Name != "gemini" {
+		t.Fatalf("globex served by %v, %v; want gemini", result.Provider, err)
+	}
+}
+
+func TestThrottlesArePerKeyAndCoverUnknownModels(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	set := throttle.NewSet(func() time.Time { return testNow })
+
+	// A tenant's own model gets the provider's default limit
+	limit := providerDefaultLimits["openai"].RPM
+	for i := 0; i < limit; i++ {
+		if err := throttleProvider(ctx, set, "/acme/openai/apiKey", "openai", "gpt-acme", 0); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if err := throttleProvider(ctx, set, "/acme/openai/apiKey", "openai", "gpt-acme", 0); !errors.Is(err, errThrottled) {
+		t.Errorf("call past the limit: err = %v, want errThrottled", err)
+	}
+	if err := throttleProvider(ctx, set, "/globex/openai/apiKey", "openai", "gpt-acme", 0); err != nil {
+		t.Errorf("another key waited on acme's bucket: %v", err)
+	}
+}
+
+// countingSecrets counts reads of a fakeSecrets.
+type countingSecrets struct {
+	fakeSecrets
+	reads int
+}
+
+func (c *countingSecrets) Get(ctx context.Context, name string) (string, error) {
+	c.reads++
+	return c.fakeSecrets.Get(ctx, name)
+}
+
+func TestProviderKeysExpireAndRejectedKeysAreReRead(t *testing.T) {
+	env := newBreakerEnv(t)
+	secrets := &countingSecrets{fakeSecrets: fakeSecrets{OpenAIKeyPath: "old-key"}}
+	keys := newKeyCache(secrets, time.Minute, func() time.Time { return env.now })
+	generate := func() error {
+		router := &ChatRouter{
+			Providers: []*ChatProvider{{Name: "openai", Model: OpenAIModel, URL: env.server.URL + "/openai", KeyPath: OpenAIKeyPath,
+				loadKey: func(ctx context.Context) (string, error) { return keys.Get(ctx, OpenAIKeyPath) }}},
+			Client:    env.server.Client(),
+			Breakers:  env.breakers,
+			Throttles: throttle.NewSet(nil),
+			Keys:      keys,
+		}
+		_, err := router.Generate(context.Background(), "system", []ChatMessage{{Role: "user", Content: "hi"}}, nil)
+		return err
+	}
+
+	generate()
+	generate()
+	if secrets.reads != 1 {
+		t.Errorf("SSM reads within the TTL = %d, want 1", secrets.reads)
+	}
+	env.now = env.now.Add(time.Minute)
+	generate()
+	if secrets.reads != 2 {
+		t.Errorf("SSM reads after the TTL = %d, want 2", secrets.reads)
+	}
+
+	// The key is rotated; the provider's 401 drops the cached one
+	secrets.fakeSecrets[OpenAIKeyPath] = "new-key"
+	env.api.script("/openai", fakeResponse{status: http.StatusUnauthorized, body: map[string]string{}})
+	if err := generate(); err == nil {
+		t.Fatal("generate with a rejected key succeeded")
+	}
+	env.api.script("/openai", openAIReply("rotated"))
+	if err := generate(); err != nil {
+		t.Fatalf("generate after rotation: %v", err)
+	}
+	if secrets.reads != 3 {
+		t.Errorf("SSM reads after a 401 = %d, want the key read again", secrets.reads)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/tenant"
+)
+
+// Several organizations can share one deployment. Each request belongs to
+// one tenant, taken from the verified token; the tenant's data is kept
+// apart by key and row, and its configuration overrides the deployment
+// defaults for the model, default persona, quotas and provider key.
+// shared/tenant does the resolving, for yoursai-ingest too.
+type (
+	Tenant       = tenant.Tenant
+	TenantConfig = tenant.Config
+	TenantStore  = tenant.Store
+)
+
+var tenancy = tenant.Settings{
+	Claim:             TenantClaim,
+	GroupPrefix:       TenantGroupPrefix,
+	Default:           DefaultTenant,
+	SSMKeyPath:        SSMKeyPath,
+	DailyTokenQuota:   DailyTokenQuota,
+	MonthlyTokenQuota: MonthlyTokenQuota,
+}
+
+// tenantForClaims resolves the tenant a token belongs to.
+func (d *Deps) tenantForClaims(ctx context.Context, claims map[string]interface{}) (Tenant, error) {
+	return tenancy.ForClaims(ctx, d.Tenants, claims)
+}
+
+// tenantErrorResponse is 403 for a token whose tenant cannot be served and
+// 500 when the configuration could not be read or is broken.
+func tenantErrorResponse(err error) events.APIGatewayProxyResponse {
+	status, body := 403, `{"error": "Your organization is not set up for this service"}`
+	if !tenant.Rejected(err) {
+		status, body = 500, `{"error": "Failed to load organization settings"}`
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+			"Content-Type":                "application/json",
+		},
+		Body: body,
+	}
+}
+
+// tenantPersona is the tenant's default persona when it names one that
+// exists, else DefaultPersona.
+func tenantPersona(t Tenant) string {
+	if t.Persona != "" {
+		if _, ok := getPromptTemplate(t.Persona, 0); ok {
+			return t.Persona
+		}
+	}
+	return DefaultPersona
+}
+
+func withTenant(ctx context.Context, t Tenant) context.Context {
+	return tenant.NewContext(ctx, t)
+}
+
+// tenantFrom returns the request's tenant; outside a request it is
+// DefaultTenant with no overrides.
+func tenantFrom(ctx context.Context) Tenant {
+	return tenancy.FromContext(ctx)
+}
+
+// isGeminiAPI and isOpenAIAPI report the request tenant's provider.
+func isGeminiAPI(ctx context.Context) bool {
+	return tenantFrom(ctx).Provider() == tenant.Gemini
+}
+
+func isOpenAIAPI(ctx context.Context) bool {
+	return tenantFrom(ctx).Provider() == tenant.OpenAI
+}
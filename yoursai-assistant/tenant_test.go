@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestHandlerAppliesTenantConfiguration(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Secrets.(fakeSecrets)["/acme/openai/apiKey"] = "acme-key"
+	env.deps.Tenants = fakeTenants{"acme": {
+		ChatModel:  "gpt-acme",
+		Persona:    "support-agent",
+		SSMKeyPath: "/acme/openai/apiKey",
+	}}
+	env.api.script("/openai", openAIReply("Hello from Acme."))
+
+	claims := map[string]interface{}{"sub": "user-1", TenantClaim: "acme"}
+	resp, body := env.chatWithClaims(t, claims, Request{SessionId: "s1", Message: "Which model answers for us?"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, resp.Body)
+	}
+	if body.Provider != "openai" || body.Model != "gpt-acme" {
+		t.Errorf("provider = %q/%q, want openai/gpt-acme", body.Provider, body.Model)
+	}
+	requests := env.api.requestsTo("/openai")
+	if len(requests) != 1 || requests[0]["model"] != "gpt-acme" {
+		t.Fatalf("OpenAI requests = %v, want one for gpt-acme", requests)
+	}
+	if got := len(env.api.requestsTo("/gemini")); got != 0 {
+		t.Errorf("Gemini calls = %d; a tenant without a failover key must not use the deployment's", got)
+	}
+
+	if got := len(env.history.saved("acme#user-1", "s1")); got != 1 {
+		t.Errorf("saved %d exchanges under the tenant's key, want 1", got)
+	}
+	if got := len(env.history.saved("user-1", "s1")); got != 0 {
+		t.Errorf("saved %d exchanges under the bare sub, want 0", got)
+	}
+	if s, ok, _ := env.sessions.Get(context.Background(), "acme#user-1", "s1"); !ok || s.Persona != "support-agent" {
+		t.Errorf("session settings = %+v, %v; want the tenant persona pinned", s, ok)
+	}
+}
+
+func TestHandlerRejectsUnknownTenant(t *testing.T) {
+	env := newTestEnv(t)
+	env.api.script("/gemini", geminiReply("Should not be called.", "STOP"))
+
+	claims := map[string]interface{}{"sub": "user-1", "cognito:groups": []interface{}{TenantGroupPrefix + "globex"}}
+	resp, _ := env.chatWithClaims(t, claims, Request{SessionId: "s1", Message: "Hello there, assistant"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403 (body %s)", resp.StatusCode, resp.Body)
+	}
+	if got := len(env.api.requestsTo("/gemini")); got != 0 {
+		t.Errorf("Gemini calls = %d, want 0", got)
+	}
+}
+
+func TestHandlerEmbedsWithTheTenantProvider(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Secrets.(fakeSecrets)["/acme/openai/apiKey"] = "acme-key"
+	env.deps.Tenants = fakeTenants{"acme": {SSMKeyPath: "/acme/openai/apiKey"}}
+	env.api.script("/openai", openAIReply("Here is what the handbook says."))
+	env.api.script("/openai-embed", fakeResponse{status: http.StatusOK, body: map[string]interface{}{
+		"data":  []interface{}{map[string]interface{}{"embedding": []float64{0.1, 0.2, 0.3}}},
+		"usage": map[string]interface{}{"prompt_tokens": 9},
+	}})
+
+	claims := map[string]interface{}{"sub": "user-1", TenantClaim: "acme"}
+	resp, _ := env.chatWithClaims(t, claims, Request{SessionId: "s1", Message: "What does the handbook say about leave?"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, resp.Body)
+	}
+	requests := env.api.requestsTo("/openai-embed")
+	if len(requests) != 1 || requests[0]["model"] != OpenAIEmbeddingModel {
+		t.Fatalf("OpenAI embedding requests = %v, want one for %s", requests, OpenAIEmbeddingModel)
+	}
+	if got := len(env.api.requestsTo("/embed")); got != 0 {
+		t.Errorf("Gemini embedding calls = %d, want 0 for an OpenAI tenant", got)
+	}
+	if got := env.vectors.searchCount(); got != 1 {
+		t.Errorf("searches = %d, want 1", got)
+	}
+}
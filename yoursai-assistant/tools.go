@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"shared/redact"
+)
+
+// Tool is a function the model may call. Parameters is a JSON schema object
+// describing the arguments.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{}
+	Timeout     time.Duration
+	Run         func(ctx context.Context, args map[string]interface{}) (string, error)
+}
+
+// ToolCall is one function call requested by the model. Raw keeps the
+// provider's original part so it can be echoed back unchanged.
+type ToolCall struct {
+	Id   string
+	Name string
+	Args map[string]interface{}
+	Raw  map[string]interface{}
+}
+
+// geminiPart returns the call as a Gemini functionCall part. Raw is used when
+// Gemini made the call; a call made by OpenAI before a failover is rebuilt.
+func (c ToolCall) geminiPart() map[string]interface{} {
+	if _, ok := c.Raw["functionCall"]; ok {
+		return c.Raw
+	}
+	return map[string]interface{}{
+		"functionCall": map[string]interface{}{"name": c.Name, "args": c.Args},
+	}
+}
+
+// openAIToolCall returns the call as an OpenAI tool_calls entry, rebuilding
+// it when the call came from Gemini.
+func (c ToolCall) openAIToolCall() map[string]interface{} {
+	if _, ok := c.Raw["function"]; ok {
+		return c.Raw
+	}
+	args, _ := json.Marshal(c.Args)
+	return map[string]interface{}{
+		"id":   c.Id,
+		"type": "function",
+		"function": map[string]interface{}{
+			"name":      c.Name,
+			"arguments": string(args),
+		},
+	}
+}
+
+// ToolRegistry holds the tools offered to the model for one request.
+type ToolRegistry struct {
+	tools map[string]Tool
+	order []string
+}
+
+func newToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: map[string]Tool{}}
+}
+
+func (r *ToolRegistry) Register(t Tool) {
+	if _, exists := r.tools[t.Name]; !exists {
+		r.order = append(r.order, t.Name)
+	}
+	r.tools[t.Name] = t
+}
+
+func (r *ToolRegistry) Empty() bool {
+	return len(r.order) == 0
+}
+
+// geminiTools renders the registry as a Gemini "tools" entry.
+func (r *ToolRegistry) geminiTools() []map[string]interface{} {
+	declarations := make([]map[string]interface{}, 0, len(r.order))
+	for _, name := range r.order {
+		t := r.tools[name]
+		declarations = append(declarations, map[string]interface{}{
+			"name":        t.Name,
+			"description": t.Description,
+			"parameters":  t.Parameters,
+		})
+	}
+	return []map[string]interface{}{{"functionDeclarations": declarations}}
+}
+
+// openAITools renders the registry in the OpenAI "tools" format.
+func (r *ToolRegistry) openAITools() []map[string]interface{} {
+	tools := make([]map[string]interface{}, 0, len(r.order))
+	for _, name := range r.order {
+		t := r.tools[name]
+		tools = append(tools, map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        t.Name,
+				"description": t.Description,
+				"parameters":  t.Parameters,
+			},
+		})
+	}
+	return tools
+}
+
+// Call runs a tool under its timeout. Failures are returned as text so the
+// model can see what went wrong and recover.
+func (r *ToolRegistry) Call(ctx context.Context, call ToolCall) string {
+	t, ok := r.tools[call.Name]
+	if !ok {
+		return fmt.Sprintf(`{"error": "unknown tool %q"}`, call.Name)
+	}
+
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = time.Duration(ToolTimeoutSeconds) * time.Second
+	}
+	defer recordStageLatency("tool", time.Now())
+	ctx, span := startSpan(ctx, "tool.call", attribute.String("tool.name", call.Name))
+	defer span.End()
+	toolCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result, err := t.Run(toolCtx, call.Args)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.WarnContext(ctx, "Tool failed", "tool", call.Name, "error", err)
+		errBody, _ := json.Marshal(map[string]string{"error": err.Error()})
+		return string(errBody)
+	}
+	return result
+}
+
+// parseToolCalls extracts function calls from a Gemini or OpenAI response.
+func parseToolCalls(resp map[string]interface{}) []ToolCall {
+	var calls []ToolCall
+
+	if candidates, ok := resp["candidates"].([]interface{}); ok && len(candidates) > 0 {
+		candidate, _ := candidates[0].(map[string]interface{})
+		content, _ := candidate["content"].(map[string]interface{})
+		parts, _ := content["parts"].([]interface{})
+		for _, p := range parts {
+			part, _ := p.(map[string]interface{})
+			fc, ok := part["functionCall"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := fc["name"].(string)
+			args, _ := fc["args"].(map[string]interface{})
+			// Gemini calls carry no id; give them one in case the loop fails over to OpenAI
+			id := fmt.Sprintf("call_%d", len(calls)+1)
+			calls = append(calls, ToolCall{Id: id, Name: name, Args: args, Raw: part})
+		}
+		return calls
+	}
+
+	if choices, ok := resp["choices"].([]interface{}); ok && len(choices) > 0 {
+		choice, _ := choices[0].(map[string]interface{})
+		message, _ := choice["message"].(map[string]interface{})
+		toolCalls, _ := message["tool_calls"].([]interface{})
+		for _, tc := range toolCalls {
+			toolCall, _ := tc.(map[string]interface{})
+			fn, _ := toolCall["function"].(map[string]interface{})
+			id, _ := toolCall["id"].(string)
+			name, _ := fn["name"].(string)
+			rawArgs, _ := fn["arguments"].(string)
+			args := map[string]interface{}{}
+			json.Unmarshal([]byte(rawArgs), &args)
+			calls = append(calls, ToolCall{Id: id, Name: name, Args: args, Raw: toolCall})
+		}
+	}
+	return calls
+}
+
+// buildDefaultTools registers the built-in tools for one request. The
+// knowledge base search is bound to the request's scope so it only sees
+// collections the caller can read, and is only offered when the vector
+// store is searchable. Internal APIs are limited to the tenant's and called
+// on the caller's behalf.
+func (d *Deps) buildDefaultTools(ctx context.Context, apiKey, userId, sessionId string, scope SearchScope, searchable bool, pii *redact.Vault) *ToolRegistry {
+	registry := newToolRegistry()
+
+	if searchable {
+		registry.Register(Tool{
+			Name:        "search_knowledge_base",
+			Description: "Search the user's uploaded documents for passages relevant to a query.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"query": map[string]interface{}{"type": "string", "description": "What to search for"},
+				},
+				"required": []string{"query"},
+			},
+			Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+				query, _ := args["query"].(string)
+				if strings.TrimSpace(query) == "" {
+					return "", fmt.Errorf("query is required")
+				}
+				embedding, embeddingTokens, err := d.generateEmbedding(ctx, query, apiKey)
+				if err != nil {
+					return "", err
+				}
+				d.recordUsage(ctx, userId, sessionId, embeddingModelName(ctx), "embedding", TokenUsage{EmbeddingTokens: embeddingTokens})
+				results, err := d.Vectors.Search(ctx, embedding, scope)
+				if err != nil {
+					return "", err
+				}
+				for i := range results {
+					results[i].Content = pii.Redact(results[i].Content)
+				}
+				results = d.screenRetrievedChunks(ctx, apiKey, userId, sessionId, results)
+				if len(results) == 0 {
+					return "No matching documents found.", nil
+				}
+				return fenceDocuments(results), nil
+			},
+		})
+	}
+
+	registry.Register(Tool{
+		Name:        "current_datetime",
+		Description: "Get the current date and time, optionally in a given IANA time zone such as Asia/Kolkata.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"timezone": map[string]interface{}{"type": "string", "description": "IANA time zone name, defaults to UTC"},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+			loc := time.UTC
+			if tz, _ := args["timezone"].(string); tz != "" {
+				l, err := time.LoadLocation(tz)
+				if err != nil {
+					return "", fmt.Errorf("unknown time zone %q", tz)
+				}
+				loc = l
+			}
+			return d.Now().In(loc).Format("Monday, 2 January 2006 15:04:05 MST"), nil
+		},
+	})
+
+	registry.Register(Tool{
+		Name:        "calculator",
+		Description: "Evaluate an arithmetic expression with + - * / ^ %, parentheses and decimals.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"expression": map[string]interface{}{"type": "string", "description": "For example (12.5 * 4) / 3"},
+			},
+			"required": []string{"expression"},
+		},
+		Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+			expr, _ := args["expression"].(string)
+			value, err := evaluateExpression(expr)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatFloat(value, 'g', 12, 64), nil
+		},
+	})
+
+	if apis := internalAPIs(tenantFrom(ctx)); len(apis) > 0 {
+		names := make([]string, 0, len(apis))
+		for name := range apis {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		registry.Register(Tool{
+			Name:        "call_internal_api",
+			Description: "Send a GET request to one of the company's internal HTTP APIs and return the response body.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"api":   map[string]interface{}{"type": "string", "enum": names},
+					"path":  map[string]interface{}{"type": "string", "description": "Path under the API base URL, e.g. /orders/123"},
+					"query": map[string]interface{}{"type": "object", "description": "Query string parameters"},
+				},
+				"required": []string{"api"},
+			},
+			// Arguments keep their PII placeholders: the model writes them
+			// and may copy in values from other people's documents
+			Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+				return callInternalAPI(ctx, apis, internalAPICaller{TenantId: scope.TenantId, UserId: userId}, args)
+			},
+		})
+	}
+
+	return registry
+}
+
+// internalAPIs reads the allowlist of internal APIs from INTERNAL_APIS, a
+// comma separated list of name=baseURL pairs, and keeps those the tenant may
+// call. Only these hosts can be called.
+func internalAPIs(t Tenant) map[string]string {
+	allowed := map[string]bool{}
+	for _, name := range t.InternalAPIs {
+		allowed[name] = true
+	}
+	apis := map[string]string{}
+	for _, entry := range strings.Split(envOrDefault("INTERNAL_APIS", ""), ",") {
+		name, base, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && name != "" && base != "" && (t.Id == DefaultTenant || allowed[name]) {
+			apis[name] = strings.TrimRight(base, "/")
+		}
+	}
+	return apis
+}
+
+// internalAPICaller is who a call_internal_api request is made for. It is
+// sent along so the API authorizes the user, not the assistant.
+type internalAPICaller struct {
+	TenantId string
+	UserId   string // scoped, as stored
+}
+
+// internalAPIClient never follows redirects, which could leave the
+// allowlisted host.
+var internalAPIClient = &http.Client{
+	Timeout: time.Duration(ToolTimeoutSeconds) * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// internalAPIPath decodes and checks a model-chosen path, so that neither
+// literal nor percent-encoded traversal can climb out of the API base path.
+func internalAPIPath(raw string) (string, error) {
+	decoded, err := url.PathUnescape(raw)
+	// A % left after decoding is double encoding, which the API might decode again
+	if err != nil || strings.ContainsAny(decoded, "%\\?#") {
+		return "", fmt.Errorf("invalid path")
+	}
+	if decoded == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(decoded, "/") {
+		decoded = "/" + decoded
+	}
+	cleaned := path.Clean(decoded)
+	if strings.HasSuffix(decoded, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != decoded {
+		return "", fmt.Errorf("invalid path")
+	}
+	return decoded, nil
+}
+
+func callInternalAPI(ctx context.Context, apis map[string]string, caller internalAPICaller, args map[string]interface{}) (string, error) {
+	name, _ := args["api"].(string)
+	base, ok := apis[name]
+	if !ok {
+		return "", fmt.Errorf("unknown API %q", name)
+	}
+
+	rawPath, _ := args["path"].(string)
+	apiPath, err := internalAPIPath(rawPath)
+	if err != nil {
+		return "", err
+	}
+	target, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	target.Path = strings.TrimRight(target.Path, "/") + apiPath
+	target.RawPath = ""
+	if query, ok := args["query"].(map[string]interface{}); ok {
+		q := url.Values{}
+		for k, v := range query {
+			q.Set(k, fmt.Sprint(v))
+		}
+		target.RawQuery = q.Encode()
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Tenant-Id", caller.TenantId)
+	req.Header.Set("X-User-Id", caller.UserId)
+	resp, err := internalAPIClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, ToolMaxResponseBytes))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("API returned status %d: %s", resp.StatusCode, body)
+	}
+	return string(body), nil
+}
+
+// evaluateExpression is a small recursive-descent evaluator so the calculator
+// tool never hands model output to anything that can execute code.
+func evaluateExpression(expr string) (float64, error) {
+	p := &exprParser{input: strings.TrimSpace(expr)}
+	if p.input == "" {
+		return 0, fmt.Errorf("expression is required")
+	}
+	value, err := p.parseSum()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("result is not a finite number")
+	}
+	return value, nil
+}
+
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseSum() (float64, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			left += right
+		} else {
+			left -= right
+		}
+	}
+}
+
+func (p *exprParser) parseProduct() (float64, error) {
+	left, err := p.parsePower()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parsePower()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			left *= right
+		case '/':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left /= right
+		case '%':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left = math.Mod(left, right)
+		}
+	}
+}
+
+func (p *exprParser) parsePower() (float64, error) {
+	base, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	// Right associative: 2^3^2 == 2^(3^2)
+	exponent, err := p.parsePower()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (p *exprParser) parseUnary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.parseUnary()
+		return -v, err
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (float64, error) {
+	if p.peek() == '(' {
+		p.pos++
+		v, err := p.parseSum()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return v, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos < len(p.input) {
+			return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+		}
+		return 0, fmt.Errorf("unexpected end of expression")
+	}
+	return strconv.ParseFloat(p.input[start:p.pos], 64)
+}
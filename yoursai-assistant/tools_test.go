@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shared/redact"
+)
+
+// internalAPIServer records the requests the call_internal_api tool sends.
+type internalAPIServer struct {
+	*httptest.Server
+	requests []*http.Request
+}
+
+func newInternalAPIServer(t *testing.T) *internalAPIServer {
+	t.Helper()
+	s := &internalAPIServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests = append(s.requests, r)
+		if r.URL.Path == "/api/moved" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestCallInternalAPIStaysUnderTheBasePath(t *testing.T) {
+	server := newInternalAPIServer(t)
+	apis := map[string]string{"orders": server.URL + "/api"}
+	caller := internalAPICaller{TenantId: "acme", UserId: "acme#user-1"}
+
+	for _, path := range []string{
+		"/../admin",
+		"/orders/../../admin",
+		"/%2e%2e/admin",
+		"/%2E%2E%2fadmin",
+		"/orders%2f..%2f..%2fadmin",
+		"/%252e%252e/admin",
+		"//evil.example.com/x",
+		`/..\admin`,
+		"/orders/./123",
+	} {
+		t.Run(path, func(t *testing.T) {
+			_, err := callInternalAPI(context.Background(), apis, caller, map[string]interface{}{"api": "orders", "path": path})
+			if err == nil {
+				t.Error("want the path rejected")
+			}
+		})
+	}
+	if len(server.requests) != 0 {
+		t.Errorf("requests = %d, want none for rejected paths", len(server.requests))
+	}
+
+	body, err := callInternalAPI(context.Background(), apis, caller, map[string]interface{}{
+		"api": "orders", "path": "orders/123", "query": map[string]interface{}{"expand": "items"},
+	})
+	if err != nil || body != `{"ok": true}` {
+		t.Fatalf("body = %q, %v", body, err)
+	}
+	got := server.requests[0]
+	if got.URL.Path != "/api/orders/123" || got.URL.Query().Get("expand") != "items" {
+		t.Errorf("request = %s", got.URL)
+	}
+	if got.Header.Get("X-Tenant-Id") != "acme" || got.Header.Get("X-User-Id") != "acme#user-1" {
+		t.Errorf("identity headers = %q/%q, want the caller's", got.Header.Get("X-Tenant-Id"), got.Header.Get("X-User-Id"))
+	}
+}
+
+func TestCallInternalAPIDoesNotFollowRedirects(t *testing.T) {
+	server := newInternalAPIServer(t)
+	apis := map[string]string{"orders": server.URL + "/api"}
+
+	_, err := callInternalAPI(context.Background(), apis, internalAPICaller{}, map[string]interface{}{"api": "orders", "path": "/moved"})
+	if err == nil || !strings.Contains(err.Error(), "302") {
+		t.Errorf("err = %v, want the redirect reported, not followed", err)
+	}
+	if len(server.requests) != 1 {
+		t.Errorf("requests = %d, want 1", len(server.requests))
+	}
+}
+
+func TestInternalAPIsAreLimitedToTheTenant(t *testing.T) {
+	t.Setenv("INTERNAL_APIS", "orders=https://orders.internal, hr=https://hr.internal/")
+
+	if got := internalAPIs(Tenant{Id: DefaultTenant}); len(got) != 2 || got["hr"] != "https://hr.internal" {
+		t.Errorf("default tenant APIs = %v, want both", got)
+	}
+	acme := Tenant{Id: "acme", Config: TenantConfig{InternalAPIs: []string{"orders", "billing"}}}
+	if got := internalAPIs(acme); len(got) != 1 || got["orders"] == "" {
+		t.Errorf("acme APIs = %v, want only orders", got)
+	}
+	if got := internalAPIs(Tenant{Id: "globex"}); len(got) != 0 {
+		t.Errorf("unlisted tenant APIs = %v, want none", got)
+	}
+}
+
+func TestInternalAPIToolKeepsPIIMasked(t *testing.T) {
+	server := newInternalAPIServer(t)
+	t.Setenv("INTERNAL_APIS", "orders="+server.URL)
+	pii := redact.NewVault(true)
+	masked := pii.Redact("jane.doe@example.com")
+
+	d := &Deps{Now: func() time.Time { return testNow }}
+	tools := d.buildDefaultTools(context.Background(), "key", "user-1", "s1", SearchScope{TenantId: DefaultTenant}, false, pii)
+	tools.Call(context.Background(), ToolCall{Name: "call_internal_api", Args: map[string]interface{}{
+		"api": "orders", "path": "/customers/" + masked,
+	}})
+
+	if len(server.requests) != 1 {
+		t.Fatalf("requests = %d, want 1", len(server.requests))
+	}
+	if got := server.requests[0].URL.Path; got != "/customers/"+masked {
+		t.Errorf("path sent = %q, want the placeholder %q", got, masked)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IngestRequest and IngestResponse mirror the ingest API's JSON.
+type IngestRequest struct {
+	DocumentName string `json:"documentName"`
+	Text         string `json:"text"`
+	CollectionId string `json:"collectionId,omitempty"`
+	DocumentId   string `json:"documentId"`
+}
+
+type IngestResponse struct {
+	Message      string `json:"message"`
+	DocumentId   string `json:"documentId"`
+	CollectionId string `json:"collectionId"`
+	Chunks       int    `json:"chunks"`
+	Quarantined  int    `json:"quarantined,omitempty"`
+}
+
+// Errors that end the whole run rather than one file.
+var (
+	errUnauthorized   = errors.New("the API rejected the token; sign in again and pass a fresh one")
+	errForbidden      = errors.New("the API refused the upload; you need the owner or editor role on the -collection")
+	errQuotaExhausted = errors.New("the API asked to wait longer than the retry limit; the token quota is probably spent")
+)
+
+// apiError is a response the client gave up on.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API returned %d: %s", e.Status, e.Message)
+}
+
+// Client calls the ingest API with a user's ID token.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	sleep   func(ctx context.Context, d time.Duration) error
+}
+
+func newClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   strings.TrimPrefix(strings.TrimSpace(token), "Bearer "),
+		http:    &http.Client{Timeout: HTTPTimeout * time.Second},
+		sleep:   sleepContext,
+	}
+}
+
+// Ingest uploads one document to a collection, or to the caller's personal
+// collection when collection is empty. Every upload of a file carries the
+// same document ID, which the API stores in place of the file's earlier
+// chunks, so rate limiting, server errors, gateway timeouts and dropped
+// connections are all safe to retry even when the server may have
+// committed the first attempt.
+func (c *Client) Ingest(ctx context.Context, collection, name, text string) (IngestResponse, error) {
+	body, err := json.Marshal(IngestRequest{DocumentName: name, Text: text, CollectionId: collection, DocumentId: documentID(collection, name)})
+	if err != nil {
+		return IngestResponse{}, err
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= MaxAttempts; attempt++ {
+		if attempt > 1 {
+			if err := c.sleep(ctx, retryDelay(lastErr, attempt)); err != nil {
+				return IngestResponse{}, err
+			}
+		}
+		var resp IngestResponse
+		resp, lastErr = c.post(ctx, body)
+		if lastErr == nil {
+			return resp, nil
+		}
+		if !retryable(lastErr) {
+			return IngestResponse{}, lastErr
+		}
+	}
+	return IngestResponse{}, lastErr
+}
+
+// documentID names a file in a collection the same way on every run.
+func documentID(collection, name string) string {
+	sum := sha256.Sum256([]byte(collection + "\x00" + name))
+	return "bulk-" + hex.EncodeToString(sum[:16])
+}
+
+// throttled is a 429 we are willing to wait out.
+type throttled struct {
+	retryAfter time.Duration
+}
+
+func (t *throttled) Error() string {
+	return fmt.Sprintf("rate limited; retry after %s", t.retryAfter)
+}
+
+func (c *Client) post(ctx context.Context, body []byte) (IngestResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+IngestEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return IngestResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return IngestResponse{}, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return IngestResponse{}, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var out IngestResponse
+		if err := json.Unmarshal(raw, &out); err != nil {
+			return IngestResponse{}, fmt.Errorf("invalid API response: %w", err)
+		}
+		return out, nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		return IngestResponse{}, errUnauthorized
+	case resp.StatusCode == http.StatusForbidden:
+		return IngestResponse{}, errForbidden
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if wait > MaxRetryAfter {
+			return IngestResponse{}, errQuotaExhausted
+		}
+		return IngestResponse{}, &throttled{retryAfter: time.Duration(wait) * time.Second}
+	}
+	var payload struct {
+		Error string `json:"error"`
+	}
+	message := strings.TrimSpace(string(raw))
+	if json.Unmarshal(raw, &payload) == nil && payload.Error != "" {
+		message = payload.Error
+	}
+	return IngestResponse{}, &apiError{Status: resp.StatusCode, Message: message}
+}
+
+func retryable(err error) bool {
+	var t *throttled
+	if errors.As(err, &t) {
+		return true
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status >= 500
+	}
+	// Transport errors; the fatal sentinels and cancellation are final
+	return !errors.Is(err, errUnauthorized) && !errors.Is(err, errForbidden) &&
+		!errors.Is(err, errQuotaExhausted) && !errors.Is(err, context.Canceled)
+}
+
+// retryDelay honours Retry-After and otherwise backs off exponentially with
+// full jitter.
+func retryDelay(err error, attempt int) time.Duration {
+	var t *throttled
+	if errors.As(err, &t) && t.retryAfter > 0 {
+		return t.retryAfter
+	}
+	ceiling := time.Duration(RetryBaseDelayMs<<(attempt-2)) * time.Millisecond
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "os"
+
+const (
+	// Ingest API
+	IngestEndpoint  = "/ingest"
+	HTTPTimeout     = 60              // seconds; large documents embed chunk by chunk
+	MaxDocumentSize = 5 * 1024 * 1024 // the API rejects anything larger with 413
+
+	// Chunking, for --dry-run estimates; matches yoursai-ingest
+	MaxTokensPerChunk = 500
+
+	// Concurrency and retries. The API allows each user a handful of ingests
+	// per minute, so extra workers mostly wait out Retry-After.
+	DefaultConcurrency = 4
+	MaxAttempts        = 5
+	RetryBaseDelayMs   = 1000
+	MaxRetryAfter      = 120 // seconds; a longer wait (a spent token quota) stops the run
+
+	// Progress for --resume, kept next to where the command runs
+	DefaultStateFile = ".yoursai-ingest-state.json"
+)
+
+// envOrDefault lets a run pick up settings from the environment.
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// extractor turns a file's bytes into the plain text the API ingests.
+type extractor func(data []byte) (string, error)
+
+var extractors = map[string]extractor{
+	".txt":      extractPlain,
+	".md":       extractPlain,
+	".markdown": extractPlain,
+	".csv":      extractPlain,
+	".json":     extractPlain,
+	".html":     extractHTML,
+	".htm":      extractHTML,
+	".docx":     extractDocx,
+}
+
+// extractorFor returns nil for a format we cannot read.
+func extractorFor(name string) extractor {
+	return extractors[strings.ToLower(path.Ext(name))]
+}
+
+func extractPlain(data []byte) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("not valid UTF-8 text")
+	}
+	return string(data), nil
+}
+
+var (
+	htmlDropPattern  = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>|<!--.*?-->`)
+	htmlBlockPattern = regexp.MustCompile(`(?i)<\s*(br|/p|/div|/li|/h[1-6]|/tr)\b[^>]*>`)
+	htmlTagPattern   = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinePattern = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+)
+
+// extractHTML keeps the visible text, with a line break per block element.
+func extractHTML(data []byte) (string, error) {
+	text, err := extractPlain(data)
+	if err != nil {
+		return "", err
+	}
+	text = htmlDropPattern.ReplaceAllString(text, "")
+	text = htmlBlockPattern.ReplaceAllString(text, "\n")
+	text = htmlTagPattern.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	return strings.TrimSpace(blankLinePattern.ReplaceAllString(text, "\n\n")), nil
+}
+
+// extractDocx reads the body text of a Word document, one line per
+// paragraph.
+func extractDocx(data []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("not a .docx archive: %w", err)
+	}
+	for _, f := range archive.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		return docxText(rc)
+	}
+	return "", fmt.Errorf("no word/document.xml in archive")
+}
+
+func docxText(r io.Reader) (string, error) {
+	var b strings.Builder
+	decoder := xml.NewDecoder(r)
+	inText := false
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				b.WriteString("\t")
+			case "br":
+				b.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				b.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				b.Write(t)
+			}
+		}
+	}
+	return strings.TrimSpace(b.String()), nil
+}
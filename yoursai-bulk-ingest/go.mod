@@ -0,0 +1,7 @@
+module yoursai-bulk-ingest
+
+go 1.21
+
+require shared v0.0.0
+
+replace shared => ../shared
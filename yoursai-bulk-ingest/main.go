@@ -0,0 +1,290 @@
+// Command yoursai-bulk-ingest uploads a directory of documents to the
+// knowledge base through the ingest API:
+//
+//	yoursai-bulk-ingest -api-url https://api.example.com -token-file token.txt \
+//		-include '*.md' -exclude 'drafts/**' ./handbook
+//
+// Progress is saved after every upload, so re-running the same command after
+// a failure or an interruption only sends what is left. -dry-run lists the
+// files and the chunks they would make without calling the API.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"shared/chunker"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "yoursai-bulk-ingest:", err)
+		os.Exit(1)
+	}
+}
+
+// listFlag collects a repeatable, comma-separable flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// options are the parsed command line.
+type options struct {
+	root        string
+	apiURL      string
+	collection  string
+	token       string
+	include     listFlag
+	exclude     listFlag
+	concurrency int
+	statePath   string
+	fresh       bool
+	dryRun      bool
+}
+
+func parseOptions(args []string) (options, error) {
+	var o options
+	var tokenFile string
+	fs := flag.NewFlagSet("yoursai-bulk-ingest", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: yoursai-bulk-ingest [flags] DIR")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&o.apiURL, "api-url", envOrDefault("YOURSAI_API_URL", ""), "API base URL (default $YOURSAI_API_URL)")
+	fs.StringVar(&o.token, "token", envOrDefault("YOURSAI_TOKEN", ""), "Cognito ID token, as the web app sends it (default $YOURSAI_TOKEN)")
+	fs.StringVar(&tokenFile, "token-file", "", "read the token from this file instead")
+	fs.StringVar(&o.collection, "collection", "", "collection ID to ingest into (default your personal collection)")
+	fs.Var(&o.include, "include", "only upload files matching this glob; repeatable")
+	fs.Var(&o.exclude, "exclude", "skip files and directories matching this glob; repeatable")
+	fs.IntVar(&o.concurrency, "concurrency", DefaultConcurrency, "uploads in flight at once")
+	fs.StringVar(&o.statePath, "state", DefaultStateFile, "progress file used to resume")
+	fs.BoolVar(&o.fresh, "fresh", false, "ignore earlier progress and upload everything")
+	fs.BoolVar(&o.dryRun, "dry-run", false, "show the files and chunk counts without uploading")
+	if err := fs.Parse(args); err != nil {
+		return o, err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return o, fmt.Errorf("expected one directory, got %d arguments", fs.NArg())
+	}
+	o.root = fs.Arg(0)
+	if o.concurrency < 1 {
+		return o, fmt.Errorf("-concurrency must be at least 1")
+	}
+	if tokenFile != "" {
+		raw, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return o, err
+		}
+		o.token = strings.TrimSpace(string(raw))
+	}
+	if !o.dryRun && (o.apiURL == "" || o.token == "") {
+		return o, fmt.Errorf("-api-url and a token are required unless -dry-run is set")
+	}
+	return o, nil
+}
+
+// document is a file read and extracted, ready to upload.
+type document struct {
+	File
+	text   string
+	sha256 string
+}
+
+// prepare reads and extracts one file. A non-nil error means it cannot be
+// uploaded at all.
+func prepare(f File) (document, error) {
+	if f.Size > MaxDocumentSize {
+		return document{}, fmt.Errorf("larger than the %d MB limit", MaxDocumentSize/(1024*1024))
+	}
+	raw, err := os.ReadFile(f.Path)
+	if err != nil {
+		return document{}, err
+	}
+	text, err := extractorFor(f.Name)(raw)
+	if err != nil {
+		return document{}, fmt.Errorf("extracting text: %w", err)
+	}
+	if strings.TrimSpace(text) == "" {
+		return document{}, fmt.Errorf("no text to ingest")
+	}
+	if len(text) > MaxDocumentSize {
+		return document{}, fmt.Errorf("extracted text is larger than the %d MB limit", MaxDocumentSize/(1024*1024))
+	}
+	sum := sha256.Sum256([]byte(text))
+	return document{File: f, text: text, sha256: hex.EncodeToString(sum[:])}, nil
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer) error {
+	o, err := parseOptions(args)
+	if err != nil {
+		return err
+	}
+	files, err := walkDocuments(o.root, o.include, o.exclude)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no supported files under %s", o.root)
+	}
+
+	state := &State{path: o.statePath, Documents: map[string]DocumentState{}}
+	if !o.fresh {
+		if state, err = loadState(o.statePath); err != nil {
+			return fmt.Errorf("reading %s: %w", o.statePath, err)
+		}
+	}
+
+	if o.dryRun {
+		return dryRun(stdout, files, state, o.collection)
+	}
+	return upload(ctx, stdout, newClient(o.apiURL, o.token), files, state, o.collection, o.concurrency)
+}
+
+func dryRun(w io.Writer, files []File, state *State, collection string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "file\tchunks\tnote")
+	var uploads, chunks, skipped, failed int
+	for _, f := range files {
+		doc, err := prepare(f)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(tw, "%s\t-\t%v\n", f.Name, err)
+		case state.ingested(doc.Name, doc.sha256, collection):
+			skipped++
+			fmt.Fprintf(tw, "%s\t-\talready ingested\n", f.Name)
+		default:
+			n := len(chunker.Split(doc.text, MaxTokensPerChunk))
+			uploads++
+			chunks += n
+			fmt.Fprintf(tw, "%s\t%d\t\n", f.Name, n)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nwould upload %d files as %d chunks; %d already ingested, %d cannot be uploaded\n", uploads, chunks, skipped, failed)
+	return nil
+}
+
+// upload sends files through a worker pool. A rejected token, a collection
+// the caller cannot write to or a spent quota stops the run; anything else
+// fails just that file.
+func upload(ctx context.Context, w io.Writer, client *Client, files []File, state *State, collection string, concurrency int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu                                          sync.Mutex
+		done, ingested, skipped, unreadable, failed int
+		chunks                                      int
+		fatal                                       error
+	)
+	// report counts a finished file under counter and prints its line
+	report := func(counter *int, format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		*counter++
+		done++
+		fmt.Fprintf(w, "[%d/%d] "+format+"\n", append([]interface{}{done, len(files)}, args...)...)
+	}
+
+	jobs := make(chan File)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				doc, err := prepare(f)
+				if err != nil {
+					report(&unreadable, "skip %s: %v", f.Name, err)
+					continue
+				}
+				if state.ingested(doc.Name, doc.sha256, collection) {
+					report(&skipped, "done %s (already ingested)", f.Name)
+					continue
+				}
+				resp, err := client.Ingest(ctx, collection, doc.Name, doc.text)
+				if err != nil {
+					switch {
+					case errors.Is(err, errUnauthorized), errors.Is(err, errForbidden), errors.Is(err, errQuotaExhausted):
+						mu.Lock()
+						if fatal == nil {
+							fatal = err
+						}
+						mu.Unlock()
+						cancel()
+					case ctx.Err() != nil:
+						// Interrupted, not failed; the next run picks it up
+						continue
+					}
+					report(&failed, "FAIL %s: %v", f.Name, err)
+					continue
+				}
+				if err := state.record(doc.Name, DocumentState{
+					SHA256:      doc.sha256,
+					Collection:  collection,
+					Chunks:      resp.Chunks,
+					Quarantined: resp.Quarantined,
+					IngestedAt:  time.Now().UTC(),
+				}); err != nil {
+					fmt.Fprintf(os.Stderr, "warning: could not save progress: %v\n", err)
+				}
+				note := ""
+				if resp.Quarantined > 0 {
+					note = fmt.Sprintf(", %d quarantined", resp.Quarantined)
+				}
+				mu.Lock()
+				chunks += resp.Chunks
+				mu.Unlock()
+				report(&ingested, "ok   %s (%d chunks%s)", f.Name, resp.Chunks, note)
+			}
+		}()
+	}
+
+feed:
+	for _, f := range files {
+		select {
+		case jobs <- f:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	pending := len(files) - ingested - skipped - unreadable - failed
+	fmt.Fprintf(w, "\ningested %d files as %d chunks; %d already ingested, %d unreadable, %d failed, %d not attempted\n",
+		ingested, chunks, skipped, unreadable, failed, pending)
+	switch {
+	case fatal != nil:
+		return fatal
+	case ctx.Err() != nil:
+		return fmt.Errorf("interrupted; run the same command again to resume")
+	case failed > 0:
+		return fmt.Errorf("%d files failed; run the same command again to retry them", failed)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shared/chunker"
+)
+
+// fakeIngestAPI answers like the ingest Lambda. respond picks the reply for
+// a document; nil means 200 with one chunk per 375 words.
+type fakeIngestAPI struct {
+	mu       sync.Mutex
+	uploads  []IngestRequest
+	auth     []string
+	respond  func(req IngestRequest, attempt int) (int, map[string]string)
+	attempts map[string]int
+}
+
+func newFakeIngestAPI(t *testing.T) (*fakeIngestAPI, string) {
+	api := &fakeIngestAPI{attempts: map[string]int{}}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return api, server.URL
+}
+
+func (f *fakeIngestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req IngestRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	f.mu.Lock()
+	f.uploads = append(f.uploads, req)
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	f.attempts[req.DocumentName]++
+	attempt, respond := f.attempts[req.DocumentName], f.respond
+	f.mu.Unlock()
+
+	status, headers := http.StatusOK, map[string]string(nil)
+	if respond != nil {
+		status, headers = respond(req, attempt)
+	}
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(status)
+	if status != http.StatusOK {
+		json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(status)})
+		return
+	}
+	json.NewEncoder(w).Encode(IngestResponse{Message: "Document ingested successfully", Chunks: len(chunker.Split(req.Text, MaxTokensPerChunk))})
+}
+
+func (f *fakeIngestAPI) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, u := range f.uploads {
+		names = append(names, u.DocumentName)
+	}
+	return names
+}
+
+func newCorpus(t *testing.T) string {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a.md"), "Annual leave is twenty five days.")
+	writeFile(t, filepath.Join(root, "b.md"), strings.Repeat("expenses ", 800))
+	writeFile(t, filepath.Join(root, "sub/c.txt"), "The service desk is on the second floor.")
+	return root
+}
+
+func TestDryRunCountsChunksWithoutCallingTheAPI(t *testing.T) {
+	root := newCorpus(t)
+	writeFile(t, filepath.Join(root, "empty.md"), "   \n")
+	var out bytes.Buffer
+	err := run(context.Background(), []string{"-dry-run", "-state", filepath.Join(t.TempDir(), "state.json"), root}, &out)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	text := strings.Join(strings.Fields(out.String()), " ")
+	for _, want := range []string{"b.md 3", "empty.md - no text to ingest", "would upload 3 files as 5 chunks; 0 already ingested, 1 cannot be uploaded"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestUploadResumesAfterFailures(t *testing.T) {
+	root := newCorpus(t)
+	state := filepath.Join(t.TempDir(), "state.json")
+	api, url := newFakeIngestAPI(t)
+	api.respond = func(req IngestRequest, attempt int) (int, map[string]string) {
+		if req.DocumentName == "b.md" {
+			return http.StatusBadRequest, nil
+		}
+		return http.StatusOK, nil
+	}
+	args := []string{"-api-url", url + "/", "-token", "Bearer id-token", "-concurrency", "2", "-state", state, root}
+
+	var out bytes.Buffer
+	err := run(context.Background(), args, &out)
+	if err == nil || !strings.Contains(err.Error(), "1 files failed") {
+		t.Fatalf("first run err = %v, want one failure\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "FAIL b.md: API returned 400: Bad Request") {
+		t.Errorf("output does not explain the failure:\n%s", out.String())
+	}
+	for _, auth := range api.auth {
+		if auth != "Bearer id-token" {
+			t.Errorf("Authorization = %q", auth)
+		}
+	}
+	ids := map[string]string{}
+	for _, u := range api.uploads {
+		ids[u.DocumentName] = u.DocumentId
+	}
+	if ids["a.md"] == "" || ids["a.md"] == ids["sub/c.txt"] {
+		t.Errorf("document IDs = %v, want one per file", ids)
+	}
+
+	// Fixed on the server side; only b.md goes again
+	api.respond = nil
+	api.uploads = nil
+	out.Reset()
+	if err := run(context.Background(), args, &out); err != nil {
+		t.Fatalf("second run: %v\n%s", err, out.String())
+	}
+	if got := api.names(); len(got) != 1 || got[0] != "b.md" {
+		t.Errorf("second run uploaded %v, want only b.md", got)
+	}
+	if !strings.Contains(out.String(), "ingested 1 files as 3 chunks; 2 already ingested") {
+		t.Errorf("summary:\n%s", out.String())
+	}
+
+	// A changed file is uploaded again under its old ID, so the API
+	// replaces it rather than storing it twice
+	writeFile(t, filepath.Join(root, "a.md"), "Annual leave is thirty days.")
+	api.uploads = nil
+	if err := run(context.Background(), args, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.names(); len(got) != 1 || got[0] != "a.md" {
+		t.Errorf("third run uploaded %v, want only the changed a.md", got)
+	}
+	if got := api.uploads[0].DocumentId; got != ids["a.md"] {
+		t.Errorf("changed a.md sent document ID %q, want %q", got, ids["a.md"])
+	}
+}
+
+func TestUploadStopsWhenTheTokenIsRejected(t *testing.T) {
+	api, url := newFakeIngestAPI(t)
+	api.respond = func(IngestRequest, int) (int, map[string]string) { return http.StatusUnauthorized, nil }
+
+	err := run(context.Background(), []string{"-api-url", url, "-token", "expired", "-concurrency", "1", "-state", filepath.Join(t.TempDir(), "s.json"), newCorpus(t)}, &bytes.Buffer{})
+	if !errors.Is(err, errUnauthorized) {
+		t.Fatalf("err = %v, want errUnauthorized", err)
+	}
+	if got := len(api.names()); got != 1 {
+		t.Errorf("uploads after a 401 = %d, want the run to stop at 1", got)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		respond      func(attempt int) (int, map[string]string)
+		wantErr      error
+		wantAttempts int
+		wantSleeps   []time.Duration
+	}{
+		{
+			name: "waits out Retry-After",
+			respond: func(attempt int) (int, map[string]string) {
+				if attempt == 1 {
+					return http.StatusTooManyRequests, map[string]string{"Retry-After": "7"}
+				}
+				return http.StatusOK, nil
+			},
+			wantAttempts: 2,
+			wantSleeps:   []time.Duration{7 * time.Second},
+		},
+		{
+			name: "retries a server error",
+			respond: func(attempt int) (int, map[string]string) {
+				if attempt < 3 {
+					return http.StatusServiceUnavailable, nil
+				}
+				return http.StatusOK, nil
+			},
+			wantAttempts: 3,
+		},
+		{
+			name:         "gives up after MaxAttempts",
+			respond:      func(int) (int, map[string]string) { return http.StatusInternalServerError, nil },
+			wantErr:      &apiError{},
+			wantAttempts: MaxAttempts,
+		},
+		{
+			name: "retries a gateway timeout",
+			respond: func(attempt int) (int, map[string]string) {
+				if attempt == 1 {
+					return http.StatusGatewayTimeout, nil
+				}
+				return http.StatusOK, nil
+			},
+			wantAttempts: 2,
+		},
+		{
+			name:         "does not retry a bad request",
+			respond:      func(int) (int, map[string]string) { return http.StatusRequestEntityTooLarge, nil },
+			wantErr:      &apiError{},
+			wantAttempts: 1,
+		},
+		{
+			name:         "stops on a collection it cannot write to",
+			respond:      func(int) (int, map[string]string) { return http.StatusForbidden, nil },
+			wantErr:      errForbidden,
+			wantAttempts: 1,
+		},
+		{
+			name: "stops on a spent quota",
+			respond: func(int) (int, map[string]string) {
+				return http.StatusTooManyRequests, map[string]string{"Retry-After": "3600"}
+			},
+			wantErr:      errQuotaExhausted,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, url := newFakeIngestAPI(t)
+			api.respond = func(_ IngestRequest, attempt int) (int, map[string]string) { return tt.respond(attempt) }
+			client := newClient(url, "token")
+			var sleeps []time.Duration
+			client.sleep = func(ctx context.Context, d time.Duration) error {
+				sleeps = append(sleeps, d)
+				return nil
+			}
+
+			_, err := client.Ingest(context.Background(), "", "doc.md", "text")
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("Ingest: %v", err)
+				}
+			case *apiError:
+				var got *apiError
+				if !errors.As(err, &got) {
+					t.Fatalf("err = %v, want an API error", err)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Fatalf("err = %v, want %v", err, want)
+				}
+			}
+			if got := len(api.names()); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+			// Retries carry the first attempt's document ID
+			for _, u := range api.uploads {
+				if u.DocumentId != api.uploads[0].DocumentId {
+					t.Errorf("document IDs differ across attempts: %q and %q", u.DocumentId, api.uploads[0].DocumentId)
+				}
+			}
+			if tt.wantSleeps != nil && (len(sleeps) != len(tt.wantSleeps) || sleeps[0] != tt.wantSleeps[0]) {
+				t.Errorf("sleeps = %v, want %v", sleeps, tt.wantSleeps)
+			}
+		})
+	}
+}
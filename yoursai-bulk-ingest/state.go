@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// State is the run's progress file. Only successful uploads are recorded,
+// so re-running the command retries whatever failed or never started, and
+// a file whose content changed since it was ingested is uploaded again,
+// replacing the chunks stored from the old content.
+type State struct {
+	mu        sync.Mutex
+	path      string
+	Documents map[string]DocumentState `json:"documents"`
+}
+
+// DocumentState is one ingested file.
+type DocumentState struct {
+	SHA256      string    `json:"sha256"`
+	Collection  string    `json:"collection,omitempty"` // "" is the personal collection
+	Chunks      int       `json:"chunks"`
+	Quarantined int       `json:"quarantined,omitempty"`
+	IngestedAt  time.Time `json:"ingestedAt"`
+}
+
+// loadState reads the progress file; a missing file is an empty state.
+func loadState(path string) (*State, error) {
+	s := &State{path: path, Documents: map[string]DocumentState{}}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, s); err != nil {
+		return nil, err
+	}
+	if s.Documents == nil {
+		s.Documents = map[string]DocumentState{}
+	}
+	return s, nil
+}
+
+// ingested reports whether name was uploaded to collection with exactly
+// this content.
+func (s *State) ingested(name, sum, collection string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.Documents[name]
+	return ok && doc.SHA256 == sum && doc.Collection == collection
+}
+
+// record saves a successful upload and rewrites the file, via a rename so
+// an interrupted run never leaves it half written.
+func (s *State) record(name string, doc DocumentState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Documents[name] = doc
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".yoursai-ingest-state-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(raw, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"*.md", "guide.md", true},
+		{"*.md", "docs/deep/guide.md", true}, // no slash: base name anywhere
+		{"*.md", "guide.txt", false},
+		{"docs/*.md", "docs/guide.md", true},
+		{"docs/*.md", "docs/deep/guide.md", false},
+		{"docs/**/*.md", "docs/guide.md", true},
+		{"docs/**/*.md", "docs/a/b/guide.md", true},
+		{"drafts/**", "drafts/x/y.md", true},
+		{"drafts/**", "published/drafts.md", false},
+		{"./docs/*.md", "docs/guide.md", true},
+		{"**/secret*", "a/b/secret-plan.md", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestWalkDocumentsAppliesGlobs(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"handbook.md", "notes.txt", "scan.pdf", "site/index.html",
+		"drafts/wip.md", "node_modules/pkg/readme.md", "policies/leave.md",
+	} {
+		writeFile(t, filepath.Join(root, name), "text")
+	}
+
+	tests := []struct {
+		name             string
+		include, exclude []string
+		want             []string
+	}{
+		{"every supported file", nil, nil, []string{"drafts/wip.md", "handbook.md", "node_modules/pkg/readme.md", "notes.txt", "policies/leave.md", "site/index.html"}},
+		{"excluded directories", nil, []string{"node_modules", "drafts/**"}, []string{"handbook.md", "notes.txt", "policies/leave.md", "site/index.html"}},
+		{"include and exclude", []string{"*.md"}, []string{"node_modules"}, []string{"drafts/wip.md", "handbook.md", "policies/leave.md"}},
+		{"path include", []string{"policies/**"}, nil, []string{"policies/leave.md"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := walkDocuments(root, tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range files {
+				got = append(got, f.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{"markdown with BOM", "a.md", []byte("\xef\xbb\xbf# Title\nBody"), "# Title\nBody", false},
+		{"binary posing as text", "a.txt", []byte{0xff, 0xfe, 0x00}, "", true},
+		{
+			"html",
+			"a.html",
+			[]byte("<html><head><title>T</title><style>p{}</style></head><body><h1>Leave</h1><p>25 days &amp; holidays</p><script>x()</script></body></html>"),
+			"Leave\n25 days & holidays",
+			false,
+		},
+		{"docx", "a.docx", docxWith(t, `<w:p><w:r><w:t>First</w:t></w:r><w:r><w:tab/><w:t>para</w:t></w:r></w:p><w:p><w:r><w:t>Second</w:t></w:r></w:p>`), "First\tpara\nSecond", false},
+		{"broken docx", "a.docx", []byte("not a zip"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractorFor(tt.file)(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if extractorFor("scan.pdf") != nil {
+		t.Error("pdf should be unsupported")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// docxWith builds a minimal .docx whose body holds the given paragraphs.
+func docxWith(t *testing.T, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("word/document.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` + body + `</w:body></w:document>`))
+	zw.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,37 @@
+package main
+
+import "os"
+
+const (
+	// Embedding models, matching what the ingest and assistant Lambdas use
+	GeminiEmbeddingModel = "text-embedding-004"
+	OpenAIEmbeddingModel = "text-embedding-3-small"
+
+	// API URLs
+	GeminiEmbeddingAPIURL = "https://generativelanguage.googleapis.com/v1beta/models/" + GeminiEmbeddingModel + ":embedContent"
+	OpenAIEmbeddingAPIURL = "https://api.openai.com/v1/embeddings"
+
+	// Defaults mirror the deployed configuration
+	DefaultChunkTokens = "500"    // yoursai-ingest MaxTokensPerChunk
+	DefaultTopK        = 3        // yoursai-assistant RetrievalTopK
+	DefaultMetric      = "l2"     // the assistant searches with <->
+	DefaultEmbedder    = "gemini" // "gemini", "openai" or "hash"
+	DefaultStore       = "memory" // "memory" or "postgres"
+
+	// Offline embedder dimension; hash embeddings need no API key
+	HashEmbeddingDims = 256
+
+	HTTPTimeout = 30 // seconds
+
+	// Fixture corpus and golden set shipped with the tool
+	DefaultCorpusDir  = "testdata/corpus"
+	DefaultGoldenPath = "testdata/golden.jsonl"
+)
+
+// envOrDefault lets a run override a compiled-in setting without a rebuild.
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Document is one fixture file, named the way the ingest API would store it.
+type Document struct {
+	Name string
+	Text string
+}
+
+// GoldenQuery is a question and the documents a good search must return.
+type GoldenQuery struct {
+	Query    string   `json:"query"`
+	Expected []string `json:"expected"`
+}
+
+// loadCorpus reads every .md and .txt file under dir. Documents are named by
+// their path relative to dir, so golden sets can tell same-named files apart.
+func loadCorpus(dir string) ([]Document, error) {
+	var docs []Document
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if entry.IsDir() || (ext != ".md" && ext != ".txt") {
+			return nil
+		}
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, Document{Name: filepath.ToSlash(name), Text: string(text)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no .md or .txt files in %s", dir)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+	return docs, nil
+}
+
+// loadGolden reads a JSON Lines golden set and checks that every expected
+// document is in the corpus, so a typo cannot quietly score as a miss.
+func loadGolden(path string, corpus []Document) ([]GoldenQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	known := make(map[string]bool, len(corpus))
+	for _, doc := range corpus {
+		known[doc.Name] = true
+	}
+
+	var golden []GoldenQuery
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+		var q GoldenQuery
+		if err := json.Unmarshal([]byte(raw), &q); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if q.Query == "" || len(q.Expected) == 0 {
+			return nil, fmt.Errorf("%s:%d: query and expected are required", path, line)
+		}
+		for _, name := range q.Expected {
+			if !known[name] {
+				return nil, fmt.Errorf("%s:%d: expected document %q is not in the corpus", path, line, name)
+			}
+		}
+		golden = append(golden, q)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(golden) == 0 {
+		return nil, fmt.Errorf("%s has no queries", path)
+	}
+	return golden, nil
+}
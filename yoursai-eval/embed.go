@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Embedder turns text into a vector. Name identifies it in reports.
+type Embedder interface {
+	Name() string
+	Embed(ctx context.Context, text string) ([]float64, error)
+}
+
+// newEmbedder builds the named embedder. The provider embedders read their
+// key from GEMINI_API_KEY or OPENAI_API_KEY.
+func newEmbedder(name string) (Embedder, error) {
+	client := &http.Client{Timeout: HTTPTimeout * time.Second}
+	switch name {
+	case "gemini":
+		key := envOrDefault("GEMINI_API_KEY", "")
+		if key == "" {
+			return nil, fmt.Errorf("GEMINI_API_KEY is not set")
+		}
+		return newCachingEmbedder(&geminiEmbedder{client: client, url: GeminiEmbeddingAPIURL, apiKey: key}), nil
+	case "openai":
+		key := envOrDefault("OPENAI_API_KEY", "")
+		if key == "" {
+			return nil, fmt.Errorf("OPENAI_API_KEY is not set")
+		}
+		return newCachingEmbedder(&openAIEmbedder{client: client, url: OpenAIEmbeddingAPIURL, apiKey: key}), nil
+	case "hash":
+		return hashEmbedder{dims: HashEmbeddingDims}, nil
+	}
+	return nil, fmt.Errorf("unknown embedder %q (want gemini, openai or hash)", name)
+}
+
+type geminiEmbedder struct {
+	client *http.Client
+	url    string
+	apiKey string
+}
+
+func (e *geminiEmbedder) Name() string { return "gemini/" + GeminiEmbeddingModel }
+
+func (e *geminiEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	payload := map[string]interface{}{
+		"model": GeminiEmbeddingModel,
+		"content": map[string]interface{}{
+			"parts": []map[string]string{{"text": text}},
+		},
+	}
+	var result struct {
+		Embedding struct {
+			Values []float64 `json:"values"`
+		} `json:"embedding"`
+	}
+	if err := postJSON(ctx, e.client, e.url+"?key="+e.apiKey, "", payload, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Embedding.Values) == 0 {
+		return nil, fmt.Errorf("invalid embedding response format")
+	}
+	return result.Embedding.Values, nil
+}
+
+type openAIEmbedder struct {
+	client *http.Client
+	url    string
+	apiKey string
+}
+
+func (e *openAIEmbedder) Name() string { return "openai/" + OpenAIEmbeddingModel }
+
+func (e *openAIEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	payload := map[string]interface{}{
+		"model": OpenAIEmbeddingModel,
+		"input": text,
+	}
+	var result struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := postJSON(ctx, e.client, e.url, "Bearer "+e.apiKey, payload, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 || len(result.Data[0].Embedding) == 0 {
+		return nil, fmt.Errorf("invalid OpenAI embedding response format")
+	}
+	return result.Data[0].Embedding, nil
+}
+
+// postJSON sends payload and decodes the reply into out, retrying rate
+// limits and server errors a few times with a doubling delay.
+func postJSON(ctx context.Context, client *http.Client, url, auth string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if resp.StatusCode == http.StatusOK {
+			defer resp.Body.Close()
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+		resp.Body.Close()
+		if !retryable || attempt == 3 {
+			return fmt.Errorf("embedding API returned status %d", resp.StatusCode)
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// cachingEmbedder remembers every embedding for the run, so a grid of
+// configurations embeds each query and each distinct chunk only once.
+type cachingEmbedder struct {
+	Embedder
+	mu    sync.Mutex
+	cache map[string][]float64
+}
+
+func newCachingEmbedder(inner Embedder) *cachingEmbedder {
+	return &cachingEmbedder{Embedder: inner, cache: map[string][]float64{}}
+}
+
+func (c *cachingEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	c.mu.Lock()
+	v, ok := c.cache[text]
+	c.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+	v, err := c.Embedder.Embed(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.cache[text] = v
+	c.mu.Unlock()
+	return v, nil
+}
+
+// hashEmbedder is an offline bag-of-words embedder: each lowercased word is
+// hashed into one of dims buckets and the vector is L2-normalized. It is a
+// lexical baseline and lets the tool run without API keys.
+type hashEmbedder struct {
+	dims int
+}
+
+func (e hashEmbedder) Name() string { return fmt.Sprintf("hash/%d", e.dims) }
+
+func (e hashEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	v := make([]float64, e.dims)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		h := fnv.New32a()
+		h.Write([]byte(w))
+		v[h.Sum32()%uint32(e.dims)]++
+	}
+	var norm float64
+	for _, x := range v {
+		norm += x * x
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range v {
+			v[i] /= norm
+		}
+	}
+	return v, nil
+}
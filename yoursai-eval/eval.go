@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"shared/chunker"
+)
+
+// Config is one point in the grid: how the corpus is chunked and embedded
+// and how it is searched.
+type Config struct {
+	Embedder    string `json:"embedder"` // provider/model
+	ChunkTokens int    `json:"chunkTokens"`
+	Metric      string `json:"metric"`
+	TopK        int    `json:"topK"`
+}
+
+// QueryScore is one golden query's outcome under a Config.
+type QueryScore struct {
+	Query          string   `json:"query"`
+	Expected       []string `json:"expected"`
+	Retrieved      []string `json:"retrieved"`
+	Recall         float64  `json:"recall"`
+	ReciprocalRank float64  `json:"reciprocalRank"`
+	NDCG           float64  `json:"ndcg"`
+}
+
+// Result averages the query scores of one Config.
+type Result struct {
+	Config
+	Chunks  int          `json:"chunks"`
+	Recall  float64      `json:"recall"`
+	MRR     float64      `json:"mrr"`
+	NDCG    float64      `json:"ndcg"`
+	Queries []QueryScore `json:"queries"`
+}
+
+// indexCorpus loads the corpus into store the way ingest would, one chunk
+// per row, and returns the chunk count.
+func indexCorpus(ctx context.Context, store VectorStore, embedder Embedder, corpus []Document, chunkTokens int) (int, error) {
+	if err := store.Reset(ctx); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, doc := range corpus {
+		for i, chunk := range chunker.Split(doc.Text, chunkTokens) {
+			embedding, err := embedder.Embed(ctx, chunk)
+			if err != nil {
+				return 0, fmt.Errorf("embedding %s chunk %d: %w", doc.Name, i, err)
+			}
+			if err := store.Insert(ctx, chunk, doc.Name, embedding); err != nil {
+				return 0, fmt.Errorf("storing %s chunk %d: %w", doc.Name, i, err)
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// scoreGolden runs every golden query against an indexed store.
+func scoreGolden(ctx context.Context, store VectorStore, embedder Embedder, golden []GoldenQuery, cfg Config) (Result, error) {
+	result := Result{Config: cfg}
+	for _, q := range golden {
+		embedding, err := embedder.Embed(ctx, q.Query)
+		if err != nil {
+			return Result{}, fmt.Errorf("embedding query %q: %w", q.Query, err)
+		}
+		hits, err := store.Search(ctx, embedding, cfg.Metric, cfg.TopK)
+		if err != nil {
+			return Result{}, fmt.Errorf("searching for %q: %w", q.Query, err)
+		}
+		ranked := rankedDocuments(hits)
+		score := QueryScore{
+			Query:          q.Query,
+			Expected:       q.Expected,
+			Retrieved:      ranked,
+			Recall:         recall(ranked, q.Expected),
+			ReciprocalRank: reciprocalRank(ranked, q.Expected),
+			NDCG:           ndcg(ranked, q.Expected, cfg.TopK),
+		}
+		result.Queries = append(result.Queries, score)
+		result.Recall += score.Recall
+		result.MRR += score.ReciprocalRank
+		result.NDCG += score.NDCG
+	}
+	n := float64(len(golden))
+	result.Recall /= n
+	result.MRR /= n
+	result.NDCG /= n
+	return result, nil
+}
+
+// evaluateGrid scores every combination of embedder, chunk size and metric.
+// The corpus is indexed once per embedder and chunk size; metrics only
+// change the search.
+func evaluateGrid(ctx context.Context, store VectorStore, embedders []Embedder, chunkSizes []int, metrics []string, topK int, corpus []Document, golden []GoldenQuery) ([]Result, error) {
+	var results []Result
+	for _, embedder := range embedders {
+		for _, size := range chunkSizes {
+			chunks, err := indexCorpus(ctx, store, embedder, corpus, size)
+			if err != nil {
+				return nil, err
+			}
+			for _, metric := range metrics {
+				cfg := Config{Embedder: embedder.Name(), ChunkTokens: size, Metric: metric, TopK: topK}
+				result, err := scoreGolden(ctx, store, embedder, golden, cfg)
+				if err != nil {
+					return nil, err
+				}
+				result.Chunks = chunks
+				results = append(results, result)
+			}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,9 @@
+module yoursai-eval
+
+go 1.21
+
+require github.com/lib/pq v1.10.9
+
+require shared v0.0.0
+
+replace shared => ../shared
@@ -0,0 +1,149 @@
+// Command yoursai-eval scores retrieval quality on a fixture corpus and a
+// golden set of questions, so changes to chunking, the distance metric or
+// the embedding model can be compared on recall@k, MRR and nDCG@k.
+//
+//	go run . -embedder gemini,hash -chunk-tokens 250,500 -metric l2,cosine
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+func main() {
+	if err := run(context.Background(), os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "yoursai-eval:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("yoursai-eval", flag.ContinueOnError)
+	corpusDir := fs.String("corpus", DefaultCorpusDir, "directory of .md and .txt documents to ingest")
+	goldenPath := fs.String("golden", DefaultGoldenPath, "JSON Lines golden set: {\"query\": ..., \"expected\": [document names]}")
+	embedderList := fs.String("embedder", DefaultEmbedder, "comma-separated embedders: gemini, openai, hash")
+	chunkList := fs.String("chunk-tokens", DefaultChunkTokens, "comma-separated chunk sizes in tokens")
+	metricList := fs.String("metric", DefaultMetric, "comma-separated distance metrics: l2, cosine, ip")
+	topK := fs.Int("k", DefaultTopK, "chunks retrieved per query")
+	storeKind := fs.String("store", DefaultStore, "vector store: memory or postgres")
+	dsn := fs.String("dsn", envOrDefault("DATABASE_URL", ""), "Postgres connection string for -store postgres")
+	asJSON := fs.Bool("json", false, "print results as JSON, including per-query scores")
+	verbose := fs.Bool("v", false, "list the queries that missed an expected document")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *topK < 1 {
+		return fmt.Errorf("-k must be at least 1")
+	}
+
+	chunkSizes, err := parseChunkSizes(*chunkList)
+	if err != nil {
+		return err
+	}
+	metrics := splitList(*metricList)
+	if len(metrics) == 0 {
+		return fmt.Errorf("-metric needs at least one metric")
+	}
+	for _, m := range metrics {
+		if _, ok := distanceOperators[m]; !ok {
+			return fmt.Errorf("unknown metric %q (want l2, cosine or ip)", m)
+		}
+	}
+	var embedders []Embedder
+	for _, name := range splitList(*embedderList) {
+		e, err := newEmbedder(name)
+		if err != nil {
+			return err
+		}
+		embedders = append(embedders, e)
+	}
+	if len(embedders) == 0 {
+		return fmt.Errorf("-embedder needs at least one embedder")
+	}
+
+	corpus, err := loadCorpus(*corpusDir)
+	if err != nil {
+		return err
+	}
+	golden, err := loadGolden(*goldenPath, corpus)
+	if err != nil {
+		return err
+	}
+
+	store, err := newVectorStore(ctx, *storeKind, *dsn)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	results, err := evaluateGrid(ctx, store, embedders, chunkSizes, metrics, *topK, corpus, golden)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	fmt.Fprintf(stdout, "%d documents, %d queries\n\n", len(corpus), len(golden))
+	printTable(stdout, results)
+	if *verbose {
+		printMisses(stdout, results)
+	}
+	return nil
+}
+
+func printTable(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	k := results[0].TopK
+	fmt.Fprintf(tw, "embedder\tchunk tokens\tmetric\tchunks\trecall@%d\tMRR\tnDCG@%d\t\n", k, k)
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%.3f\t%.3f\t%.3f\t\n", r.Embedder, r.ChunkTokens, r.Metric, r.Chunks, r.Recall, r.MRR, r.NDCG)
+	}
+	tw.Flush()
+}
+
+func printMisses(w io.Writer, results []Result) {
+	for _, r := range results {
+		fmt.Fprintf(w, "\n%s, %d tokens, %s:\n", r.Embedder, r.ChunkTokens, r.Metric)
+		for _, q := range r.Queries {
+			if q.Recall < 1 {
+				fmt.Fprintf(w, "  %q\n    expected %s\n    got      %s\n", q.Query, strings.Join(q.Expected, ", "), strings.Join(q.Retrieved, ", "))
+			}
+		}
+	}
+}
+
+func parseChunkSizes(list string) ([]int, error) {
+	var sizes []int
+	for _, s := range splitList(list) {
+		n, err := strconv.Atoi(s)
+		// Below 2 tokens a chunk would hold less than one word
+		if err != nil || n < 2 {
+			return nil, fmt.Errorf("invalid chunk size %q", s)
+		}
+		sizes = append(sizes, n)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("-chunk-tokens needs at least one size")
+	}
+	return sizes, nil
+}
+
+func splitList(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, strings.ToLower(s))
+		}
+	}
+	return out
+}
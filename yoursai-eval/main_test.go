@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The hash embedder keeps these tests offline; they check the plumbing,
+// not how good lexical matching is.
+
+func TestRunScoresEveryConfiguration(t *testing.T) {
+	var out bytes.Buffer
+	err := run(context.Background(), []string{"-embedder", "hash", "-chunk-tokens", "100,500", "-metric", "l2,cosine", "-json"}, &out)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var results []Result
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out.String())
+	}
+	if len(results) != 4 {
+		t.Fatalf("got %d results, want 2 chunk sizes x 2 metrics", len(results))
+	}
+	golden, _ := os.ReadFile(DefaultGoldenPath)
+	queries := strings.Count(strings.TrimSpace(string(golden)), "\n") + 1
+	for _, r := range results {
+		if r.Embedder != "hash/256" || r.TopK != DefaultTopK || len(r.Queries) != queries {
+			t.Errorf("result %+v does not match the run's configuration", r.Config)
+		}
+		for name, v := range map[string]float64{"recall": r.Recall, "mrr": r.MRR, "ndcg": r.NDCG} {
+			if v <= 0 || v > 1 {
+				t.Errorf("%d tokens/%s: %s = %v, want in (0, 1]", r.ChunkTokens, r.Metric, name, v)
+			}
+		}
+	}
+	// Smaller chunks make more of them
+	if results[0].Chunks <= results[2].Chunks {
+		t.Errorf("100-token chunks = %d, 500-token chunks = %d", results[0].Chunks, results[2].Chunks)
+	}
+}
+
+func TestRunPrintsTable(t *testing.T) {
+	var out bytes.Buffer
+	if err := run(context.Background(), []string{"-embedder", "hash", "-k", "5"}, &out); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, want := range []string{"recall@5", "nDCG@5", "hash/256"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("table is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunRejectsBadInput(t *testing.T) {
+	dir := t.TempDir()
+	badGolden := filepath.Join(dir, "golden.jsonl")
+	os.WriteFile(badGolden, []byte(`{"query": "Where is the handbook?", "expected": ["handbook.md"]}`+"\n"), 0o644)
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"unknown metric", []string{"-embedder", "hash", "-metric", "manhattan"}, "unknown metric"},
+		{"unknown embedder", []string{"-embedder", "word2vec"}, "unknown embedder"},
+		{"chunk size too small", []string{"-embedder", "hash", "-chunk-tokens", "1"}, "invalid chunk size"},
+		{"unknown store", []string{"-embedder", "hash", "-store", "redis"}, "unknown store"},
+		{"expected document not in corpus", []string{"-embedder", "hash", "-golden", badGolden}, `"handbook.md" is not in the corpus`},
+		{"empty corpus", []string{"-embedder", "hash", "-corpus", dir}, "no .md or .txt files"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := run(context.Background(), tt.args, &bytes.Buffer{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
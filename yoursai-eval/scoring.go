@@ -0,0 +1,76 @@
+package main
+
+import "math"
+
+// Retrieval is scored per document, not per chunk: a search that returns
+// three chunks of the right document has found one relevant document. The
+// ranking is the documents in order of their best chunk.
+
+// rankedDocuments collapses chunk results into distinct document names,
+// keeping the position of each document's first chunk.
+func rankedDocuments(results []SearchResult) []string {
+	seen := map[string]bool{}
+	var ranked []string
+	for _, r := range results {
+		if !seen[r.DocumentName] {
+			seen[r.DocumentName] = true
+			ranked = append(ranked, r.DocumentName)
+		}
+	}
+	return ranked
+}
+
+// recall is the share of expected documents that were retrieved at all.
+func recall(ranked, expected []string) float64 {
+	want := toSet(expected)
+	hits := 0
+	for _, name := range ranked {
+		if want[name] {
+			hits++
+		}
+	}
+	return float64(hits) / float64(len(want))
+}
+
+// reciprocalRank is 1/rank of the first expected document, 0 if none came
+// back. Averaged over queries it is the MRR.
+func reciprocalRank(ranked, expected []string) float64 {
+	want := toSet(expected)
+	for i, name := range ranked {
+		if want[name] {
+			return 1 / float64(i+1)
+		}
+	}
+	return 0
+}
+
+// ndcg is binary-relevance nDCG@k: the discounted gain of the ranking over
+// that of a ranking with every expected document on top.
+func ndcg(ranked, expected []string, k int) float64 {
+	want := toSet(expected)
+	var dcg float64
+	for i, name := range ranked {
+		if i == k {
+			break
+		}
+		if want[name] {
+			dcg += 1 / math.Log2(float64(i+2))
+		}
+	}
+	var ideal float64
+	for i := 0; i < len(want) && i < k; i++ {
+		ideal += 1 / math.Log2(float64(i+2))
+	}
+	if ideal == 0 {
+		return 0
+	}
+	return dcg / ideal
+}
+
+func toSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	return set
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRankedDocumentsKeepsFirstChunkPosition(t *testing.T) {
+	results := []SearchResult{
+		{DocumentName: "a.md"}, {DocumentName: "b.md"}, {DocumentName: "a.md"}, {DocumentName: "c.md"},
+	}
+	if got, want := rankedDocuments(results), []string{"a.md", "b.md", "c.md"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rankedDocuments = %v, want %v", got, want)
+	}
+}
+
+func TestScores(t *testing.T) {
+	tests := []struct {
+		name       string
+		ranked     []string
+		expected   []string
+		k          int
+		wantRecall float64
+		wantRR     float64
+		wantNDCG   float64
+	}{
+		{"hit at the top", []string{"a", "b", "c"}, []string{"a"}, 3, 1, 1, 1},
+		{"hit in second place", []string{"b", "a", "c"}, []string{"a"}, 3, 1, 0.5, 1 / math.Log2(3)},
+		{"miss", []string{"b", "c"}, []string{"a"}, 3, 0, 0, 0},
+		{"both of two expected, in order", []string{"a", "b"}, []string{"a", "b"}, 3, 1, 1, 1},
+		{"one of two expected", []string{"c", "a"}, []string{"a", "b"}, 3, 0.5, 0.5, (1 / math.Log2(3)) / (1 + 1/math.Log2(3))},
+		{"nothing retrieved", nil, []string{"a"}, 3, 0, 0, 0},
+		{"more expected than k", []string{"a"}, []string{"a", "b", "c"}, 1, 1.0 / 3, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := recall(tt.ranked, tt.expected); !closeTo(got, tt.wantRecall) {
+				t.Errorf("recall = %.4f, want %.4f", got, tt.wantRecall)
+			}
+			if got := reciprocalRank(tt.ranked, tt.expected); !closeTo(got, tt.wantRR) {
+				t.Errorf("reciprocalRank = %.4f, want %.4f", got, tt.wantRR)
+			}
+			if got := ndcg(tt.ranked, tt.expected, tt.k); !closeTo(got, tt.wantNDCG) {
+				t.Errorf("ndcg = %.4f, want %.4f", got, tt.wantNDCG)
+			}
+		})
+	}
+}
+
+func TestDistanceMatchesPgvectorOperators(t *testing.T) {
+	a, b := []float64{1, 0}, []float64{0, 2}
+	tests := []struct {
+		metric string
+		want   float64
+	}{
+		{"l2", math.Sqrt(5)},
+		{"cosine", 1},
+		{"ip", 0},
+	}
+	for _, tt := range tests {
+		got, err := distance(tt.metric, a, b)
+		if err != nil || !closeTo(got, tt.want) {
+			t.Errorf("distance(%s) = %v, %v; want %v", tt.metric, got, err, tt.want)
+		}
+	}
+	if _, err := distance("l2", a, []float64{1}); err == nil {
+		t.Error("expected an error for mismatched dimensions")
+	}
+}
+
+func closeTo(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
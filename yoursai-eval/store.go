@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// Distance metrics and their pgvector operators. The assistant searches
+// with l2 today.
+var distanceOperators = map[string]string{
+	"l2":     "<->",
+	"cosine": "<=>",
+	"ip":     "<#>", // negative inner product, so smaller is still closer
+}
+
+// SearchResult is one retrieved chunk, as the assistant's vector search
+// returns it.
+type SearchResult struct {
+	Content      string
+	DocumentName string
+	Distance     float64
+}
+
+// VectorStore holds one configuration's chunks. Reset empties it between
+// configurations.
+type VectorStore interface {
+	Reset(ctx context.Context) error
+	Insert(ctx context.Context, content, documentName string, embedding []float64) error
+	Search(ctx context.Context, embedding []float64, metric string, k int) ([]SearchResult, error)
+	Close() error
+}
+
+func newVectorStore(ctx context.Context, kind, dsn string) (VectorStore, error) {
+	switch kind {
+	case "memory":
+		return &memoryStore{}, nil
+	case "postgres":
+		if dsn == "" {
+			return nil, fmt.Errorf("-dsn or DATABASE_URL is required for the postgres store")
+		}
+		return newPGStore(ctx, dsn)
+	}
+	return nil, fmt.Errorf("unknown store %q (want memory or postgres)", kind)
+}
+
+// memoryStore is a brute-force store computing the same distances as
+// pgvector's operators.
+type memoryStore struct {
+	chunks []memoryChunk
+}
+
+type memoryChunk struct {
+	content, documentName string
+	embedding             []float64
+}
+
+func (s *memoryStore) Reset(ctx context.Context) error {
+	s.chunks = nil
+	return nil
+}
+
+func (s *memoryStore) Insert(ctx context.Context, content, documentName string, embedding []float64) error {
+	s.chunks = append(s.chunks, memoryChunk{content: content, documentName: documentName, embedding: embedding})
+	return nil
+}
+
+func (s *memoryStore) Search(ctx context.Context, embedding []float64, metric string, k int) ([]SearchResult, error) {
+	results := make([]SearchResult, 0, len(s.chunks))
+	for _, c := range s.chunks {
+		d, err := distance(metric, embedding, c.embedding)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, SearchResult{Content: c.content, DocumentName: c.documentName, Distance: d})
+	}
+	// Stable, so ties keep insertion order like a sequential scan would
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Distance < results[j].Distance })
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+func (s *memoryStore) Close() error { return nil }
+
+func distance(metric string, a, b []float64) (float64, error) {
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("different vector dimensions %d and %d", len(a), len(b))
+	}
+	var dot, normA, normB, sq float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+		sq += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	switch metric {
+	case "l2":
+		return math.Sqrt(sq), nil
+	case "cosine":
+		if normA == 0 || normB == 0 {
+			return 1, nil // pgvector returns NaN; 1 keeps the sort well-defined
+		}
+		return 1 - dot/(math.Sqrt(normA)*math.Sqrt(normB)), nil
+	case "ip":
+		return -dot, nil
+	}
+	return 0, fmt.Errorf("unknown metric %q", metric)
+}
+
+// pgStore evaluates against a real pgvector install. Chunks go into a
+// temporary table on one pinned connection, so aiknowledge is never touched
+// and nothing outlives the run.
+type pgStore struct {
+	db   *sql.DB
+	conn *sql.Conn
+}
+
+func newPGStore(ctx context.Context, dsn string) (*pgStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	// No dimension on the column: embedders in one run may differ
+	_, err = conn.ExecContext(ctx, `CREATE TEMP TABLE eval_chunks (content TEXT NOT NULL, document_name TEXT NOT NULL, embedding vector NOT NULL)`)
+	if err != nil {
+		conn.Close()
+		db.Close()
+		return nil, fmt.Errorf("creating eval table (is the vector extension installed?): %w", err)
+	}
+	return &pgStore{db: db, conn: conn}, nil
+}
+
+func (s *pgStore) Reset(ctx context.Context) error {
+	_, err := s.conn.ExecContext(ctx, `TRUNCATE eval_chunks`)
+	return err
+}
+
+func (s *pgStore) Insert(ctx context.Context, content, documentName string, embedding []float64) error {
+	_, err := s.conn.ExecContext(ctx,
+		`INSERT INTO eval_chunks (content, document_name, embedding) VALUES ($1, $2, $3::float8[]::vector)`,
+		content, documentName, pq.Array(embedding))
+	return err
+}
+
+func (s *pgStore) Search(ctx context.Context, embedding []float64, metric string, k int) ([]SearchResult, error) {
+	op, ok := distanceOperators[metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q", metric)
+	}
+	// Same shape as the assistant's pgVectorStore.Search, minus the per-user filter
+	query := fmt.Sprintf(`SELECT content, document_name, embedding %s $1::float8[]::vector AS distance FROM eval_chunks ORDER BY distance LIMIT $2`, op)
+	rows, err := s.conn.QueryContext(ctx, query, pq.Array(embedding), k)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.Content, &r.DocumentName, &r.Distance); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+func (s *pgStore) Close() error {
+	s.conn.Close()
+	return s.db.Close()
+}
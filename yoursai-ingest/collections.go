@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Knowledge-base chunks belong to collections. A collection is owned by a
+// user or a team, and collection_members grants principals the owner,
+// editor or reader role on it: owners manage members, editors ingest and
+// readers only retrieve. Principals are "user:<sub>" for a user and
+// "team:<group>" for each Cognito group the user is in. Every user has a
+// personal collection, created on their first ingest. Collections belong to
+// one tenant and are invisible to every other, even to a principal with the
+// same name.
+
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleReader = "reader"
+)
+
+// errCollectionForbidden covers both a collection that does not exist and
+// one the caller lacks the role for, so IDs cannot be probed.
+var errCollectionForbidden = errors.New("collection not found or access denied")
+
+// Collection is a knowledge base as one caller sees it.
+type Collection struct {
+	CollectionId string    `json:"collectionId"`
+	TenantId     string    `json:"-"`
+	Name         string    `json:"name"`
+	Owner        string    `json:"owner"`          // owning principal
+	Role         string    `json:"role,omitempty"` // the caller's strongest role
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Member grants one principal a role on a collection.
+type Member struct {
+	Principal string `json:"principal"`
+	Role      string `json:"role"`
+}
+
+// CollectionStore manages collections and their members. Every method
+// takes the caller's tenant and principals and checks both in the same
+// query that reads or writes, returning errCollectionForbidden when it
+// fails.
+type CollectionStore interface {
+	List(ctx context.Context, tenantId string, principals []string) ([]Collection, error)
+	Create(ctx context.Context, c Collection) error
+	Members(ctx context.Context, tenantId, collectionId string, principals []string) ([]Member, error)
+	// SetMember and RemoveMember need the owner role and never change the
+	// owning principal's own membership.
+	SetMember(ctx context.Context, tenantId, collectionId string, principals []string, member Member) error
+	RemoveMember(ctx context.Context, tenantId, collectionId string, principals []string, principal string) error
+}
+
+func userPrincipal(userId string) string { return "user:" + userId }
+
+func teamPrincipal(team string) string { return "team:" + team }
+
+func personalCollectionId(userId string) string { return "personal:" + userId }
+
+// callerPrincipals lists the principals the token holds: the user and one
+// team per cognito:groups entry.
+func callerPrincipals(userId string, claims map[string]interface{}) []string {
+	principals := []string{userPrincipal(userId)}
+	groups, _ := claims["cognito:groups"].([]interface{})
+	for _, g := range groups {
+		if team, ok := g.(string); ok && team != "" {
+			principals = append(principals, teamPrincipal(team))
+		}
+	}
+	return principals
+}
+
+func validPrincipal(p string) bool {
+	kind, name, ok := strings.Cut(p, ":")
+	return ok && name != "" && (kind == "user" || kind == "team")
+}
+
+func validRole(role string) bool {
+	return role == RoleOwner || role == RoleEditor || role == RoleReader
+}
+
+// CreateCollectionRequest is the body of POST /collections. Team names a
+// Cognito group the caller is in; without it the caller owns the
+// collection.
+type CreateCollectionRequest struct {
+	Name string `json:"name"`
+	Team string `json:"team,omitempty"`
+}
+
+// handleCollections serves the collection endpoints:
+//
+//	GET    /collections                           collections the caller can read
+//	POST   /collections                           create one
+//	GET    /collections/{id}/members              members, for anyone who can read it
+//	PUT    /collections/{id}/members              add or change a member (owners)
+//	DELETE /collections/{id}/members/{principal}  remove a member (owners)
+func (d *Deps) handleCollections(ctx context.Context, request events.APIGatewayProxyRequest, tenantId, userId string, principals []string) (events.APIGatewayProxyResponse, error) {
+	rest := request.Path[strings.Index(request.Path, "/collections")+len("/collections"):]
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	} else if id, err := url.PathUnescape(parts[0]); err == nil {
+		parts[0] = id
+	}
+
+	switch {
+	case len(parts) == 0 && request.HTTPMethod == "GET":
+		collections, err := d.Collections.List(ctx, tenantId, principals)
+		if err != nil {
+			return collectionError(ctx, err)
+		}
+		if collections == nil {
+			collections = []Collection{}
+		}
+		return jsonResponse(http.StatusOK, collections), nil
+
+	case len(parts) == 0 && request.HTTPMethod == "POST":
+		var req CreateCollectionRequest
+		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+			return errorResponse(http.StatusBadRequest, "Invalid request body"), nil
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > MaxCollectionNameLength {
+			return errorResponse(http.StatusBadRequest, "Collection name is required and must be short"), nil
+		}
+		owner := userPrincipal(userId)
+		if req.Team != "" {
+			owner = teamPrincipal(req.Team)
+			if !containsString(principals, owner) {
+				return errorResponse(http.StatusForbidden, "You are not a member of that team"), nil
+			}
+		}
+		c := Collection{
+			CollectionId: uuid.New().String(),
+			TenantId:     tenantId,
+			Name:         req.Name,
+			Owner:        owner,
+			Role:         RoleOwner,
+			CreatedAt:    d.Now().UTC(),
+		}
+		if err := d.Collections.Create(ctx, c); err != nil {
+			return collectionError(ctx, err)
+		}
+		slog.InfoContext(ctx, "Collection created", "collectionId", c.CollectionId, "owner", owner)
+		return jsonResponse(http.StatusCreated, c), nil
+
+	case len(parts) == 2 && parts[1] == "members" && request.HTTPMethod == "GET":
+		members, err := d.Collections.Members(ctx, tenantId, parts[0], principals)
+		if err != nil {
+			return collectionError(ctx, err)
+		}
+		return jsonResponse(http.StatusOK, members), nil
+
+	case len(parts) == 2 && parts[1] == "members" && request.HTTPMethod == "PUT":
+		var m Member
+		if err := json.Unmarshal([]byte(request.Body), &m); err != nil {
+			return errorResponse(http.StatusBadRequest, "Invalid request body"), nil
+		}
+		if !validPrincipal(m.Principal) || !validRole(m.Role) {
+			return errorResponse(http.StatusBadRequest, `Member needs a "user:" or "team:" principal and an owner, editor or reader role`), nil
+		}
+		if err := d.Collections.SetMember(ctx, tenantId, parts[0], principals, m); err != nil {
+			return collectionError(ctx, err)
+		}
+		slog.InfoContext(ctx, "Collection member set", "collectionId", parts[0], "principal", m.Principal, "role", m.Role)
+		return jsonResponse(http.StatusOK, m), nil
+
+	case len(parts) == 3 && parts[1] == "members" && request.HTTPMethod == "DELETE":
+		principal, err := url.PathUnescape(parts[2])
+		if err != nil || !validPrincipal(principal) {
+			return errorResponse(http.StatusBadRequest, `Principal must start with "user:" or "team:"`), nil
+		}
+		if err := d.Collections.RemoveMember(ctx, tenantId, parts[0], principals, principal); err != nil {
+			return collectionError(ctx, err)
+		}
+		slog.InfoContext(ctx, "Collection member removed", "collectionId", parts[0], "principal", principal)
+		return jsonResponse(http.StatusOK, map[string]string{"message": "Member removed"}), nil
+	}
+	return errorResponse(http.StatusNotFound, "Not found"), nil
+}
+
+func collectionError(ctx context.Context, err error) (events.APIGatewayProxyResponse, error) {
+	if errors.Is(err, errCollectionForbidden) {
+		return errorResponse(http.StatusForbidden, "Collection not found or you lack the role for this"), nil
+	}
+	slog.ErrorContext(ctx, "Collection store error", "error", err)
+	return errorResponse(http.StatusInternalServerError, "Database error"), nil
+}
+
+func jsonResponse(status int, v interface{}) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(v)
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+			"Content-Type":                "application/json",
+		},
+		Body: string(body),
+	}
+}
+
+func errorResponse(status int, message string) events.APIGatewayProxyResponse {
+	return jsonResponse(status, map[string]string{"error": message})
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pgCollectionStore keeps collections in Postgres, next to aiknowledge.
+type pgCollectionStore struct {
+	secrets SecretStore
+}
+
+// roleRank orders roles strongest first.
+const roleRank = `CASE m.role WHEN 'owner' THEN 0 WHEN 'editor' THEN 1 ELSE 2 END`
+
+func (s pgCollectionStore) List(ctx context.Context, tenantId string, principals []string) ([]Collection, error) {
+	db, err := connectDB(ctx, s.secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT ON (c.collection_id) c.collection_id, c.name, c.owner, m.role, c.created_at
+		FROM collections c JOIN collection_members m ON m.collection_id = c.collection_id
+		WHERE c.tenant_id = $1 AND m.principal = ANY($2)
+		ORDER BY c.collection_id, `+roleRank, tenantId, pq.Array(principals))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collections []Collection
+	for rows.Next() {
+		var c Collection
+		if err := rows.Scan(&c.CollectionId, &c.Name, &c.Owner, &c.Role, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		collections = append(collections, c)
+	}
+	sort.Slice(collections, func(i, j int) bool { return collections[i].Name < collections[j].Name })
+	return collections, rows.Err()
+}
+
+func (s pgCollectionStore) Create(ctx context.Context, c Collection) error {
+	db, err := connectDB(ctx, s.secrets)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := createCollection(ctx, tx, c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createCollection inserts a collection and its owner's membership;
+// creating one that exists is a no-op.
+func createCollection(ctx context.Context, tx *sql.Tx, c Collection) error {
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO collections (collection_id, tenant_id, name, owner, created_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+		c.CollectionId, c.TenantId, c.Name, c.Owner, c.CreatedAt); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO collection_members (collection_id, principal, role) VALUES ($1, $2, 'owner') ON CONFLICT DO NOTHING`,
+		c.CollectionId, c.Owner)
+	return err
+}
+
+func (s pgCollectionStore) Members(ctx context.Context, tenantId, collectionId string, principals []string) ([]Member, error) {
+	db, err := connectDB(ctx, s.secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// Any member can see the others; the EXISTS keeps outsiders out
+	rows, err := db.QueryContext(ctx, `
+		SELECT principal, role FROM collection_members
+		WHERE collection_id = $1
+		  AND EXISTS (SELECT 1 FROM collection_members m JOIN collections c ON c.collection_id = m.collection_id
+		              WHERE m.collection_id = $1 AND c.tenant_id = $2 AND m.principal = ANY($3))
+		ORDER BY principal`, collectionId, tenantId, pq.Array(principals))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.Principal, &m.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, errCollectionForbidden
+	}
+	return members, nil
+}
+
+func (s pgCollectionStore) SetMember(ctx context.Context, tenantId, collectionId string, principals []string, member Member) error {
+	db, err := connectDB(ctx, s.secrets)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO collection_members (collection_id, principal, role)
+		SELECT c.collection_id, $2, $3 FROM collections c
+		WHERE c.collection_id = $1 AND c.tenant_id = $5 AND c.owner <> $2
+		  AND EXISTS (SELECT 1 FROM collection_members m
+		              WHERE m.collection_id = c.collection_id AND m.principal = ANY($4) AND m.role = 'owner')
+		ON CONFLICT (collection_id, principal) DO UPDATE SET role = EXCLUDED.role`,
+		collectionId, member.Principal, member.Role, pq.Array(principals), tenantId)
+	return requireRow(res, err)
+}
+
+func (s pgCollectionStore) RemoveMember(ctx context.Context, tenantId, collectionId string, principals []string, principal string) error {
+	db, err := connectDB(ctx, s.secrets)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM collection_members d USING collections c
+		WHERE d.collection_id = $1 AND d.principal = $2
+		  AND c.collection_id = d.collection_id AND c.tenant_id = $4 AND c.owner <> $2
+		  AND EXISTS (SELECT 1 FROM collection_members m
+		              WHERE m.collection_id = c.collection_id AND m.principal = ANY($3) AND m.role = 'owner')`,
+		collectionId, principal, pq.Array(principals), tenantId)
+	return requireRow(res, err)
+}
+
+// requireRow turns a write that matched no rows into errCollectionForbidden.
+func requireRow(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errCollectionForbidden
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandlerRejectsIngestWithoutWriteAccess(t *testing.T) {
+	env := newTestEnv(t)
+	env.chunks.authorizeErr = errCollectionForbidden
+	env.api.script("/gemini/embed", embeddingReply(0.1, 0.2, 0.3))
+
+	claims := map[string]interface{}{"sub": "user-reader", "cognito:groups": []string{"hr"}}
+	body, _ := json.Marshal(IngestRequest{DocumentName: "handbook.md", Text: "Holidays are on the intranet.", CollectionId: "team-handbook"})
+	resp := env.call(t, "POST", "/ingest", claims, string(body))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, resp.Body)
+	}
+
+	tx := env.chunks.lastTx()
+	if tx.collection != "team-handbook" || !reflect.DeepEqual(tx.caller.Principals, []string{"user:user-reader", "team:hr"}) {
+		t.Errorf("authorized %q for %v", tx.collection, tx.caller.Principals)
+	}
+	if !tx.rolledBack || len(tx.inserted) != 0 {
+		t.Errorf("transaction = %+v, want rolled back and empty", tx)
+	}
+	if got := len(env.api.requestsTo("/gemini/embed")); got != 0 {
+		t.Errorf("embedding calls = %d, want 0 before access is checked", got)
+	}
+}
+
+func TestCollectionMembership(t *testing.T) {
+	env := newTestEnv(t)
+	alice := map[string]interface{}{"sub": "alice", "cognito:groups": []string{"hr"}}
+	bob := map[string]interface{}{"sub": "bob"}
+	carol := map[string]interface{}{"sub": "carol", "cognito:groups": []string{"hr"}}
+
+	// A team collection needs the caller to be in the team
+	resp := env.call(t, "POST", "/collections", bob, `{"name":"HR handbook","team":"hr"}`)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("create for a team bob is not in: %d %s", resp.StatusCode, resp.Body)
+	}
+	resp = env.call(t, "POST", "/collections", alice, `{"name":"HR handbook","team":"hr"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %d %s", resp.StatusCode, resp.Body)
+	}
+	var created Collection
+	json.Unmarshal([]byte(resp.Body), &created)
+	if created.Owner != "team:hr" || created.Role != RoleOwner || created.CollectionId == "" {
+		t.Fatalf("created = %+v", created)
+	}
+	members := "/collections/" + created.CollectionId + "/members"
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		caller     map[string]interface{}
+		body       string
+		wantStatus int
+	}{
+		{"outsider cannot see members", "GET", members, bob, "", http.StatusForbidden},
+		{"outsider cannot add members", "PUT", members, bob, `{"principal":"user:bob","role":"owner"}`, http.StatusForbidden},
+		{"team member adds a reader", "PUT", members, carol, `{"principal":"user:bob","role":"reader"}`, http.StatusOK},
+		{"reader sees members", "GET", members, bob, "", http.StatusOK},
+		{"reader cannot promote themself", "PUT", members, bob, `{"principal":"user:bob","role":"editor"}`, http.StatusForbidden},
+		{"owning team keeps its role", "PUT", members, alice, `{"principal":"team:hr","role":"reader"}`, http.StatusForbidden},
+		{"unknown role", "PUT", members, alice, `{"principal":"user:dave","role":"admin"}`, http.StatusBadRequest},
+		{"bare principal", "PUT", members, alice, `{"principal":"dave","role":"reader"}`, http.StatusBadRequest},
+		{"owning team cannot be removed", "DELETE", members + "/team%3Ahr", alice, "", http.StatusForbidden},
+	}
+	for _, s := range steps {
+		resp := env.call(t, s.method, s.path, s.caller, s.body)
+		if resp.StatusCode != s.wantStatus {
+			t.Errorf("%s: got %d %s, want %d", s.name, resp.StatusCode, resp.Body, s.wantStatus)
+		}
+	}
+
+	resp = env.call(t, "GET", "/collections", bob, "")
+	var listed []Collection
+	json.Unmarshal([]byte(resp.Body), &listed)
+	if len(listed) != 1 || listed[0].CollectionId != created.CollectionId || listed[0].Role != RoleReader {
+		t.Errorf("bob's collections = %+v, want the handbook as a reader", listed)
+	}
+
+	resp = env.call(t, "DELETE", members+"/user:bob", alice, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("remove: %d %s", resp.StatusCode, resp.Body)
+	}
+	resp = env.call(t, "GET", "/collections", bob, "")
+	if strings.TrimSpace(resp.Body) != "[]" {
+		t.Errorf("bob's collections after removal = %s, want none", resp.Body)
+	}
+}
+
+func TestTenantsAreIsolated(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Secrets.(fakeSecrets)["/acme/openai/apiKey"] = "acme-key"
+	env.deps.Tenants = fakeTenants{"acme": {SSMKeyPath: "/acme/openai/apiKey"}}
+	env.api.script("/openai/embed", fakeResponse{status: http.StatusOK, body: map[string]interface{}{
+		"data": []interface{}{map[string]interface{}{"embedding": []interface{}{0.1, 0.2}}},
+	}})
+	acme := map[string]interface{}{"sub": "alice", "cognito:groups": []string{"hr", TenantGroupPrefix + "acme"}}
+	other := map[string]interface{}{"sub": "alice", "cognito:groups": []string{"hr"}}
+
+	// The same sub and team in the default tenant see nothing of acme's
+	resp := env.call(t, "POST", "/collections", acme, `{"name":"Acme HR","team":"hr"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %d %s", resp.StatusCode, resp.Body)
+	}
+	var created Collection
+	json.Unmarshal([]byte(resp.Body), &created)
+	if resp := env.call(t, "GET", "/collections", other, ""); strings.TrimSpace(resp.Body) != "[]" {
+		t.Errorf("other tenant's collections = %s, want none", resp.Body)
+	}
+	if resp := env.call(t, "GET", "/collections/"+created.CollectionId+"/members", other, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other tenant reading members: %d, want 403", resp.StatusCode)
+	}
+
+	// Ingest runs as the tenant: its key picks the provider and its rows
+	// and personal collection carry the tenant
+	resp = env.call(t, "POST", "/ingest", acme, ingestBody("handbook.md", "Holidays are on the intranet."))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("ingest: %d %s", resp.StatusCode, resp.Body)
+	}
+	if got := len(env.api.requestsTo("/openai/embed")); got != 1 {
+		t.Errorf("OpenAI embedding calls = %d, want 1 with the tenant's key", got)
+	}
+	tx := env.chunks.lastTx()
+	if tx.caller.TenantId != "acme" || tx.caller.UserId != "acme#alice" || tx.collection != "personal:acme#alice" {
+		t.Errorf("authorized %q as %+v", tx.collection, tx.caller)
+	}
+	if len(tx.inserted) != 1 || tx.inserted[0].TenantId != "acme" || tx.inserted[0].UserId != "acme#alice" {
+		t.Errorf("inserted = %+v, want one acme chunk from acme#alice", tx.inserted)
+	}
+
+	unknown := map[string]interface{}{"sub": "mallory", TenantClaim: "globex"}
+	if resp := env.call(t, "GET", "/collections", unknown, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unconfigured tenant: %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestTenantWithoutProviderIsRejected(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Secrets.(fakeSecrets)["/acme/llm-key"] = "acme-key"
+	env.deps.Tenants = fakeTenants{"acme": {SSMKeyPath: "/acme/llm-key"}}
+	acme := map[string]interface{}{"sub": "alice", TenantClaim: "acme"}
+
+	resp := env.call(t, "POST", "/ingest", acme, ingestBody("handbook.md", "Holidays are on the intranet."))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("ingest: %d %s, want 500 for a key path naming no provider", resp.StatusCode, resp.Body)
+	}
+	if got := len(env.api.requests); got != 0 {
+		t.Errorf("provider calls = %d, want 0", got)
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "os"
+
 const (
 	// AI Models
 	GeminiEmbeddingModel = "text-embedding-004"
@@ -9,6 +11,12 @@ const (
 	GeminiEmbeddingAPIURL = "https://generativelanguage.googleapis.com/v1beta/models/" + GeminiEmbeddingModel + ":embedContent"
 	OpenAIEmbeddingAPIURL = "https://api.openai.com/v1/embeddings"
 
+	// Chat models used only for the optional prompt-injection classifier
+	GeminiClassifierModel  = "gemini-2.5-flash-lite"
+	OpenAIClassifierModel  = "gpt-5-nano"
+	GeminiClassifierAPIURL = "https://generativelanguage.googleapis.com/v1beta/models/" + GeminiClassifierModel + ":generateContent"
+	OpenAIChatAPIURL       = "https://api.openai.com/v1/chat/completions"
+
 	// AWS Configuration
 	SSMKeyPath = "/yoursai/gemini/apiKey"
 	AWSRegion  = "us-east-1"
@@ -16,9 +24,78 @@ const (
 	// Chunking Configuration
 	MaxTokensPerChunk = 500
 	HTTPTimeout       = 10              // seconds
-	APICallDelay      = 2000            // milliseconds between API calls
 	MaxDocumentSize   = 5 * 1024 * 1024 // 5MB max document size
 
+	// Document metadata stored on every chunk for filtered retrieval
+	MaxTags          = 20
+	MaxTagLength     = 64
+	MaxMetadataBytes = 4096 // serialized JSON
+	MaxDocumentIdLen = 128  // client-supplied document IDs
+
+	// Knowledge-base collections
+	MaxCollectionNameLength = 100
+
+	// Client-side provider rate limits, per Lambda container (see providerLimits)
+	GeminiEmbeddingRPM = 1500
+	OpenAIEmbeddingRPM = 3000
+	OpenAIEmbeddingTPM = 1000000
+	GeminiChatRPM      = 4000
+	GeminiChatTPM      = 4000000
+	OpenAIChatRPM      = 500
+	OpenAIChatTPM      = 200000
+
+	// Retry policy for outbound provider calls (full-jitter exponential backoff)
+	RetryMaxAttempts          = 3
+	RetryBaseDelayMs          = 500
+	RetryMaxDelayMs           = 8000
+	RetryMaxRetryAfterSeconds = 20 // a longer Retry-After is not waited out
+
+	// Tracing
+	ServiceName     = "yoursai-ingest"
+	TracingExporter = "none" // "otlp", "stdout" or "none"
+
+	// CloudWatch embedded metrics, written to stdout
+	Metrics          = "on"
+	MetricsNamespace = "YoursAI"
+
+	// Structured logging
+	LogLevel               = "info" // "debug" also logs document text in full
+	LogContent             = "hash" // "hash" or "truncate"; how content is logged below debug
+	LogContentPreviewChars = 40
+
+	// Per-user ingest rate limiting (kept separate from the chat limits)
+	IngestRateLimitPerMin = 10
+	IngestRateLimitWindow = 60 // seconds
+	RateLimitTableName    = "RateLimits"
+	RateLimitBackend      = "dynamodb" // "dynamodb" or "memory"
+
+	// Token usage accounting and quotas, shared with the assistant's ledger
+	UsageTableName           = "UsageLedger"
+	UsageBackend             = "dynamodb" // "dynamodb" or "memory"
+	UsageLedgerRetentionDays = 90
+	DailyTokenQuota          = 200000
+	MonthlyTokenQuota        = 3000000
+
+	// Multi-tenancy, resolved as in the assistant
+	TenantClaim              = "custom:tenant"
+	TenantGroupPrefix        = "tenant-"
+	DefaultTenant            = "default"
+	TenantConfigPath         = "/yoursai/tenants"
+	TenantConfigCacheSeconds = 300
+
+	// Prompt-injection screening of uploaded chunks
+	InjectionClassifier = "off"        // "on" adds an LLM check after the heuristics
+	InjectionAction     = "quarantine" // "quarantine" hides suspicious chunks from retrieval, "flag" keeps them retrievable but marked
+
+	// PII masking before chunks are sent to the embedding API
+	PIIRedaction = "on" // "on" or "off"
+
+	// Content-addressed embedding cache, shared with the assistant
+	EmbeddingCacheBackend   = "postgres" // "postgres", "dynamodb", "memory" or "off"
+	EmbeddingCacheTableName = "EmbeddingCache"
+	EmbeddingCacheLRUSize   = 1000
+	EmbeddingCacheTTLDays   = 30 // dynamodb backend only
+
 	// Database Parameter Store paths
 	DBHostPath     = "/yoursai/db/host"
 	DBUsernamePath = "/yoursai/db/username"
@@ -26,3 +103,11 @@ const (
 	DBDatabasePath = "/yoursai/db/database"
 	DBPortPath     = "/yoursai/db/port"
 )
+
+// envOrDefault lets deployments override a compiled-in setting without a rebuild.
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"shared/embedcache"
+	"shared/ratelimit"
+	"shared/tenant"
+	"shared/throttle"
+)
+
+// Deps is everything the ingest handler reaches outside the process:
+// secrets, tenant configuration, the chunk and collection stores, the rate
+// limit, the usage ledger, the embedding cache, the model APIs and the
+// clock. main wires SSM, Postgres and the provider APIs; tests pass fakes
+// and httptest servers. With no Tenants only DefaultTenant is served.
+type Deps struct {
+	Secrets        SecretStore
+	Tenants        TenantStore
+	Chunks         ChunkStore
+	Collections    CollectionStore
+	Limiter        ratelimit.Limiter // per-user ingest requests
+	Usage          UsageStore
+	EmbeddingCache *embedcache.Cache // nil turns caching off
+	Providers      Providers
+	Now            func() time.Time
+}
+
+// SecretStore reads configuration secrets such as API keys and database
+// credentials by Parameter Store path.
+type SecretStore interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// ChunkStore stores a document's chunks in one transaction, so a failed
+// ingest leaves nothing behind.
+type ChunkStore interface {
+	// Begin opens a transaction that runs as caller; the database's
+	// row-level security checks every chunk against it.
+	Begin(ctx context.Context, caller Caller) (ChunkTx, error)
+}
+
+// Caller is the verified identity an ingest runs as.
+type Caller struct {
+	TenantId   string
+	UserId     string // tenant-scoped
+	Principals []string
+}
+
+// ChunkTx is an open ingest transaction; Commit or Rollback ends it.
+type ChunkTx interface {
+	// Authorize checks that the collection belongs to the caller's tenant
+	// and one of their principals is an owner or editor of it, and keeps
+	// that membership locked until the transaction ends, returning
+	// errCollectionForbidden otherwise. A caller's personal collection is
+	// created here on first use.
+	Authorize(ctx context.Context, collectionId string) error
+	// Replace deletes the chunks already stored for the document, waiting
+	// for any other transaction ingesting the same document to end first,
+	// so a re-upload or a retried request never stores it twice.
+	Replace(ctx context.Context, collectionId, documentId string) error
+	Insert(ctx context.Context, chunk Chunk) error
+	Commit() error
+	Rollback() error
+}
+
+// Chunk is one stored piece of a document.
+type Chunk struct {
+	Content          string // original text, PII included, for the owner only
+	Embedding        []float64
+	DocumentName     string
+	TenantId         string
+	CollectionId     string
+	UserId           string // who uploaded it
+	Quarantined      bool
+	QuarantineReason string
+	Document         DocumentMetadata // the same for every chunk of a document
+}
+
+// Providers are the model API endpoints and the throttles guarding them.
+type Providers struct {
+	GeminiEmbeddingURL string
+	OpenAIEmbeddingURL string
+	GeminiChatURL      string // injection classifier only
+	OpenAIChatURL      string
+	Throttles          *throttle.Set
+}
+
+func defaultProviders() Providers {
+	return Providers{
+		GeminiEmbeddingURL: GeminiEmbeddingAPIURL,
+		OpenAIEmbeddingURL: OpenAIEmbeddingAPIURL,
+		GeminiChatURL:      GeminiClassifierAPIURL,
+		OpenAIChatURL:      OpenAIChatAPIURL,
+		Throttles:          throttle.NewSet(nil),
+	}
+}
+
+// newAWSDeps wires the production dependencies: SSM, pgvector and the
+// public provider APIs, with the backends the *_BACKEND variables pick.
+func newAWSDeps(ctx context.Context) *Deps {
+	secrets := ssmSecretStore{}
+	return &Deps{
+		Secrets:        secrets,
+		Tenants:        tenant.NewSSMStore(secrets, TenantConfigPath, TenantConfigCacheSeconds*time.Second),
+		Chunks:         pgChunkStore{secrets: secrets, now: time.Now},
+		Collections:    pgCollectionStore{secrets: secrets},
+		Limiter:        newIngestRateLimiter(ctx),
+		Usage:          newUsageStore(ctx),
+		EmbeddingCache: newEmbeddingCache(ctx, secrets),
+		Providers:      defaultProviders(),
+		Now:            time.Now,
+	}
+}
+
+// pgChunkStore writes chunks to the aiknowledge table, opening a
+// connection per document.
+type pgChunkStore struct {
+	secrets SecretStore
+	now     func() time.Time // stamps personal collections created on first use
+}
+
+func (s pgChunkStore) Begin(ctx context.Context, caller Caller) (ChunkTx, error) {
+	conn, err := connectDB(ctx, s.secrets)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := beginAs(ctx, conn, caller)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &pgChunkTx{conn: conn, tx: tx, caller: caller, now: s.now}, nil
+}
+
+// beginAs opens a transaction and sets the caller the aiknowledge row-level
+// security policies check (db/migrations/006_row_level_security.sql). The
+// settings are local to the transaction.
+func beginAs(ctx context.Context, conn *sql.DB, caller Caller) (*sql.Tx, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `SELECT set_config('yoursai.tenant_id', $1, true),
+		set_config('yoursai.user_id', $2, true),
+		set_config('yoursai.principals', $3::text[]::text, true)`,
+		caller.TenantId, caller.UserId, pq.Array(caller.Principals))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+type pgChunkTx struct {
+	conn   *sql.DB
+	tx     *sql.Tx
+	caller Caller
+	now    func() time.Time
+}
+
+func (t *pgChunkTx) Authorize(ctx context.Context, collectionId string) error {
+	for _, p := range t.caller.Principals {
+		if userId, ok := strings.CutPrefix(p, "user:"); ok && collectionId == personalCollectionId(userId) {
+			err := createCollection(ctx, t.tx, Collection{CollectionId: collectionId, TenantId: t.caller.TenantId, Name: "Personal", Owner: p, CreatedAt: t.now().UTC()})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// FOR SHARE keeps an owner from revoking the role mid-ingest
+	var role string
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT m.role FROM collection_members m JOIN collections c ON c.collection_id = m.collection_id
+		WHERE m.collection_id = $1 AND c.tenant_id = $2 AND m.principal = ANY($3) AND m.role IN ('owner', 'editor')
+		LIMIT 1 FOR SHARE OF m`, collectionId, t.caller.TenantId, pq.Array(t.caller.Principals)).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errCollectionForbidden
+	}
+	return err
+}
+
+func (t *pgChunkTx) Replace(ctx context.Context, collectionId, documentId string) error {
+	// The lock is released at commit or rollback, after which the other
+	// transaction's delete sees this one's chunks
+	_, err := t.tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1 || '/' || $2 || '/' || $3))`,
+		t.caller.TenantId, collectionId, documentId)
+	if err != nil {
+		return err
+	}
+	_, err = t.tx.ExecContext(ctx, `DELETE FROM aiknowledge WHERE tenant_id = $1 AND collection_id = $2 AND document_id = $3`,
+		t.caller.TenantId, collectionId, documentId)
+	return err
+}
+
+func (t *pgChunkTx) Insert(ctx context.Context, chunk Chunk) error {
+	tags, err := json.Marshal(chunk.Document.Tags)
+	if err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(chunk.Document.Metadata)
+	if err != nil {
+		return err
+	}
+	// Use native array parameter - no manual string construction
+	_, err = t.tx.ExecContext(ctx,
+		`INSERT INTO aiknowledge (content, embedding, document_name, user_id, quarantined, quarantine_reason, document_id, document_date, tags, metadata, collection_id, tenant_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8::date, $9::jsonb, $10::jsonb, $11, $12)`,
+		chunk.Content,
+		chunk.Embedding, // Pass array directly
+		chunk.DocumentName,
+		chunk.UserId,
+		chunk.Quarantined,
+		chunk.QuarantineReason,
+		chunk.Document.DocumentId,
+		chunk.Document.Date,
+		string(tags),
+		string(metadata),
+		chunk.CollectionId,
+		chunk.TenantId,
+	)
+	return err
+}
+
+func (t *pgChunkTx) Commit() error {
+	defer t.conn.Close()
+	return t.tx.Commit()
+}
+
+func (t *pgChunkTx) Rollback() error {
+	defer t.conn.Close()
+	return t.tx.Rollback()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"shared/embedcache"
+)
+
+// newEmbeddingCache builds the cache EMBEDDING_CACHE_BACKEND names, or
+// returns nil when caching is off.
+func newEmbeddingCache(ctx context.Context, secrets SecretStore) *embedcache.Cache {
+	backend := envOrDefault("EMBEDDING_CACHE_BACKEND", EmbeddingCacheBackend)
+	switch backend {
+	case "off":
+		return nil
+	case "postgres":
+		// The handler connects per request; the cache keeps one
+		// connection for the life of the container
+		db, err := connectDB(ctx, secrets)
+		if err != nil {
+			slog.WarnContext(ctx, "Embedding cache using memory only", "backend", backend, "error", err)
+			break
+		}
+		return embedcache.New(EmbeddingCacheLRUSize, embedcache.NewPostgres(db))
+	case "dynamodb":
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "Embedding cache using memory only", "backend", backend, "error", err)
+			break
+		}
+		table := envOrDefault("EMBEDDING_CACHE_TABLE", EmbeddingCacheTableName)
+		ttl := time.Duration(EmbeddingCacheTTLDays) * 24 * time.Hour
+		return embedcache.New(EmbeddingCacheLRUSize, embedcache.NewDynamo(dynamodb.NewFromConfig(cfg), table, ttl, nil))
+	}
+	return embedcache.New(EmbeddingCacheLRUSize, nil)
+}
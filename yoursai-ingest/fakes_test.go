@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/ratelimit"
+	"shared/throttle"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("METRICS", "off")
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+var testNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeSecrets serves secrets from a map.
+type fakeSecrets map[string]string
+
+func (f fakeSecrets) Get(ctx context.Context, name string) (string, error) {
+	if v, ok := f[name]; ok {
+		return v, nil
+	}
+	return "", errors.New("parameter not found: " + name)
+}
+
+// fakeChunkStore hands out one fakeChunkTx per Begin.
+type fakeChunkStore struct {
+	beginErr     error
+	authorizeErr error
+	insertErr    error // returned by insert number failOn (1-based)
+	failOn       int
+	commitErr    error
+	txs          []*fakeChunkTx
+}
+
+func (f *fakeChunkStore) Begin(ctx context.Context, caller Caller) (ChunkTx, error) {
+	if f.beginErr != nil {
+		return nil, f.beginErr
+	}
+	tx := &fakeChunkTx{store: f, caller: caller}
+	f.txs = append(f.txs, tx)
+	return tx, nil
+}
+
+// lastTx returns the most recent transaction, or nil when none was started.
+func (f *fakeChunkStore) lastTx() *fakeChunkTx {
+	if len(f.txs) == 0 {
+		return nil
+	}
+	return f.txs[len(f.txs)-1]
+}
+
+type fakeChunkTx struct {
+	store      *fakeChunkStore
+	caller     Caller
+	collection string   // as authorized
+	replaced   []string // document IDs passed to Replace
+	inserted   []Chunk
+	committed  bool
+	rolledBack bool
+}
+
+func (t *fakeChunkTx) Authorize(ctx context.Context, collectionId string) error {
+	t.collection = collectionId
+	return t.store.authorizeErr
+}
+
+func (t *fakeChunkTx) Replace(ctx context.Context, collectionId, documentId string) error {
+	t.replaced = append(t.replaced, documentId)
+	return nil
+}
+
+func (t *fakeChunkTx) Insert(ctx context.Context, chunk Chunk) error {
+	if t.store.insertErr != nil && len(t.inserted)+1 == t.store.failOn {
+		return t.store.insertErr
+	}
+	t.inserted = append(t.inserted, chunk)
+	return nil
+}
+
+func (t *fakeChunkTx) Commit() error {
+	if t.store.commitErr != nil {
+		return t.store.commitErr
+	}
+	t.committed = true
+	return nil
+}
+
+func (t *fakeChunkTx) Rollback() error {
+	t.rolledBack = true
+	return nil
+}
+
+// fakeCollections keeps collections in memory with the role rules of
+// pgCollectionStore.
+type fakeCollections struct {
+	collections map[string]Collection
+	members     map[string]map[string]string // collection ID -> principal -> role
+}
+
+func newFakeCollections() *fakeCollections {
+	return &fakeCollections{collections: map[string]Collection{}, members: map[string]map[string]string{}}
+}
+
+// roleOf is the strongest role any of principals holds in the tenant's
+// collection, or "".
+func (f *fakeCollections) roleOf(tenantId, collectionId string, principals []string) string {
+	if c, ok := f.collections[collectionId]; !ok || c.TenantId != tenantId {
+		return ""
+	}
+	best := ""
+	for _, p := range principals {
+		switch role := f.members[collectionId][p]; {
+		case role == RoleOwner:
+			return RoleOwner
+		case role == RoleEditor, role == RoleReader && best == "":
+			best = role
+		}
+	}
+	return best
+}
+
+func (f *fakeCollections) List(ctx context.Context, tenantId string, principals []string) ([]Collection, error) {
+	var out []Collection
+	for id, c := range f.collections {
+		if role := f.roleOf(tenantId, id, principals); role != "" {
+			c.Role = role
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (f *fakeCollections) Create(ctx context.Context, c Collection) error {
+	c.Role = ""
+	f.collections[c.CollectionId] = c
+	f.members[c.CollectionId] = map[string]string{c.Owner: RoleOwner}
+	return nil
+}
+
+func (f *fakeCollections) Members(ctx context.Context, tenantId, collectionId string, principals []string) ([]Member, error) {
+	if f.roleOf(tenantId, collectionId, principals) == "" {
+		return nil, errCollectionForbidden
+	}
+	var out []Member
+	for p, role := range f.members[collectionId] {
+		out = append(out, Member{Principal: p, Role: role})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Principal < out[j].Principal })
+	return out, nil
+}
+
+func (f *fakeCollections) SetMember(ctx context.Context, tenantId, collectionId string, principals []string, member Member) error {
+	if f.roleOf(tenantId, collectionId, principals) != RoleOwner || f.collections[collectionId].Owner == member.Principal {
+		return errCollectionForbidden
+	}
+	f.members[collectionId][member.Principal] = member.Role
+	return nil
+}
+
+func (f *fakeCollections) RemoveMember(ctx context.Context, tenantId, collectionId string, principals []string, principal string) error {
+	if f.roleOf(tenantId, collectionId, principals) != RoleOwner || f.collections[collectionId].Owner == principal {
+		return errCollectionForbidden
+	}
+	if _, ok := f.members[collectionId][principal]; !ok {
+		return errCollectionForbidden
+	}
+	delete(f.members[collectionId], principal)
+	return nil
+}
+
+// fakeTenants serves tenant configuration from a map.
+type fakeTenants map[string]TenantConfig
+
+func (f fakeTenants) Get(ctx context.Context, tenantId string) (TenantConfig, bool, error) {
+	cfg, ok := f[tenantId]
+	return cfg, ok, nil
+}
+
+// fakeResponse is one scripted provider reply.
+type fakeResponse struct {
+	status int
+	body   interface{}
+}
+
+// fakeAPI stands in for the provider APIs. Each path serves its scripted
+// responses in order and repeats the last one; every request body is kept.
+type fakeAPI struct {
+	mu        sync.Mutex
+	responses map[string][]fakeResponse
+	requests  map[string][]map[string]interface{}
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{responses: map[string][]fakeResponse{}, requests: map[string][]map[string]interface{}{}}
+}
+
+func (f *fakeAPI) script(path string, responses ...fakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[path] = responses
+}
+
+func (f *fakeAPI) requestsTo(path string) []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	f.mu.Lock()
+	f.requests[r.URL.Path] = append(f.requests[r.URL.Path], body)
+	queue := f.responses[r.URL.Path]
+	if len(queue) == 0 {
+		f.mu.Unlock()
+		http.Error(w, "unexpected request to "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	resp := queue[0]
+	if len(queue) > 1 {
+		f.responses[r.URL.Path] = queue[1:]
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	json.NewEncoder(w).Encode(resp.body)
+}
+
+// testEnv is a Deps wired to fakes and one fake provider server.
+type testEnv struct {
+	deps        *Deps
+	api         *fakeAPI
+	chunks      *fakeChunkStore
+	collections *fakeCollections
+	usage       *memoryUsageStore
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	api := newFakeAPI()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	env := &testEnv{api: api, chunks: &fakeChunkStore{}, collections: newFakeCollections(), usage: newMemoryUsageStore()}
+	env.deps = &Deps{
+		Secrets:     fakeSecrets{SSMKeyPath: "test-key"},
+		Tenants:     fakeTenants{},
+		Chunks:      env.chunks,
+		Collections: env.collections,
+		Usage:       env.usage,
+		Providers: Providers{
+			GeminiEmbeddingURL: server.URL + "/gemini/embed",
+			OpenAIEmbeddingURL: server.URL + "/openai/embed",
+			GeminiChatURL:      server.URL + "/gemini/generate",
+			OpenAIChatURL:      server.URL + "/openai/chat",
+			Throttles:          throttle.NewSet(nil),
+		},
+		Now: func() time.Time { return testNow },
+	}
+	env.deps.Limiter = ratelimit.NewMemory(IngestRateLimitPerMin, IngestRateLimitWindow, env.deps.Now)
+	return env
+}
+
+// ingest sends a POST to the handler as the given user.
+func (e *testEnv) ingest(t *testing.T, userId, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	return e.call(t, "POST", "/ingest", map[string]interface{}{"sub": userId}, body)
+}
+
+// call sends any request to the handler with a token carrying claims.
+func (e *testEnv) call(t *testing.T, method, path string, claims map[string]interface{}, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	resp, err := e.deps.handler(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod: method,
+		Path:       path,
+		Headers:    map[string]string{"Authorization": bearerToken(claims)},
+		Body:       body,
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return resp
+}
+
+// bearerToken builds an unsigned JWT; API Gateway has already verified it
+// by the time the handler runs.
+func bearerToken(claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	return "Bearer e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func ingestBody(documentName, text string) string {
+	body, _ := json.Marshal(IngestRequest{DocumentName: documentName, Text: text})
+	return string(body)
+}
+
+func embeddingReply(values ...float64) fakeResponse {
+	return fakeResponse{status: http.StatusOK, body: map[string]interface{}{
+		"embedding": map[string]interface{}{"values": values},
+	}}
+}
@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
@@ -18,57 +18,49 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"shared"
+	"shared/chunker"
+	"shared/embedcache"
+	"shared/logging"
+	"shared/ratelimit"
+	"shared/redact"
 )
 
 type IngestRequest struct {
 	DocumentName string `json:"documentName"`
 	Text         string `json:"text"`
-}
-
-func extractUserFromToken(authHeader string) (string, error) {
-	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-		return "", fmt.Errorf("missing or invalid authorization header")
-	}
-
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-	parts := strings.Split(token, ".")
-	if len(parts) != 3 {
-		return "", fmt.Errorf("invalid JWT format")
-	}
-
-	// Decode payload (second part)
-	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
-	if err != nil {
-		return "", fmt.Errorf("failed to decode JWT payload")
-	}
-
-	var claims map[string]interface{}
-	if err := json.Unmarshal(payload, &claims); err != nil {
-		return "", fmt.Errorf("failed to parse JWT claims")
-	}
-
-	// Extract user ID from 'sub' claim
-	if sub, ok := claims["sub"].(string); ok {
-		return sub, nil
-	}
-
-	return "", fmt.Errorf("user ID not found in token")
+	CollectionId string `json:"collectionId,omitempty"` // defaults to the caller's personal collection
+	// Optional stable ID; ingesting it again replaces the earlier chunks
+	DocumentId string `json:"documentId,omitempty"`
+	// Optional, stored on every chunk so chat requests can filter on them
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	Tags         []string               `json:"tags,omitempty"`
+	DocumentDate string                 `json:"documentDate,omitempty"` // YYYY-MM-DD; defaults to the ingest date
 }
 
 type IngestResponse struct {
-	Message string `json:"message"`
-	Chunks  int    `json:"chunks"`
+	Message      string `json:"message"`
+	DocumentId   string `json:"documentId"` // for chat filters
+	CollectionId string `json:"collectionId"`
+	Chunks       int    `json:"chunks"`
+	Quarantined  int    `json:"quarantined,omitempty"`
+	Flagged      int    `json:"flagged,omitempty"`
 }
 
-func isGeminiAPI() bool {
-	return strings.Contains(SSMKeyPath, "gemini")
-}
+// ssmSecretStore reads secrets from SSM Parameter Store.
+type ssmSecretStore struct{}
 
-func isOpenAIAPI() bool {
-	return strings.Contains(SSMKeyPath, "openai")
+func (ssmSecretStore) Get(ctx context.Context, name string) (string, error) {
+	return getParameter(ctx, name)
 }
 
-func getParameter(ctx context.Context, name string) (string, error) {
+func getParameter(ctx context.Context, name string) (value string, err error) {
+	ctx, span := startSpan(ctx, "ssm.get_parameter", attribute.String("ssm.parameter", name))
+	defer func() { endSpan(span, err) }()
+
 	cfg, _ := config.LoadDefaultConfig(ctx)
 	client := ssm.NewFromConfig(cfg)
 
@@ -82,28 +74,31 @@ func getParameter(ctx context.Context, name string) (string, error) {
 	return *out.Parameter.Value, nil
 }
 
-func connectDB(ctx context.Context) (*sql.DB, error) {
-	host, err := getParameter(ctx, DBHostPath)
+func connectDB(ctx context.Context, secrets SecretStore) (db *sql.DB, err error) {
+	ctx, span := startSpan(ctx, "postgres.connect")
+	defer func() { endSpan(span, err) }()
+
+	host, err := secrets.Get(ctx, DBHostPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get host: %v", err)
 	}
 
-	username, err := getParameter(ctx, DBUsernamePath)
+	username, err := secrets.Get(ctx, DBUsernamePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get username: %v", err)
 	}
 
-	password, err := getParameter(ctx, DBPasswordPath)
+	password, err := secrets.Get(ctx, DBPasswordPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get password: %v", err)
 	}
 
-	database, err := getParameter(ctx, DBDatabasePath)
+	database, err := secrets.Get(ctx, DBDatabasePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get database: %v", err)
 	}
 
-	port, err := getParameter(ctx, DBPortPath)
+	port, err := secrets.Get(ctx, DBPortPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get port: %v", err)
 	}
@@ -116,131 +111,162 @@ func connectDB(ctx context.Context) (*sql.DB, error) {
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=require",
 		host, port, username, password, database)
 
-	log.Printf("Connecting to database with host=%s port=%s dbname=%s", host, port, database)
+	slog.InfoContext(ctx, "Connecting to database", "host", host, "port", port, "dbname", database)
 
-	db, err := sql.Open("postgres", connStr)
+	db, err = sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open connection: %v", err)
 	}
 
-	if err = db.Ping(); err != nil {
+	if err = db.PingContext(ctx); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %v", err)
 	}
 
 	return db, nil
 }
 
-// Chunk text into ~500 token chunks (roughly 375 words)
-func chunkText(text string, maxTokens int) []string {
-	words := strings.Fields(text)
-	wordsPerChunk := maxTokens * 3 / 4 // Rough conversion: 1 token ≈ 0.75 words
+// embeddingProvider and embeddingModelName identify the embeddings the
+// tenant's provider produces; the assistant searches with the same ones.
+func embeddingProvider(ctx context.Context) string {
+	return tenantFrom(ctx).Provider()
+}
+
+func embeddingModelName(ctx context.Context) string {
+	if isGeminiAPI(ctx) {
+		return GeminiEmbeddingModel
+	}
+	return OpenAIEmbeddingModel
+}
 
-	var chunks []string
-	for i := 0; i < len(words); i += wordsPerChunk {
-		end := i + wordsPerChunk
-		if end > len(words) {
-			end = len(words)
+// generateEmbedding returns the embedding for text and the tokens spent on
+// it, which is zero when the embedding came from the cache, so re-ingesting
+// a document only pays for the chunks that changed.
+func (d *Deps) generateEmbedding(ctx context.Context, text string, apiKey string) (embedding []float64, tokens int, err error) {
+	defer recordStageLatency("embedding", time.Now())
+	ctx, span := startSpan(ctx, "embedding", attribute.String("llm.model", embeddingModelName(ctx)))
+	defer func() { endSpan(span, err) }()
+
+	cache := d.EmbeddingCache
+	key := embedcache.Key(embeddingProvider(ctx), embeddingModelName(ctx), text)
+	if cache != nil {
+		if embedding, ok := cache.Get(ctx, key); ok {
+			span.SetAttributes(attribute.Bool("embedding.cache_hit", true))
+			return embedding, 0, nil
 		}
-		chunk := strings.Join(words[i:end], " ")
-		chunks = append(chunks, chunk)
 	}
+	span.SetAttributes(attribute.Bool("embedding.cache_hit", false))
 
-	return chunks
+	embedding, tokens, err = d.fetchEmbedding(ctx, text, apiKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	span.SetAttributes(usageAttributes(TokenUsage{EmbeddingTokens: tokens})...)
+	if cache != nil {
+		cache.Put(ctx, key, embedding)
+	}
+	return embedding, tokens, nil
 }
 
-func generateEmbedding(ctx context.Context, text string, apiKey string) ([]float64, error) {
-	var payload map[string]interface{}
+func (d *Deps) fetchEmbedding(ctx context.Context, text string, apiKey string) ([]float64, int, error) {
+	provider, model := embeddingProvider(ctx), embeddingModelName(ctx)
 	var req *http.Request
-	
-	if isGeminiAPI() {
-		payload = map[string]interface{}{
-			"model": GeminiEmbeddingModel,
+	switch provider {
+	case "gemini":
+		body, _ := json.Marshal(map[string]interface{}{
+			"model": model,
 			"content": map[string]interface{}{
 				"parts": []map[string]string{
 					{"text": text},
 				},
 			},
-		}
-		body, _ := json.Marshal(payload)
-		req, _ = http.NewRequestWithContext(ctx, "POST", GeminiEmbeddingAPIURL+"?key="+apiKey, bytes.NewBuffer(body))
-	} else if isOpenAIAPI() {
-		payload = map[string]interface{}{
-			"model": OpenAIEmbeddingModel,
-			"input": text,
-		}
-		body, _ := json.Marshal(payload)
-		req, _ = http.NewRequestWithContext(ctx, "POST", OpenAIEmbeddingAPIURL, bytes.NewBuffer(body))
+		})
+		req, _ = http.NewRequestWithContext(ctx, "POST", d.Providers.GeminiEmbeddingURL+"?key="+apiKey, bytes.NewBuffer(body))
+	case "openai":
+		body, _ := json.Marshal(map[string]interface{}{"model": model, "input": text})
+		req, _ = http.NewRequestWithContext(ctx, "POST", d.Providers.OpenAIEmbeddingURL, bytes.NewBuffer(body))
 		req.Header.Set("Authorization", "Bearer "+apiKey)
+	default:
+		return nil, 0, fmt.Errorf("no embedding provider configured")
 	}
-	
 	req.Header.Set("Content-Type", "application/json")
 
+	if err := throttleProvider(ctx, d.Providers.Throttles, tenantFrom(ctx).KeyPath(), provider, model, estimateTokens(text)); err != nil {
+		return nil, 0, err
+	}
 	client := &http.Client{Timeout: HTTPTimeout * time.Second}
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := doWithRetry(ctx, client, req)
+	recordProviderCall(provider, model, start, resp, err)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("embedding API returned status %d", resp.StatusCode)
+	}
 
 	var result map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	var embedVec []float64
-	if isGeminiAPI() {
-		// Parse Gemini response
-		embeddingMap, embOk := result["embedding"].(map[string]interface{})
-		if !embOk {
-			return nil, fmt.Errorf("invalid embedding response format")
-		}
-
-		values, valOk := embeddingMap["values"].([]interface{})
-		if !valOk {
-			return nil, fmt.Errorf("invalid embedding values format")
-		}
-
-		embedVec = make([]float64, len(values))
-		for i, v := range values {
-			if floatVal, ok := v.(float64); ok {
-				embedVec[i] = floatVal
-			} else {
-				return nil, fmt.Errorf("invalid embedding value type at index %d", i)
+	// OpenAI reports the exact token count, Gemini only gets the estimate
+	tokens := estimateTokens(text)
+	var values []interface{}
+	if provider == "openai" {
+		if data, ok := result["data"].([]interface{}); ok && len(data) > 0 {
+			if first, ok := data[0].(map[string]interface{}); ok {
+				values, _ = first["embedding"].([]interface{})
 			}
 		}
-	} else if isOpenAIAPI() {
-		// Parse OpenAI response
-		data, dataOk := result["data"].([]interface{})
-		if !dataOk || len(data) == 0 {
-			return nil, fmt.Errorf("invalid OpenAI embedding response format")
+		if usage, ok := result["usage"].(map[string]interface{}); ok {
+			if promptTokens, ok := usage["prompt_tokens"].(float64); ok {
+				tokens = int(promptTokens)
+			}
 		}
+	} else if embedding, ok := result["embedding"].(map[string]interface{}); ok {
+		values, _ = embedding["values"].([]interface{})
+	}
+	if len(values) == 0 {
+		return nil, 0, fmt.Errorf("invalid %s embedding response format", provider)
+	}
 
-		embeddingData := data[0].(map[string]interface{})
-		values := embeddingData["embedding"].([]interface{})
-
-		embedVec = make([]float64, len(values))
-		for i, v := range values {
-			if floatVal, ok := v.(float64); ok {
-				embedVec[i] = floatVal
-			} else {
-				return nil, fmt.Errorf("invalid embedding value type at index %d", i)
-			}
+	embedVec := make([]float64, len(values))
+	for i, v := range values {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid embedding value type at index %d", i)
 		}
+		embedVec[i] = f
 	}
+	return embedVec, tokens, nil
+}
 
-	return embedVec, nil
+func (d *Deps) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	defer recordStageLatency("request", time.Now())
+	ctx, span := startSpan(ctx, "ingest.request",
+		attribute.String("http.method", request.HTTPMethod),
+		attribute.String("http.path", request.Path),
+		attribute.String("aws.apigateway.request_id", request.RequestContext.RequestID))
+	resp, err := d.handleIngest(ctx, request)
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	endSpan(span, err)
+	flushTraces(ctx)
+	return resp, err
 }
 
-func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func (d *Deps) handleIngest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx = logging.WithFields(ctx, "requestId", request.RequestContext.RequestID)
+
 	// Extract user ID from Authorization header
 	authHeader := request.Headers["Authorization"]
 	if authHeader == "" {
 		authHeader = request.Headers["authorization"] // case-insensitive fallback
 	}
 
-	userId, err := extractUserFromToken(authHeader)
+	userId, err := shared.ExtractUserFromToken(authHeader)
 	if err != nil {
-		log.Printf("Authentication failed: %v", err)
+		slog.WarnContext(ctx, "Authentication failed", "error", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 401,
 			Headers: map[string]string{
@@ -251,6 +277,37 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}, nil
 	}
 
+	// Everything below runs as the caller's tenant: keys and rows are scoped
+	// to it and its configuration applies
+	claims, _ := shared.ExtractTokenClaims(authHeader)
+	tenant, err := d.tenantForClaims(ctx, claims)
+	if err != nil {
+		slog.WarnContext(ctx, "Tenant rejected", "error", err)
+		return tenantErrorResponse(err), nil
+	}
+	ctx = withTenant(ctx, tenant)
+	userId = tenant.ScopedUserId(userId)
+	ctx = logging.WithFields(ctx, "tenant", tenant.Id, "userId", userId)
+	principals := callerPrincipals(userId, claims)
+
+	// Collection management is cheap and not counted against the ingest limit
+	if strings.Contains(request.Path, "/collections") {
+		return d.handleCollections(ctx, request, tenant.Id, userId, principals)
+	}
+
+	// Ingest has its own, tighter per-user limit since every chunk costs an embedding call
+	decision, err := d.Limiter.Allow(ctx, "ingest#"+userId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Rate limiter error", "error", err)
+	} else if !decision.Allowed {
+		slog.WarnContext(ctx, "Ingest rate limit exceeded", "retryAfter", decision.RetryAfter.String())
+		return events.APIGatewayProxyResponse{
+			StatusCode: 429,
+			Headers:    ratelimit.Headers(decision),
+			Body:       `{"error": "Too many requests. Please slow down."}`,
+		}, nil
+	}
+
 	var req IngestRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
 		return events.APIGatewayProxyResponse{
@@ -263,6 +320,9 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}, nil
 	}
 	
+	ctx = logging.WithFields(ctx, "document", req.DocumentName)
+	slog.InfoContext(ctx, "Ingest request", logging.Content("text", req.Text))
+
 	// Validate document size to prevent memory issues
 	if len(req.Text) > MaxDocumentSize {
 		return events.APIGatewayProxyResponse{
@@ -275,67 +335,129 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}, nil
 	}
 
-	// Get API key
-	apiKey, err := getParameter(ctx, SSMKeyPath)
+	meta, err := parseDocumentMetadata(req, d.Now())
 	if err != nil {
-		log.Printf("Error getting API key: %v", err)
+		body, _ := json.Marshal(map[string]string{"error": "Invalid metadata: " + err.Error()})
 		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
+			StatusCode: 400,
 			Headers: map[string]string{
 				"Access-Control-Allow-Origin": "*",
 				"Content-Type":                "application/json",
 			},
-			Body: `{"error": "Failed to get API key"}`,
+			Body: string(body),
 		}, nil
 	}
+	ctx = logging.WithFields(ctx, "documentId", meta.DocumentId)
+
+	// Enforce token quotas, counting the embedding tokens this document will need
+	quota, err := d.getQuotaStatus(ctx, userId, d.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "Quota check failed", "error", err)
+	} else {
+		quota.Daily.EmbeddingTokens += estimateTokens(req.Text)
+		quota.Monthly.EmbeddingTokens += estimateTokens(req.Text)
+		if wait := quota.Exceeded(d.Now()); wait > 0 {
+			return quotaExceededResponse(wait), nil
+		}
+	}
 
-	// Connect to database
-	conn, err := connectDB(ctx)
+	// Get API key
+	apiKey, err := d.Secrets.Get(ctx, tenant.KeyPath())
 	if err != nil {
-		log.Printf("DB connection failed: %v", err)
+		slog.ErrorContext(ctx, "Error getting API key", "error", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Headers: map[string]string{
 				"Access-Control-Allow-Origin": "*",
 				"Content-Type":                "application/json",
 			},
-			Body: `{"error": "Database connection failed"}`,
+			Body: `{"error": "Failed to get API key"}`,
 		}, nil
 	}
-	defer conn.Close()
 
 	// Chunk the text into ~500 token chunks
-	chunks := chunkText(req.Text, MaxTokensPerChunk)
+	chunks := chunker.Split(req.Text, MaxTokensPerChunk)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("ingest.document_bytes", len(req.Text)),
+		attribute.Int("ingest.chunks", len(chunks)))
 
 	// Start transaction for atomic document ingestion
-	tx, err := conn.Begin()
+	tx, err := d.Chunks.Begin(ctx, Caller{TenantId: tenant.Id, UserId: userId, Principals: principals})
 	if err != nil {
-		log.Printf("Failed to start transaction: %v", err)
+		slog.ErrorContext(ctx, "Failed to start transaction", "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+				"Content-Type":                "application/json",
+			},
+			Body: `{"error": "Database connection failed"}`,
+		}, nil
+	}
+
+	// Check write access before paying for any embeddings
+	collectionId := req.CollectionId
+	if collectionId == "" {
+		collectionId = personalCollectionId(userId)
+	}
+	if err := tx.Authorize(ctx, collectionId); err != nil {
+		tx.Rollback()
+		if errors.Is(err, errCollectionForbidden) {
+			slog.WarnContext(ctx, "Ingest into collection denied", "collectionId", collectionId)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 403,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+					"Content-Type":                "application/json",
+				},
+				Body: `{"error": "You need the owner or editor role on this collection"}`,
+			}, nil
+		}
+		slog.ErrorContext(ctx, "Collection check failed", "error", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Headers: map[string]string{
 				"Access-Control-Allow-Origin": "*",
 				"Content-Type":                "application/json",
 			},
-			Body: `{"error": "Transaction failed"}`,
+			Body: `{"error": "Database error"}`,
 		}, nil
 	}
 
+	// A client-supplied document ID replaces what an earlier upload stored
+	if req.DocumentId != "" {
+		if err := tx.Replace(ctx, collectionId, meta.DocumentId); err != nil {
+			tx.Rollback()
+			slog.ErrorContext(ctx, "Replacing earlier chunks failed", "error", err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+					"Content-Type":                "application/json",
+				},
+				Body: `{"error": "Database error"}`,
+			}, nil
+		}
+	}
+
 	successCount := 0
+	quarantinedCount := 0
+	flaggedCount := 0
+	quarantine := envOrDefault("INJECTION_ACTION", InjectionAction) != "flag"
+	// One vault per document, so a value gets the same placeholder in every chunk
+	pii := redact.NewVault(envOrDefault("PII_REDACTION", PIIRedaction) == "on")
 
 	// Process each chunk
 	for i, chunkText := range chunks {
-		log.Printf("Processing chunk %d/%d for document: %s", i+1, len(chunks), req.DocumentName)
-
-		// Add delay between API calls to prevent rate limiting
-		if i > 0 {
-			time.Sleep(time.Duration(APICallDelay) * time.Millisecond)
-		}
+		slog.DebugContext(ctx, "Processing chunk", "chunk", i+1, "of", len(chunks))
 
 		// Generate embedding
-		embeddingVector, err := generateEmbedding(ctx, chunkText, apiKey)
+		// Only the masked text is sent to the provider; the original is stored for the owner
+		maskedChunk := pii.Redact(chunkText)
+
+		embeddingVector, embeddingTokens, err := d.generateEmbedding(ctx, maskedChunk, apiKey)
 		if err != nil {
-			log.Printf("Embedding generation failed for chunk %d: %v", i+1, err)
+			slog.ErrorContext(ctx, "Embedding generation failed", "chunk", i+1, "error", err)
 			tx.Rollback()
 			return events.APIGatewayProxyResponse{
 				StatusCode: 500,
@@ -347,17 +469,38 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			}, nil
 		}
 
+		d.recordUsage(ctx, userId, "", embeddingModelName(ctx), "embedding", TokenUsage{EmbeddingTokens: embeddingTokens})
+
+		// Chunks that look like prompt injection are stored for review and
+		// either quarantined so the assistant never retrieves them, or
+		// flagged so it fences them off with a warning
+		verdict := d.screenChunk(ctx, apiKey, userId, maskedChunk)
+		if verdict.Suspicious && quarantine {
+			slog.WarnContext(ctx, "Quarantining chunk", "chunk", i+1, "reasons", verdict.Reasons)
+			quarantinedCount++
+		} else if verdict.Suspicious {
+			slog.WarnContext(ctx, "Flagging chunk", "chunk", i+1, "reasons", verdict.Reasons)
+			flaggedCount++
+		}
+
 		// Insert into aiknowledge table with document name and user_id
-		// Use native array parameter - no manual string construction
-		_, err = tx.Exec(
-			"INSERT INTO aiknowledge (content, embedding, document_name, user_id) VALUES ($1, $2, $3, $4)",
-			chunkText,
-			embeddingVector, // Pass array directly
-			req.DocumentName,
-			userId,
-		)
+		insertStart := time.Now()
+		insertCtx, insertSpan := startSpan(ctx, "pgvector.insert_chunk", attribute.Int("ingest.chunk_index", i))
+		err = tx.Insert(insertCtx, Chunk{
+			Content:          chunkText,
+			Embedding:        embeddingVector,
+			DocumentName:     req.DocumentName,
+			TenantId:         tenant.Id,
+			CollectionId:     collectionId,
+			UserId:           userId,
+			Quarantined:      verdict.Suspicious && quarantine,
+			QuarantineReason: strings.Join(verdict.Reasons, ","),
+			Document:         meta,
+		})
+		endSpan(insertSpan, err)
+		recordStageLatency("insert", insertStart)
 		if err != nil {
-			log.Printf("Vector storage failed for chunk %d: %v", i+1, err)
+			slog.ErrorContext(ctx, "Vector storage failed", "chunk", i+1, "error", err)
 			tx.Rollback()
 			return events.APIGatewayProxyResponse{
 				StatusCode: 500,
@@ -372,8 +515,13 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	}
 
 	// Commit transaction - all chunks succeeded
-	if err := tx.Commit(); err != nil {
-		log.Printf("Transaction commit failed: %v", err)
+	commitStart := time.Now()
+	_, commitSpan := startSpan(ctx, "postgres.commit")
+	err = tx.Commit()
+	endSpan(commitSpan, err)
+	recordStageLatency("commit", commitStart)
+	if err != nil {
+		slog.ErrorContext(ctx, "Transaction commit failed", "error", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Headers: map[string]string{
@@ -384,9 +532,15 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}, nil
 	}
 
+	recordIngest(successCount, quarantinedCount)
+
 	response := IngestResponse{
-		Message: fmt.Sprintf("Document '%s' ingested successfully", req.DocumentName),
-		Chunks:  successCount,
+		Message:      fmt.Sprintf("Document '%s' ingested successfully", req.DocumentName),
+		DocumentId:   meta.DocumentId,
+		CollectionId: collectionId,
+		Chunks:       successCount,
+		Quarantined:  quarantinedCount,
+		Flagged:      flaggedCount,
 	}
 
 	responseBody, _ := json.Marshal(response)
@@ -402,5 +556,7 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 }
 
 func main() {
-	lambda.Start(handler)
+	initLogging()
+	initTracing(context.Background())
+	lambda.Start(newAWSDeps(context.Background()).handler)
 }
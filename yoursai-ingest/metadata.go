@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DocumentMetadata is what the assistant can filter a document's chunks on.
+type DocumentMetadata struct {
+	DocumentId string
+	Date       string // YYYY-MM-DD
+	Tags       []string
+	Metadata   map[string]interface{}
+}
+
+const documentDateLayout = "2006-01-02"
+
+// parseDocumentMetadata checks the request's tags, metadata and date and
+// takes the document ID from the request, assigning a new one when there is
+// none. Tags are trimmed and de-duplicated; the date defaults to today.
+func parseDocumentMetadata(req IngestRequest, now time.Time) (DocumentMetadata, error) {
+	meta := DocumentMetadata{
+		DocumentId: uuid.New().String(),
+		Date:       now.UTC().Format(documentDateLayout),
+		Tags:       []string{},
+		Metadata:   req.Metadata,
+	}
+
+	if req.DocumentId != "" {
+		if len(req.DocumentId) > MaxDocumentIdLen {
+			return meta, fmt.Errorf("documentId must be at most %d bytes", MaxDocumentIdLen)
+		}
+		meta.DocumentId = req.DocumentId
+	}
+
+	if len(req.Tags) > MaxTags {
+		return meta, fmt.Errorf("at most %d tags", MaxTags)
+	}
+	seen := map[string]bool{}
+	for _, tag := range req.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return meta, fmt.Errorf("tags must not be empty")
+		}
+		if len(tag) > MaxTagLength {
+			return meta, fmt.Errorf("tags must be at most %d bytes", MaxTagLength)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			meta.Tags = append(meta.Tags, tag)
+		}
+	}
+
+	if meta.Metadata == nil {
+		meta.Metadata = map[string]interface{}{}
+	}
+	raw, err := json.Marshal(meta.Metadata)
+	if err != nil {
+		return meta, fmt.Errorf("metadata is not valid JSON")
+	}
+	if len(raw) > MaxMetadataBytes {
+		return meta, fmt.Errorf("metadata is larger than %d bytes", MaxMetadataBytes)
+	}
+
+	if req.DocumentDate != "" {
+		date, err := time.Parse(documentDateLayout, req.DocumentDate)
+		if err != nil {
+			return meta, fmt.Errorf("documentDate must be YYYY-MM-DD")
+		}
+		meta.Date = date.Format(documentDateLayout)
+	}
+	return meta, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CloudWatch units used by our metrics.
+const (
+	UnitMilliseconds = "Milliseconds"
+	UnitCount        = "Count"
+	UnitNone         = "None"
+)
+
+// Metric is one value in an EMF record.
+type Metric struct {
+	Name  string
+	Value float64
+	Unit  string
+}
+
+var (
+	metricsMu  sync.Mutex
+	metricsOut io.Writer = os.Stdout
+)
+
+// putMetrics writes one CloudWatch Embedded Metric Format record to stdout.
+// In Lambda, CloudWatch Logs turns it into metrics under MetricsNamespace;
+// run locally, stdout is the sink. Every metric in the record shares the
+// given dimensions, plus Service.
+func putMetrics(dims map[string]string, metrics ...Metric) {
+	if len(metrics) == 0 || envOrDefault("METRICS", Metrics) != "on" {
+		return
+	}
+
+	record := map[string]interface{}{"Service": ServiceName}
+	dimNames := []string{"Service"}
+	keys := make([]string, 0, len(dims))
+	for k := range dims {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		record[k] = dims[k]
+		dimNames = append(dimNames, k)
+	}
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	for _, m := range metrics {
+		record[m.Name] = m.Value
+		definitions = append(definitions, map[string]string{"Name": m.Name, "Unit": m.Unit})
+	}
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  MetricsNamespace,
+			"Dimensions": [][]string{dimNames},
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Warn("Failed to encode metrics", "error", err)
+		return
+	}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsOut.Write(append(line, '\n'))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// recordStageLatency records how long a pipeline stage took since start.
+// Deferred with time.Now() as the argument, it times the whole function.
+func recordStageLatency(stage string, start time.Time) {
+	putMetrics(map[string]string{"Stage": stage},
+		Metric{Name: "StageLatency", Value: milliseconds(time.Since(start)), Unit: UnitMilliseconds})
+}
+
+// recordProviderCall records the latency of a call to provider/model and,
+// when it failed, an error by status code ("transport" when there was no
+// response).
+func recordProviderCall(provider, model string, start time.Time, resp *http.Response, err error) {
+	dims := map[string]string{"Provider": provider, "Model": model}
+	putMetrics(dims, Metric{Name: "ProviderLatency", Value: milliseconds(time.Since(start)), Unit: UnitMilliseconds})
+
+	status := "transport"
+	if resp != nil {
+		if resp.StatusCode == http.StatusOK {
+			return
+		}
+		status = strconv.Itoa(resp.StatusCode)
+	} else if err == nil {
+		return
+	}
+	putMetrics(map[string]string{"Provider": provider, "Model": model, "StatusCode": status},
+		Metric{Name: "ProviderErrors", Value: 1, Unit: UnitCount})
+}
+
+// recordRetry counts one retried request. The retry policy only sees the
+// URL, so the provider is inferred from the host.
+func recordRetry(host string) {
+	putMetrics(map[string]string{"Provider": providerForHost(host)},
+		Metric{Name: "Retries", Value: 1, Unit: UnitCount})
+}
+
+func providerForHost(host string) string {
+	switch {
+	case strings.HasSuffix(host, "googleapis.com"):
+		return "gemini"
+	case strings.HasSuffix(host, "openai.com"):
+		return "openai"
+	}
+	return host
+}
+
+// providerForModel finds the provider serving model from the throttle table,
+// which already lists every provider/model pair we call.
+func providerForModel(model string) string {
+	for key := range providerLimits {
+		if provider, m, ok := strings.Cut(key, "/"); ok && m == model {
+			return provider
+		}
+	}
+	return "unknown"
+}
+
+// recordTokenMetrics records the tokens spent on one call.
+func recordTokenMetrics(model, kind string, usage TokenUsage) {
+	dims := map[string]string{"Provider": providerForModel(model), "Model": model, "Kind": kind}
+	var metrics []Metric
+	for _, m := range []Metric{
+		{Name: "PromptTokens", Value: float64(usage.PromptTokens), Unit: UnitCount},
+		{Name: "CompletionTokens", Value: float64(usage.CompletionTokens), Unit: UnitCount},
+		{Name: "EmbeddingTokens", Value: float64(usage.EmbeddingTokens), Unit: UnitCount},
+	} {
+		if m.Value > 0 {
+			metrics = append(metrics, m)
+		}
+	}
+	putMetrics(dims, metrics...)
+}
+
+// recordIngest records the outcome of one ingested document.
+func recordIngest(chunks, quarantined int) {
+	putMetrics(nil,
+		Metric{Name: "ChunksIngested", Value: float64(chunks), Unit: UnitCount},
+		Metric{Name: "ChunksQuarantined", Value: float64(quarantined), Unit: UnitCount})
+}
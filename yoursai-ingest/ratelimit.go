@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"shared/ratelimit"
+)
+
+// newIngestRateLimiter builds the per-user ingest limiter
+// RATE_LIMIT_BACKEND names.
+func newIngestRateLimiter(ctx context.Context) ratelimit.Limiter {
+	backend := envOrDefault("RATE_LIMIT_BACKEND", RateLimitBackend)
+	if backend == "memory" {
+		return ratelimit.NewMemory(IngestRateLimitPerMin, IngestRateLimitWindow, nil)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Rate limiter falling back to memory backend", "error", err)
+		return ratelimit.NewMemory(IngestRateLimitPerMin, IngestRateLimitWindow, nil)
+	}
+	table := envOrDefault("RATE_LIMIT_TABLE", RateLimitTableName)
+	return ratelimit.NewDynamo(dynamodb.NewFromConfig(cfg), table, IngestRateLimitPerMin, IngestRateLimitWindow, nil)
+}
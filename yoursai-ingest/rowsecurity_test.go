@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestRowLevelSecurity applies db/migrations to a scratch schema and checks
+// the aiknowledge policies from the database side, with no WHERE clauses to
+// lean on. It needs YOURSAI_TEST_DATABASE_URL to name a Postgres database
+// the test may create schemas in, as a role without SUPERUSER or BYPASSRLS,
+// which RLS never applies to. CI runs it against a Postgres service
+// (.github/workflows/row-level-security.yml).
+func TestRowLevelSecurity(t *testing.T) {
+	dsn := os.Getenv("YOURSAI_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("YOURSAI_TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// One connection, so the search_path below applies to every query
+	db.SetMaxOpenConns(1)
+
+	var bypass bool
+	if err := db.QueryRowContext(ctx, `SELECT rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user`).Scan(&bypass); err != nil {
+		t.Fatal(err)
+	}
+	if bypass {
+		t.Skip("the test role bypasses row-level security")
+	}
+
+	schema := fmt.Sprintf("rls_test_%d", time.Now().UnixNano())
+	mustExec(t, db, "CREATE SCHEMA "+schema)
+	t.Cleanup(func() { db.Exec("DROP SCHEMA " + schema + " CASCADE") })
+	mustExec(t, db, "SET search_path TO "+schema)
+	// The base table predates the migrations; embedding is left out so the
+	// database does not need pgvector
+	mustExec(t, db, `CREATE TABLE aiknowledge (
+		id BIGSERIAL PRIMARY KEY, content TEXT NOT NULL, document_name TEXT NOT NULL, user_id TEXT NOT NULL)`)
+	migrations, _ := filepath.Glob("../db/migrations/*.sql")
+	sort.Strings(migrations)
+	for _, m := range migrations {
+		sqlText, err := os.ReadFile(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustExec(t, db, string(sqlText))
+	}
+
+	alice := Caller{TenantId: DefaultTenant, UserId: "alice", Principals: []string{"user:alice"}}
+	bob := Caller{TenantId: DefaultTenant, UserId: "bob", Principals: []string{"user:bob"}}
+	// alice's principal presented from another tenant
+	acme := Caller{TenantId: "acme", UserId: "acme#alice", Principals: []string{"user:alice"}}
+	// Cognito group names are not unique across tenants
+	dave := Caller{TenantId: DefaultTenant, UserId: "dave", Principals: []string{"team:eng"}}
+	acmeEng := Caller{TenantId: "acme", UserId: "acme#carol", Principals: []string{"team:eng"}}
+	mustExec(t, db, `INSERT INTO collections (collection_id, tenant_id, name, owner) VALUES ('eng-handbook', 'default', 'Handbook', 'team:eng')`)
+	mustExec(t, db, `INSERT INTO collection_members (collection_id, principal, role) VALUES ('eng-handbook', 'team:eng', 'editor')`)
+
+	// as runs fn in a transaction as caller and rolls back when fn fails
+	as := func(caller Caller, fn func(tx *sql.Tx) error) error {
+		tx, err := beginAs(ctx, db, caller)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+	insert := func(tx *sql.Tx, userId, collectionId, tenantId string) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO aiknowledge (content, document_name, user_id, collection_id, tenant_id)
+			VALUES ('Salary bands for 2024', 'pay.md', $1, $2, $3)`, userId, collectionId, tenantId)
+		return err
+	}
+	visible := func(caller Caller) int {
+		var n int
+		err := as(caller, func(tx *sql.Tx) error { return tx.QueryRowContext(ctx, `SELECT count(*) FROM aiknowledge`).Scan(&n) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	affected := func(caller Caller, statement string) int64 {
+		var n int64
+		err := as(caller, func(tx *sql.Tx) error {
+			res, err := tx.ExecContext(ctx, statement)
+			if err != nil {
+				return err
+			}
+			n, err = res.RowsAffected()
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+		return n
+	}
+
+	err = as(alice, func(tx *sql.Tx) error {
+		if err := (&pgChunkTx{tx: tx, caller: alice, now: time.Now}).Authorize(ctx, personalCollectionId("alice")); err != nil {
+			return err
+		}
+		return insert(tx, "alice", personalCollectionId("alice"), DefaultTenant)
+	})
+	if err != nil {
+		t.Fatalf("alice ingesting into her own collection: %v", err)
+	}
+	if err := as(bob, func(tx *sql.Tx) error {
+		return (&pgChunkTx{tx: tx, caller: bob, now: time.Now}).Authorize(ctx, personalCollectionId("bob"))
+	}); err != nil {
+		t.Fatalf("bob creating his collection: %v", err)
+	}
+
+	if n := visible(alice); n != 1 {
+		t.Fatalf("alice sees %d chunks, want 1", n)
+	}
+	if n := visible(bob); n != 0 {
+		t.Errorf("bob sees %d of alice's chunks", n)
+	}
+	if n := visible(acme); n != 0 {
+		t.Errorf("another tenant sees %d of alice's chunks", n)
+	}
+	var unscoped int
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM aiknowledge`).Scan(&unscoped); err != nil || unscoped != 0 {
+		t.Errorf("a query with no caller sees %d chunks (err %v), want 0", unscoped, err)
+	}
+
+	if n := affected(bob, `DELETE FROM aiknowledge`); n != 0 {
+		t.Errorf("bob deleted %d of alice's chunks", n)
+	}
+	if n := affected(acme, `DELETE FROM aiknowledge`); n != 0 {
+		t.Errorf("another tenant deleted %d of alice's chunks", n)
+	}
+	if n := affected(bob, `UPDATE aiknowledge SET content = 'tampered'`); n != 0 {
+		t.Errorf("bob updated %d of alice's chunks", n)
+	}
+
+	forbidden := []struct {
+		name   string
+		caller Caller
+		write  func(tx *sql.Tx) error
+	}{
+		{"bob writes into alice's collection", bob, func(tx *sql.Tx) error {
+			return insert(tx, "bob", personalCollectionId("alice"), DefaultTenant)
+		}},
+		{"bob writes as alice", bob, func(tx *sql.Tx) error {
+			return insert(tx, "alice", personalCollectionId("bob"), DefaultTenant)
+		}},
+		{"bob writes into another tenant", bob, func(tx *sql.Tx) error {
+			return insert(tx, "bob", personalCollectionId("bob"), "acme")
+		}},
+		{"another tenant's team writes into a same-named team's collection", acmeEng, func(tx *sql.Tx) error {
+			return insert(tx, "acme#carol", "eng-handbook", "acme")
+		}},
+	}
+	for _, f := range forbidden {
+		if err := as(f.caller, f.write); err == nil {
+			t.Errorf("%s: insert succeeded, want a policy violation", f.name)
+		}
+	}
+	if err := as(dave, func(tx *sql.Tx) error { return insert(tx, "dave", "eng-handbook", DefaultTenant) }); err != nil {
+		t.Errorf("team member writing into the team's collection: %v", err)
+	}
+	if n := visible(acmeEng); n != 0 {
+		t.Errorf("another tenant's team sees %d of the team's chunks", n)
+	}
+	err = as(acme, func(tx *sql.Tx) error {
+		return (&pgChunkTx{tx: tx, caller: acme, now: time.Now}).Authorize(ctx, personalCollectionId("alice"))
+	})
+	if !errors.Is(err, errCollectionForbidden) {
+		t.Errorf("another tenant authorizing alice's collection: %v, want errCollectionForbidden", err)
+	}
+
+	if n := visible(alice); n != 1 {
+		t.Errorf("alice sees %d chunks after the attempts, want her 1", n)
+	}
+	if n := affected(alice, `DELETE FROM aiknowledge`); n != 1 {
+		t.Errorf("alice deleted %d of her chunks, want 1", n)
+	}
+}
+
+func mustExec(t *testing.T, db *sql.DB, statement string) {
+	t.Helper()
+	if _, err := db.Exec(statement); err != nil {
+		t.Fatalf("%v\n%s", err, statement)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/tenant"
+)
+
+// Tenants are resolved by shared/tenant, as in yoursai-assistant, so a
+// document is stored under the tenant, user key and embedding provider the
+// assistant will search with. ChatModel and Persona only matter to the
+// assistant.
+type (
+	Tenant       = tenant.Tenant
+	TenantConfig = tenant.Config
+	TenantStore  = tenant.Store
+)
+
+var tenancy = tenant.Settings{
+	Claim:             TenantClaim,
+	GroupPrefix:       TenantGroupPrefix,
+	Default:           DefaultTenant,
+	SSMKeyPath:        SSMKeyPath,
+	DailyTokenQuota:   DailyTokenQuota,
+	MonthlyTokenQuota: MonthlyTokenQuota,
+}
+
+// tenantForClaims resolves the tenant a token belongs to.
+func (d *Deps) tenantForClaims(ctx context.Context, claims map[string]interface{}) (Tenant, error) {
+	return tenancy.ForClaims(ctx, d.Tenants, claims)
+}
+
+// tenantErrorResponse is 403 for a token whose tenant cannot be served and
+// 500 when the configuration could not be read or is broken.
+func tenantErrorResponse(err error) events.APIGatewayProxyResponse {
+	if tenant.Rejected(err) {
+		return errorResponse(403, "Your organization is not set up for this service")
+	}
+	return errorResponse(500, "Failed to load organization settings")
+}
+
+func withTenant(ctx context.Context, t Tenant) context.Context {
+	return tenant.NewContext(ctx, t)
+}
+
+// tenantFrom returns the request's tenant; outside a request it is
+// DefaultTenant with no overrides.
+func tenantFrom(ctx context.Context) Tenant {
+	return tenancy.FromContext(ctx)
+}
+
+// isGeminiAPI and isOpenAIAPI report the request tenant's provider.
+func isGeminiAPI(ctx context.Context) bool {
+	return tenantFrom(ctx).Provider() == tenant.Gemini
+}
+
+func isOpenAIAPI(ctx context.Context) bool {
+	return tenantFrom(ctx).Provider() == tenant.OpenAI
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"shared/throttle"
+)
+
+// providerLimits is keyed by "provider/model". Limits apply per Lambda
+// container, so keep them at the account quota divided by expected
+// concurrency when many containers are warm.
+var providerLimits = map[string]throttle.Limit{
+	"gemini/" + GeminiEmbeddingModel:  {RPM: GeminiEmbeddingRPM},
+	"openai/" + OpenAIEmbeddingModel:  {RPM: OpenAIEmbeddingRPM, TPM: OpenAIEmbeddingTPM},
+	"gemini/" + GeminiClassifierModel: {RPM: GeminiChatRPM, TPM: GeminiChatTPM},
+	"openai/" + OpenAIClassifierModel: {RPM: OpenAIChatRPM, TPM: OpenAIChatTPM},
+}
+
+// providerDefaultLimits covers models missing from providerLimits, such as
+// a tenant's own chat model.
+var providerDefaultLimits = map[string]throttle.Limit{
+	"gemini": {RPM: GeminiChatRPM, TPM: GeminiChatTPM},
+	"openai": {RPM: OpenAIChatRPM, TPM: OpenAIChatTPM},
+}
+
+// throttleProvider waits in set for capacity to send a call of roughly
+// tokens tokens to provider/model on the key stored at keyPath. Each key
+// gets its own buckets, so tenants billing their own keys never wait on
+// each other.
+func throttleProvider(ctx context.Context, set *throttle.Set, keyPath, provider, model string, tokens int) error {
+	limit, known := providerLimits[provider+"/"+model]
+	if !known {
+		if limit, known = providerDefaultLimits[provider]; !known {
+			return nil
+		}
+	}
+
+	key := keyPath + "|" + provider + "/" + model
+	start := time.Now()
+	err := set.Wait(ctx, key, limit, tokens)
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		slog.InfoContext(ctx, "Throttled provider call", "limit", key, "waited", waited.Round(time.Millisecond).String())
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracer         = otel.Tracer(ServiceName)
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// initTracing installs the exporter chosen by TRACING_EXPORTER: "otlp"
+// (configured through the standard OTEL_EXPORTER_OTLP_* variables),
+// "stdout", or "none", which leaves the no-op tracer in place.
+func initTracing(ctx context.Context) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch envOrDefault("TRACING_EXPORTER", TracingExporter) {
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	default:
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Tracing disabled, exporter failed to start", "error", err)
+		return
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+}
+
+// flushTraces exports the invocation's spans before Lambda freezes the
+// container, which could otherwise hold them until the next request.
+func flushTraces(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		slog.WarnContext(ctx, "Failed to flush traces", "error", err)
+	}
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// usageAttributes describes token counts on LLM and embedding spans.
+func usageAttributes(usage TokenUsage) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("llm.usage.prompt_tokens", usage.PromptTokens),
+		attribute.Int("llm.usage.completion_tokens", usage.CompletionTokens),
+		attribute.Int("llm.usage.embedding_tokens", usage.EmbeddingTokens),
+	}
+}
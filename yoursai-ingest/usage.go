@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+
+	"shared/llm"
+)
+
+// TokenUsage counts the tokens consumed by one or more provider calls.
+type TokenUsage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	EmbeddingTokens  int `json:"embeddingTokens"`
+}
+
+func (u TokenUsage) Total() int {
+	return u.PromptTokens + u.CompletionTokens + u.EmbeddingTokens
+}
+
+func (u *TokenUsage) Add(other TokenUsage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.EmbeddingTokens += other.EmbeddingTokens
+}
+
+// UsageEvent is one ledger entry: a single LLM or embedding call.
+type UsageEvent struct {
+	UserId    string
+	SessionId string
+	Model     string
+	Kind      string // "chat" or "embedding"
+	Usage     TokenUsage
+	Time      time.Time
+}
+
+// UsageStore persists ledger entries and the per-day, per-month and
+// per-session totals derived from them.
+type UsageStore interface {
+	Record(ctx context.Context, event UsageEvent) error
+	Totals(ctx context.Context, userId string, keys ...string) (map[string]TokenUsage, error)
+}
+
+func dayKey(t time.Time) string   { return "day#" + t.UTC().Format("2006-01-02") }
+func monthKey(t time.Time) string { return "month#" + t.UTC().Format("2006-01") }
+func sessionKey(id string) string { return "session#" + id }
+
+// parseTokenUsage reads Gemini usageMetadata or OpenAI usage from a decoded
+// generation response.
+func parseTokenUsage(resp map[string]interface{}) TokenUsage {
+	prompt, completion := llm.Usage(resp)
+	return TokenUsage{PromptTokens: prompt, CompletionTokens: completion}
+}
+
+// estimateTokens approximates token count for providers that do not report it,
+// using the same 1 token ≈ 0.75 words ratio as chunker.Split.
+func estimateTokens(text string) int {
+	return (len(strings.Fields(text))*4 + 2) / 3
+}
+
+type memoryUsageStore struct {
+	mu     sync.Mutex
+	events []UsageEvent
+	totals map[string]TokenUsage
+}
+
+func newMemoryUsageStore() *memoryUsageStore {
+	return &memoryUsageStore{totals: map[string]TokenUsage{}}
+}
+
+func (m *memoryUsageStore) Record(ctx context.Context, event UsageEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events = append(m.events, event)
+	keys := []string{dayKey(event.Time), monthKey(event.Time)}
+	if event.SessionId != "" {
+		keys = append(keys, sessionKey(event.SessionId))
+	}
+	for _, k := range keys {
+		total := m.totals[event.UserId+"|"+k]
+		total.Add(event.Usage)
+		m.totals[event.UserId+"|"+k] = total
+	}
+	return nil
+}
+
+func (m *memoryUsageStore) Totals(ctx context.Context, userId string, keys ...string) (map[string]TokenUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := map[string]TokenUsage{}
+	for _, k := range keys {
+		result[k] = m.totals[userId+"|"+k]
+	}
+	return result, nil
+}
+
+// dynamoUsageStore keeps the ledger and the running totals in one table keyed
+// by userId and recordKey. Ledger rows use "event#<time>#<id>", totals use
+// "day#", "month#" and "session#" keys.
+type dynamoUsageStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func (d *dynamoUsageStore) Record(ctx context.Context, event UsageEvent) error {
+	uid := &types.AttributeValueMemberS{Value: event.UserId}
+	eventKey := fmt.Sprintf("event#%s#%s", event.Time.UTC().Format(time.RFC3339Nano), uuid.New().String())
+
+	items := []types.TransactWriteItem{{
+		Put: &types.Put{
+			TableName: aws.String(d.table),
+			Item: map[string]types.AttributeValue{
+				"userId":           uid,
+				"recordKey":        &types.AttributeValueMemberS{Value: eventKey},
+				"sessionId":        &types.AttributeValueMemberS{Value: event.SessionId},
+				"model":            &types.AttributeValueMemberS{Value: event.Model},
+				"kind":             &types.AttributeValueMemberS{Value: event.Kind},
+				"timestamp":        &types.AttributeValueMemberS{Value: event.Time.Format(time.RFC3339)},
+				"promptTokens":     numberAttr(event.Usage.PromptTokens),
+				"completionTokens": numberAttr(event.Usage.CompletionTokens),
+				"embeddingTokens":  numberAttr(event.Usage.EmbeddingTokens),
+				"expiresAt":        numberAttr(int(event.Time.AddDate(0, 0, UsageLedgerRetentionDays).Unix())),
+			},
+		},
+	}}
+
+	keys := []string{dayKey(event.Time), monthKey(event.Time)}
+	if event.SessionId != "" {
+		keys = append(keys, sessionKey(event.SessionId))
+	}
+	for _, k := range keys {
+		items = append(items, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName: aws.String(d.table),
+				Key: map[string]types.AttributeValue{
+					"userId":    uid,
+					"recordKey": &types.AttributeValueMemberS{Value: k},
+				},
+				UpdateExpression: aws.String("ADD promptTokens :p, completionTokens :c, embeddingTokens :e"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":p": numberAttr(event.Usage.PromptTokens),
+					":c": numberAttr(event.Usage.CompletionTokens),
+					":e": numberAttr(event.Usage.EmbeddingTokens),
+				},
+			},
+		})
+	}
+
+	_, err := d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	return err
+}
+
+func (d *dynamoUsageStore) Totals(ctx context.Context, userId string, keys ...string) (map[string]TokenUsage, error) {
+	result := map[string]TokenUsage{}
+	for _, k := range keys {
+		out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(d.table),
+			Key: map[string]types.AttributeValue{
+				"userId":    &types.AttributeValueMemberS{Value: userId},
+				"recordKey": &types.AttributeValueMemberS{Value: k},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		result[k] = TokenUsage{
+			PromptTokens:     intAttr(out.Item, "promptTokens"),
+			CompletionTokens: intAttr(out.Item, "completionTokens"),
+			EmbeddingTokens:  intAttr(out.Item, "embeddingTokens"),
+		}
+	}
+	return result, nil
+}
+
+func numberAttr(n int) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.Itoa(n)}
+}
+
+func intAttr(item map[string]types.AttributeValue, name string) int {
+	attr, ok := item[name].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(attr.Value)
+	return n
+}
+
+// newUsageStore builds the ledger USAGE_BACKEND names.
+func newUsageStore(ctx context.Context) UsageStore {
+	if envOrDefault("USAGE_BACKEND", UsageBackend) == "memory" {
+		return newMemoryUsageStore()
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Usage store falling back to memory backend", "error", err)
+		return newMemoryUsageStore()
+	}
+	return &dynamoUsageStore{
+		client: dynamodb.NewFromConfig(cfg),
+		table:  envOrDefault("USAGE_TABLE", UsageTableName),
+	}
+}
+
+// recordUsage writes a ledger entry and logs instead of failing the request,
+// since the embedding has already been paid for by the time we get here.
+func (d *Deps) recordUsage(ctx context.Context, userId, sessionId, model, kind string, usage TokenUsage) {
+	if usage.Total() == 0 {
+		return
+	}
+	recordTokenMetrics(model, kind, usage)
+	err := d.Usage.Record(ctx, UsageEvent{
+		UserId:    userId,
+		SessionId: sessionId,
+		Model:     model,
+		Kind:      kind,
+		Usage:     usage,
+		Time:      d.Now(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record usage", "error", err)
+	}
+}
+
+// QuotaStatus reports a user's consumption against the daily and monthly quotas.
+type QuotaStatus struct {
+	Daily        TokenUsage `json:"daily"`
+	Monthly      TokenUsage `json:"monthly"`
+	DailyQuota   int        `json:"dailyQuota"`
+	MonthlyQuota int        `json:"monthlyQuota"`
+}
+
+// Exceeded returns how long the caller must wait before the exhausted quota
+// resets, or zero when both quotas still have room.
+func (q QuotaStatus) Exceeded(now time.Time) time.Duration {
+	now = now.UTC()
+	if q.MonthlyQuota > 0 && q.Monthly.Total() >= q.MonthlyQuota {
+		firstOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return firstOfMonth.AddDate(0, 1, 0).Sub(now)
+	}
+	if q.DailyQuota > 0 && q.Daily.Total() >= q.DailyQuota {
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return midnight.AddDate(0, 0, 1).Sub(now)
+	}
+	return 0
+}
+
+func (d *Deps) getQuotaStatus(ctx context.Context, userId string, now time.Time) (QuotaStatus, error) {
+	totals, err := d.Usage.Totals(ctx, userId, dayKey(now), monthKey(now))
+	if err != nil {
+		return QuotaStatus{}, err
+	}
+	daily, monthly := tenantFrom(ctx).Quotas()
+	return QuotaStatus{
+		Daily:        totals[dayKey(now)],
+		Monthly:      totals[monthKey(now)],
+		DailyQuota:   daily,
+		MonthlyQuota: monthly,
+	}, nil
+}
+
+func quotaExceededResponse(wait time.Duration) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: 429,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":   "*",
+			"Access-Control-Expose-Headers": "Retry-After",
+			"Content-Type":                  "application/json",
+			"Retry-After":                   strconv.Itoa(int(wait.Seconds())),
+		},
+		Body: `{"error": "Token quota exceeded. Please try again later."}`,
+	}
+}